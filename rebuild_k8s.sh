@@ -11,13 +11,18 @@ docker compose build
 # Create temporary key if needed.
 ./create_key.sh
 
+# Create an operator admin-api key if needed (for curl and the web UI).
+[[ -f dev/admin-key ]] || openssl rand -hex 32 > dev/admin-key
+ADMIN_KEY="dev:operator:$(printf %s "$(cat dev/admin-key)" | sha256sum | cut -d' ' -f1)"
+
 # Install helm charts.
 cd helm
 kubectl -n sftp delete secret sftp-hostkey --ignore-not-found
 kubectl -n sftp create secret generic sftp-hostkey \
   --from-file=ssh_host_ed25519_key=../dev/sftp_host
 helm uninstall sftp -n sftp || true
-helm upgrade --install sftp ./sftp-service -n sftp --create-namespace --set-string seed.alicePublicKey="$(cat ../dev/alice.pub)"
+helm upgrade --install sftp ./sftp-service -n sftp --create-namespace --set-string seed.alicePublicKey="$(cat ../dev/alice.pub)" \
+  --set-string adminApi.auth.apiKeys="$ADMIN_KEY"
 
 # Install the Alice key into Vault.
 cd ..
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+
+	hv "github.com/hashicorp/vault/api"
+)
+
+// Per-user activity. sftp-server records each user's last login (time,
+// source IP, key fingerprint) and last upload and download under
+// VAULT_ACTIVITY_PREFIX, one KV v2 secret per user. It is read-only here:
+// GET /users/{username} returns it as "activity", and GET /users can sort
+// by its times. Upload and download times may lag by up to a minute.
+
+// userActivity is one user's record. Times are RFC 3339 UTC.
+type userActivity struct {
+	LastLoginAt    string `json:"lastLoginAt,omitempty"`
+	LastLoginIP    string `json:"lastLoginIP,omitempty"`
+	LastLoginKey   string `json:"lastLoginKey,omitempty"` // SHA256 fingerprint; empty for password logins
+	LastUploadAt   string `json:"lastUploadAt,omitempty"`
+	LastDownloadAt string `json:"lastDownloadAt,omitempty"`
+}
+
+// readActivity reads a user's activity record; none yet is not an error.
+func readActivity(ctx context.Context, c *hv.Client, activityPrefix, username string) (userActivity, error) {
+	var a userActivity
+	dataPath, _, _, err := kv2Paths(activityPrefix, username)
+	if err != nil {
+		return a, err
+	}
+	sec, err := c.Logical().ReadWithContext(ctx, dataPath)
+	if err != nil || sec == nil || sec.Data == nil {
+		return a, err
+	}
+	m, _ := sec.Data["data"].(map[string]any)
+	a.LastLoginAt, _ = m["lastLoginAt"].(string)
+	a.LastLoginIP, _ = m["lastLoginIP"].(string)
+	a.LastLoginKey, _ = m["lastLoginKey"].(string)
+	a.LastUploadAt, _ = m["lastUploadAt"].(string)
+	a.LastDownloadAt, _ = m["lastDownloadAt"].(string)
+	return a, nil
+}
+
+// activityOf returns u's activity from the index, or none.
+func activityOf(u User) userActivity {
+	if u.Activity == nil {
+		return userActivity{}
+	}
+	return *u.Activity
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// Audit store: every mutation event (auditRequest) is also written to Vault
+// as one KV v2 secret, VAULT_AUDIT_PREFIX/<YYYY-MM-DD>/<time>-<random>, so
+// the history survives restarts, is shared by all replicas and can be
+// queried with GET /api/v1/audit. Authentication failures are only logged.
+//
+// Writes are best effort: the change itself already happened, so a failed
+// write is logged but does not fail the request.
+
+const auditDayLayout = "2006-01-02"
+
+// Every event is its own secret, so a query costs one Vault LIST per day
+// and one read per event. One request scans at most this many days and
+// events; the rest is left to nextCursor.
+const (
+	auditMaxDays  = 31
+	auditMaxReads = 2000
+)
+
+type auditStore struct {
+	c      *hv.Client
+	prefix string
+}
+
+// auditLog is set up by main; nil keeps events in the log only.
+var auditLog *auditStore
+
+func (s *auditStore) store(ev auditEvent) {
+	if s == nil {
+		return
+	}
+	ts, err := time.Parse(time.RFC3339Nano, ev.Ts)
+	if err != nil {
+		ts = time.Now().UTC()
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	name := ts.Format(auditDayLayout) + "/" + ts.Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix)
+
+	dataPath, _, _, err := kv2Paths(s.prefix, name)
+	if err == nil {
+		var m map[string]any
+		b, _ := json.Marshal(ev)
+		_ = json.Unmarshal(b, &m)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = s.c.Logical().WriteWithContext(ctx, dataPath, map[string]any{"data": m})
+		cancel()
+	}
+	if err != nil {
+		log.Printf("audit store: %s %s: %v", ev.Action, ev.Target, err)
+	}
+}
+
+// auditQuery selects events; empty fields match everything.
+type auditQuery struct {
+	actor, target, action, requestID string
+	since, until                     time.Time
+	limit                            int
+	cursor                           *auditCursor
+}
+
+// auditCursor is where the next page resumes: day folder Day, events
+// named before Before (all of them when empty).
+type auditCursor struct {
+	Day    string `json:"d"`
+	Before string `json:"b,omitempty"`
+}
+
+func (c auditCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAuditCursor(raw string) (*auditCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	var c auditCursor
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err == nil {
+		_, err = time.Parse(auditDayLayout, c.Day)
+	}
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// query returns matching events, newest first, scanning one day folder at a
+// time from until (or the cursor) back to since. It stops after q.limit
+// matches, auditMaxDays folders or auditMaxReads events and then returns
+// the cursor of the rest; the cursor is nil when the range is exhausted.
+func (s *auditStore) query(ctx context.Context, q auditQuery) ([]auditEvent, *auditCursor, error) {
+	out := []auditEvent{}
+	dataBase, _, metadataBase, err := kv2Paths(s.prefix, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	first := q.since.UTC().Truncate(24 * time.Hour)
+	day, before := q.until.UTC().Truncate(24*time.Hour), ""
+	if q.cursor != nil {
+		day, _ = time.Parse(auditDayLayout, q.cursor.Day)
+		before = q.cursor.Before
+	}
+	days, reads := 0, 0
+	for ; !day.Before(first); day, before = day.AddDate(0, 0, -1), "" {
+		dir := day.Format(auditDayLayout)
+		if days == auditMaxDays {
+			return out, &auditCursor{Day: dir}, nil
+		}
+		days++
+		sec, err := s.c.Logical().ListWithContext(ctx, metadataBase+"/"+dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sec == nil || sec.Data == nil {
+			continue
+		}
+		names := asStrings(sec.Data["keys"])
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		for _, name := range names {
+			if before != "" && name >= before {
+				continue
+			}
+			ts, err := time.Parse("20060102T150405.000000000Z", strings.SplitN(name, "-", 2)[0])
+			if err != nil || ts.Before(q.since) || ts.After(q.until) {
+				continue
+			}
+			if reads == auditMaxReads {
+				return out, &auditCursor{Day: dir, Before: before}, nil
+			}
+			reads++
+			before = name
+			ev, err := s.read(ctx, dataBase+"/"+dir+"/"+name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ev == nil || !q.matches(*ev) {
+				continue
+			}
+			out = append(out, *ev)
+			if len(out) >= q.limit {
+				return out, &auditCursor{Day: dir, Before: name}, nil
+			}
+		}
+	}
+	return out, nil, nil
+}
+
+func (s *auditStore) read(ctx context.Context, path string) (*auditEvent, error) {
+	sec, err := s.c.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(sec.Data["data"])
+	if err != nil {
+		return nil, err
+	}
+	var ev auditEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return nil, fmt.Errorf("audit event %s: %w", path, err)
+	}
+	return &ev, nil
+}
+
+func (q auditQuery) matches(ev auditEvent) bool {
+	return (q.actor == "" || ev.User == q.actor) &&
+		(q.target == "" || ev.Target == q.target) &&
+		(q.action == "" || ev.Action == q.action) &&
+		(q.requestID == "" || ev.RequestID == q.requestID)
+}
+
+// auditPage is one page of GET /audit. Fewer than limit events with a
+// NextCursor means the scan budget ran out, not that nothing is left.
+type auditPage struct {
+	OK         bool         `json:"ok"`
+	Data       []auditEvent `json:"data"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// mountAuditRoutes adds GET /audit. Query parameters: actor, target, action,
+// requestId, since and until (RFC 3339 or a duration back from now such as
+// 24h; default the last 7 days), limit (default 100, at most 1000) and
+// cursor (nextCursor of the previous page, with the same other parameters).
+func mountAuditRoutes(r chi.Router) {
+	r.With(requireUnscoped).Get("/audit", func(w http.ResponseWriter, req *http.Request) {
+		if auditLog == nil {
+			writeAPIError(w, http.StatusNotImplemented, "AUDIT_DISABLED", "audit store disabled (VAULT_AUDIT_PREFIX=off)", nil)
+			return
+		}
+		qs := req.URL.Query()
+		now := time.Now().UTC()
+		q := auditQuery{
+			actor:     strings.TrimSpace(qs.Get("actor")),
+			target:    strings.TrimSpace(qs.Get("target")),
+			action:    strings.TrimSpace(qs.Get("action")),
+			requestID: strings.TrimSpace(qs.Get("requestId")),
+			since:     now.Add(-7 * 24 * time.Hour),
+			until:     now,
+			limit:     parseLimit(qs.Get("limit"), 1000),
+		}
+		if qs.Get("limit") == "" {
+			q.limit = 100
+		}
+		for name, dst := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+			raw := strings.TrimSpace(qs.Get(name))
+			if raw == "" {
+				continue
+			}
+			t, err := parseAuditTime(raw, now)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error(), map[string]any{name: raw})
+				return
+			}
+			*dst = t
+		}
+		if raw := strings.TrimSpace(qs.Get("cursor")); raw != "" {
+			c, err := decodeAuditCursor(raw)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error(), nil)
+				return
+			}
+			q.cursor = c
+		}
+		if q.until.Before(q.since) {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", "until is before since", nil)
+			return
+		}
+		if q.until.Sub(q.since) > 366*24*time.Hour {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", "at most one year can be queried at once", nil)
+			return
+		}
+
+		events, next, err := auditLog.query(req.Context(), q)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		page := auditPage{OK: true, Data: events}
+		if next != nil {
+			page.NextCursor = next.encode()
+		}
+		writeJSON(w, http.StatusOK, page)
+	})
+}
+
+// parseAuditTime accepts RFC 3339 or a duration before now ("36h").
+func parseAuditTime(raw string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if days, err := strconv.Atoi(strings.TrimSuffix(raw, "d")); err == nil && strings.HasSuffix(raw, "d") && days >= 0 {
+		return now.AddDate(0, 0, -days), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or a duration like 24h or 7d", raw)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// Authentication and role-based authorization for /api/v1.
+//
+// Requests carry "Authorization: Bearer <credential>", which is either a
+// static API key or an OIDC access token (JWT):
+//
+//	ADMIN_API_KEYS   name:role[@tenant]:sha256hex, comma separated; only
+//	                 the SHA-256 of each key is configured
+//	ADMIN_OIDC_*     issuer, audience and a local JWKS file or the issuer's
+//	                 published keys (see newOIDCVerifier)
+//
+// Roles are cumulative:
+//
+//	viewer    read users, groups, holds and bans
+//	operator  also create and update users and group membership,
+//	          enroll/remove TOTP, clear bans
+//	admin     also delete users, manage groups, place and release legal holds
+//
+// A principal with a tenant only sees and changes users and groups of that
+// tenant; bans are global and need a principal without one.
+// ADMIN_AUTH_DISABLED=true turns all of this off (everyone is an anonymous
+// admin) for development.
+
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func parseRole(s string) (role, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "viewer":
+		return roleViewer, true
+	case "operator":
+		return roleOperator, true
+	case "admin":
+		return roleAdmin, true
+	}
+	return roleNone, false
+}
+
+// principal is the authenticated caller.
+type principal struct {
+	Name   string
+	Method string // "apikey", "oidc" or "none"
+	Role   role
+	Tenant string // "" = all tenants
+}
+
+// actor is how the principal appears in audit events.
+func (p principal) actor() string {
+	if p.Method == "" {
+		return "anonymous"
+	}
+	if p.Method == "none" {
+		return p.Name
+	}
+	return p.Method + ":" + p.Name
+}
+
+type principalKey struct{}
+
+func principalFrom(req *http.Request) principal {
+	p, _ := req.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+var (
+	errNoCredentials  = errors.New("missing bearer credentials")
+	errBadCredentials = errors.New("invalid credentials")
+	errNoRole         = errors.New("no admin-api role granted")
+)
+
+type apiKey struct {
+	name   string
+	role   role
+	tenant string
+	sum    []byte
+}
+
+type authenticator struct {
+	disabled bool
+	keys     []apiKey
+	oidc     *oidcVerifier
+}
+
+// newAuthenticator reads ADMIN_API_KEYS, ADMIN_OIDC_* and
+// ADMIN_AUTH_DISABLED. Having no way to authenticate is an error.
+func newAuthenticator() (*authenticator, error) {
+	a := &authenticator{disabled: strings.EqualFold(env("ADMIN_AUTH_DISABLED", "false"), "true")}
+	if a.disabled {
+		log.Printf("WARNING: admin-api authentication disabled (ADMIN_AUTH_DISABLED=true); every request is an admin")
+		return a, nil
+	}
+
+	for _, entry := range strings.Split(os.Getenv("ADMIN_API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		k, err := parseAPIKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_API_KEYS: %w", err)
+		}
+		a.keys = append(a.keys, k)
+	}
+
+	v, err := newOIDCVerifier()
+	if err != nil {
+		return nil, err
+	}
+	a.oidc = v
+
+	if len(a.keys) == 0 && a.oidc == nil {
+		return nil, errors.New("no admin authentication configured: set ADMIN_API_KEYS and/or ADMIN_OIDC_AUDIENCE (or ADMIN_AUTH_DISABLED=true for development)")
+	}
+	return a, nil
+}
+
+// parseAPIKey parses "name:role[@tenant]:sha256hex".
+func parseAPIKey(entry string) (apiKey, error) {
+	parts := strings.Split(entry, ":")
+	if len(parts) != 3 {
+		return apiKey{}, fmt.Errorf("%q: want name:role[@tenant]:sha256hex", entry)
+	}
+	name := strings.TrimSpace(parts[0])
+	roleName, tenant, _ := strings.Cut(parts[1], "@")
+	r, ok := parseRole(roleName)
+	if name == "" || !ok {
+		return apiKey{}, fmt.Errorf("%q: want name:role[@tenant]:sha256hex with role viewer, operator or admin", entry)
+	}
+	if tenant != "" && !usernameRe.MatchString(tenant) {
+		return apiKey{}, fmt.Errorf("%q: invalid tenant", entry)
+	}
+	sum, err := hex.DecodeString(strings.TrimSpace(parts[2]))
+	if err != nil || len(sum) != sha256.Size {
+		return apiKey{}, fmt.Errorf("key %s: hash must be 64 hex digits (sha256sum of the key)", name)
+	}
+	return apiKey{name: name, role: r, tenant: tenant, sum: sum}, nil
+}
+
+func (a *authenticator) authenticate(req *http.Request) (principal, error) {
+	if a.disabled {
+		return principal{Name: "anonymous", Method: "none", Role: roleAdmin}, nil
+	}
+	scheme, cred, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	cred = strings.TrimSpace(cred)
+	if !strings.EqualFold(scheme, "Bearer") || cred == "" {
+		return principal{}, errNoCredentials
+	}
+
+	// JWTs have three dot-separated parts; API keys are opaque
+	if a.oidc != nil && strings.Count(cred, ".") == 2 {
+		return a.oidc.verify(req.Context(), cred)
+	}
+	sum := sha256.Sum256([]byte(cred))
+	var found *apiKey
+	for i := range a.keys {
+		// compare against every key so timing doesn't reveal which matched
+		if subtle.ConstantTimeCompare(sum[:], a.keys[i].sum) == 1 {
+			found = &a.keys[i]
+		}
+	}
+	if found == nil {
+		return principal{}, errBadCredentials
+	}
+	return principal{Name: found.name, Method: "apikey", Role: found.role, Tenant: found.tenant}, nil
+}
+
+// middleware authenticates every request and stores the principal in the
+// request context.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p, err := a.authenticate(req)
+		if err != nil {
+			audit(p.actor(), req.RemoteAddr, "admin_auth_failed", req.Method+" "+req.URL.Path, "", err)
+			if errors.Is(err, errNoRole) {
+				writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sftp-admin-api"`)
+			writeAPIError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "valid bearer credentials required", nil)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, p)))
+	})
+}
+
+// requireRole refuses principals below min.
+func requireRole(min role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			p := principalFrom(req)
+			if p.Role < min {
+				err := fmt.Errorf("role %s required", min)
+				audit(p.actor(), req.RemoteAddr, "admin_forbidden", req.Method+" "+req.URL.Path, "", err)
+				writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), map[string]any{"role": p.Role.String()})
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// requireUnscoped refuses tenant-scoped principals (for global resources).
+func requireUnscoped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := principalFrom(req)
+		if p.Tenant != "" {
+			err := errors.New("not available to tenant-scoped principals")
+			audit(p.actor(), req.RemoteAddr, "admin_forbidden", req.Method+" "+req.URL.Path, "", err)
+			writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// tenantScope hides users of other tenants from tenant-scoped principals
+// on /users/{username} routes: they get 404 as if the user did not exist.
+// Deleted users are matched on the tenant kept in their metadata. Users
+// that don't exist pass; the handlers answer 404 themselves.
+func tenantScope(c *hv.Client, usersPrefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			p := principalFrom(req)
+			username := chi.URLParam(req, "username")
+			if p.Tenant == "" || !usernameRe.MatchString(username) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			u, err := readUserKV2(req.Context(), c, usersPrefix, username)
+			if errors.Is(err, errDeleted) {
+				var h userHistory
+				h, err = readUserHistory(req.Context(), c, usersPrefix, username)
+				u.Tenant = h.Tenant
+			}
+			switch {
+			case errors.Is(err, errNotFound):
+			case err != nil:
+				writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+				return
+			case u.Tenant != p.Tenant:
+				writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// inTenantScope reports whether a user of tenant is visible to the
+// principal of req. Unscoped principals see every tenant.
+func inTenantScope(req *http.Request, tenant string) bool {
+	p := principalFrom(req)
+	return p.Tenant == "" || p.Tenant == tenant
+}
+
+// scopeUser puts u in the tenant of a tenant-scoped principal, refusing
+// any other tenant.
+func scopeUser(req *http.Request, u *User) error {
+	p := principalFrom(req)
+	if p.Tenant == "" {
+		return nil
+	}
+	if t := strings.TrimSpace(u.Tenant); t != "" && t != p.Tenant {
+		return fmt.Errorf("tenant must be %s", p.Tenant)
+	}
+	u.Tenant = p.Tenant
+	return nil
+}
+
+// ---- OIDC / JWT ----
+
+var oidcAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// oidcVerifier validates bearer JWTs: signature against the JWKS, exp/nbf,
+// issuer and audience. Roles come from a claim (default "roles"; dotted
+// paths like "realm_access.roles" reach into objects), optionally renamed
+// through ADMIN_OIDC_ROLE_MAP; the highest role wins.
+type oidcVerifier struct {
+	issuer      string
+	audience    string
+	rolesClaim  string
+	tenantClaim string
+	nameClaim   string
+	roleMap     map[string]role
+
+	jwksFile string // fixed key set
+	client   *http.Client
+
+	mu       sync.Mutex
+	keys     *jose.JSONWebKeySet
+	jwksURL  string
+	fetched  time.Time
+	lastTry  time.Time
+	cacheTTL time.Duration
+}
+
+// newOIDCVerifier returns nil when ADMIN_OIDC_AUDIENCE is not set.
+//
+//	ADMIN_OIDC_AUDIENCE      required "aud" value; enables OIDC
+//	ADMIN_OIDC_ISSUER        required "iss" value; also where keys are
+//	                         discovered (/.well-known/openid-configuration)
+//	ADMIN_OIDC_JWKS_FILE     local JWKS instead of discovery
+//	ADMIN_OIDC_ROLES_CLAIM   default "roles"
+//	ADMIN_OIDC_TENANT_CLAIM  default "tenant"
+//	ADMIN_OIDC_NAME_CLAIM    default "email", falling back to "sub"
+//	ADMIN_OIDC_ROLE_MAP      claim value=role pairs, e.g. sftp-admins=admin
+func newOIDCVerifier() (*oidcVerifier, error) {
+	aud := env("ADMIN_OIDC_AUDIENCE", "")
+	if aud == "" {
+		return nil, nil
+	}
+	v := &oidcVerifier{
+		issuer:      strings.TrimSuffix(env("ADMIN_OIDC_ISSUER", ""), "/"),
+		audience:    aud,
+		rolesClaim:  env("ADMIN_OIDC_ROLES_CLAIM", "roles"),
+		tenantClaim: env("ADMIN_OIDC_TENANT_CLAIM", "tenant"),
+		nameClaim:   env("ADMIN_OIDC_NAME_CLAIM", "email"),
+		roleMap:     map[string]role{},
+		jwksFile:    env("ADMIN_OIDC_JWKS_FILE", ""),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		cacheTTL:    15 * time.Minute,
+	}
+	for _, pair := range strings.Split(env("ADMIN_OIDC_ROLE_MAP", ""), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		from, to, _ := strings.Cut(pair, "=")
+		r, ok := parseRole(to)
+		if strings.TrimSpace(from) == "" || !ok {
+			return nil, fmt.Errorf("ADMIN_OIDC_ROLE_MAP: %q: want claim-value=viewer|operator|admin", pair)
+		}
+		v.roleMap[strings.TrimSpace(from)] = r
+	}
+
+	switch {
+	case v.jwksFile != "":
+		b, err := os.ReadFile(v.jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_OIDC_JWKS_FILE: %w", err)
+		}
+		var set jose.JSONWebKeySet
+		if err := json.Unmarshal(b, &set); err != nil || len(set.Keys) == 0 {
+			return nil, fmt.Errorf("ADMIN_OIDC_JWKS_FILE %s: not a JWKS with keys (%v)", v.jwksFile, err)
+		}
+		v.keys = &set
+	case v.issuer == "":
+		return nil, errors.New("ADMIN_OIDC_AUDIENCE needs ADMIN_OIDC_ISSUER or ADMIN_OIDC_JWKS_FILE")
+	}
+	log.Printf("admin-api: OIDC bearer tokens accepted (issuer=%q audience=%q)", v.issuer, v.audience)
+	return v, nil
+}
+
+func (v *oidcVerifier) verify(ctx context.Context, raw string) (principal, error) {
+	tok, err := jwt.ParseSigned(raw, oidcAlgorithms)
+	if err != nil || len(tok.Headers) == 0 {
+		return principal{}, fmt.Errorf("%w: malformed token", errBadCredentials)
+	}
+	kid := tok.Headers[0].KeyID
+
+	var std jwt.Claims
+	var extra map[string]any
+	keys, err := v.keySet(ctx, kid)
+	if err != nil {
+		return principal{}, err
+	}
+	if err := tok.Claims(keys, &std, &extra); err != nil {
+		return principal{}, fmt.Errorf("%w: %v", errBadCredentials, err)
+	}
+	if std.Expiry == nil {
+		return principal{}, fmt.Errorf("%w: token has no exp", errBadCredentials)
+	}
+	exp := jwt.Expected{Issuer: v.issuer, AnyAudience: jwt.Audience{v.audience}}
+	if err := std.ValidateWithLeeway(exp, 30*time.Second); err != nil {
+		return principal{}, fmt.Errorf("%w: %v", errBadCredentials, err)
+	}
+
+	p := principal{Method: "oidc", Name: claimString(extra, v.nameClaim), Tenant: claimString(extra, v.tenantClaim)}
+	if p.Name == "" {
+		p.Name = std.Subject
+	}
+	for _, name := range claimStrings(claimValue(extra, v.rolesClaim)) {
+		r, ok := v.roleMap[name]
+		if !ok {
+			r, _ = parseRole(name)
+		}
+		if r > p.Role {
+			p.Role = r
+		}
+	}
+	if p.Role == roleNone {
+		return p, errNoRole
+	}
+	if p.Tenant != "" && !usernameRe.MatchString(p.Tenant) {
+		return p, fmt.Errorf("%w: invalid tenant claim", errBadCredentials)
+	}
+	return p, nil
+}
+
+// keySet returns the keys to verify with. Discovered keys are refetched
+// after cacheTTL, or sooner (at most once a minute) for an unknown kid.
+func (v *oidcVerifier) keySet(ctx context.Context, kid string) (*jose.JSONWebKeySet, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.jwksFile != "" {
+		return v.keys, nil
+	}
+	stale := v.keys == nil || time.Since(v.fetched) > v.cacheTTL ||
+		(kid != "" && len(v.keys.Key(kid)) == 0)
+	if stale && time.Since(v.lastTry) > time.Minute {
+		v.lastTry = time.Now()
+		set, err := v.fetchKeys(ctx)
+		if err != nil {
+			log.Printf("admin-api: OIDC key refresh failed: %v", err)
+		} else {
+			v.keys, v.fetched = set, time.Now()
+		}
+	}
+	if v.keys == nil {
+		return nil, fmt.Errorf("%w: issuer keys unavailable", errBadCredentials)
+	}
+	return v.keys, nil
+}
+
+func (v *oidcVerifier) fetchKeys(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	if v.jwksURL == "" {
+		var disc struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &disc); err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(disc.Issuer, "/") != v.issuer || disc.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document for %s has issuer %q, jwks_uri %q", v.issuer, disc.Issuer, disc.JWKSURI)
+		}
+		v.jwksURL = disc.JWKSURI
+	}
+	var set jose.JSONWebKeySet
+	if err := v.getJSON(ctx, v.jwksURL, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// claimValue looks up a claim by name or dotted path.
+func claimValue(claims map[string]any, name string) any {
+	var cur any = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	return cur
+}
+
+func claimString(claims map[string]any, name string) string {
+	s, _ := claimValue(claims, name).(string)
+	return strings.TrimSpace(s)
+}
+
+// claimStrings accepts a string claim (space separated, like "scope") or a
+// list of strings.
+func claimStrings(v any) []string {
+	if s, ok := v.(string); ok {
+		return strings.Fields(s)
+	}
+	return asStrings(v)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// AuthBan is a brute-force ban placed by sftp-server (LOCKOUT_STORE=vault).
+// Each ban is one KV v2 secret under VAULT_BANS_PREFIX, keyed by banID.
+type AuthBan struct {
+	Kind     string `json:"kind"`  // "ip" or "user"
+	Value    string `json:"value"` // IP, or "username@IP" or "username" for kind "user"
+	Reason   string `json:"reason,omitempty"`
+	Failures int64  `json:"failures,omitempty"`
+	BannedAt string `json:"bannedAt,omitempty"`
+	Until    string `json:"until,omitempty"`
+	Expired  bool   `json:"expired,omitempty"`
+}
+
+// banID must match sftp-server's lockout.go.
+func banID(kind, value string) string {
+	return kind + "-" + hex.EncodeToString([]byte(value))
+}
+
+func mountBanRoutes(r chi.Router, c *hv.Client, bansPrefix string) {
+	r.With(requireUnscoped).Get("/bans", func(w http.ResponseWriter, req *http.Request) {
+		bans, err := listBansKV2(req.Context(), c, bansPrefix)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: bans})
+	})
+
+	r.With(requireUnscoped, requireRole(roleOperator)).Delete("/bans/{kind}/{value}", func(w http.ResponseWriter, req *http.Request) {
+		kind, value := chi.URLParam(req, "kind"), chi.URLParam(req, "value")
+		if kind != "ip" && kind != "user" {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "kind must be ip or user", map[string]any{"kind": kind})
+			return
+		}
+		err := deleteBanKV2(req.Context(), c, bansPrefix, banID(kind, value))
+		auditRequest(req, auditEvent{Action: "ban_clear", Path: kind + ":" + value}, err)
+		if errors.Is(err, errNotFound) {
+			writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "ban not found", map[string]any{"kind": kind, "value": value})
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+}
+
+func listBansKV2(ctx context.Context, c *hv.Client, bansPrefix string) ([]AuthBan, error) {
+	dataBase, _, metadataBase, err := kv2Paths(bansPrefix, "")
+	if err != nil {
+		return nil, err
+	}
+	sec, err := c.Logical().ListWithContext(ctx, metadataBase)
+	if err != nil {
+		return nil, err
+	}
+	bans := []AuthBan{}
+	if sec == nil || sec.Data == nil {
+		return bans, nil
+	}
+
+	now := time.Now()
+	for _, id := range asStrings(sec.Data["keys"]) {
+		s, err := c.Logical().ReadWithContext(ctx, dataBase+"/"+id)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil || s.Data == nil {
+			continue
+		}
+		m, ok := s.Data["data"].(map[string]any)
+		if !ok {
+			continue
+		}
+		b := AuthBan{Failures: asInt64(m["failures"])}
+		b.Kind, _ = m["kind"].(string)
+		b.Value, _ = m["value"].(string)
+		b.Reason, _ = m["reason"].(string)
+		b.BannedAt, _ = m["bannedAt"].(string)
+		b.Until, _ = m["until"].(string)
+		if t, err := time.Parse(time.RFC3339, b.Until); err == nil && now.After(t) {
+			b.Expired = true
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].BannedAt > bans[j].BannedAt })
+	return bans, nil
+}
+
+func deleteBanKV2(ctx context.Context, c *hv.Client, bansPrefix, id string) error {
+	dataPath, metadataPath, _, err := kv2Paths(bansPrefix, id)
+	if err != nil {
+		return err
+	}
+	sec, err := c.Logical().ReadWithContext(ctx, dataPath)
+	if err != nil {
+		return err
+	}
+	if sec == nil || sec.Data == nil {
+		return errNotFound
+	}
+	if _, err := c.Logical().DeleteWithContext(ctx, metadataPath); err != nil {
+		return fmt.Errorf("delete ban: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base32"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	hv "github.com/hashicorp/vault/api"
+)
+
+// Bulk import and export of users, as JSON lines (one user per line, the
+// same fields as GET /users/{username}) or CSV with a header row of those
+// field names. passwordHash and totpSecret carry credentials between Vault
+// clusters: export includes them only with ?secrets=true (admin role), and
+// import accepts them as well as a plain password.
+
+const (
+	maxImportBytes = 32 << 20
+	maxImportRows  = 10000
+
+	// Bulk requests outlive the server's 15s read/write timeouts.
+	bulkTimeout = 10 * time.Minute
+)
+
+// userRecord is a user as imported or exported.
+type userRecord struct {
+	User
+	PasswordHash string `json:"passwordHash,omitempty"`
+	TOTPSecret   string `json:"totpSecret,omitempty"`
+}
+
+// CSV columns of an export, in order. List cells hold one item per line;
+// import also splits them on ";".
+var (
+	userColumns   = []string{"username", "disabled", "tenant", "rootSubdir", "publicKeys", "allowedCIDRs", "authMode", "immutable", "immutablePaths", "retentionDays", "listSort", "listMaxEntries", "uploadBytesPerSec", "downloadBytesPerSec", "quotaBytes", "quotaFiles", "validFrom", "validUntil", "inactivityDays", "groups", "permissions", "updatedAt"}
+	secretColumns = []string{"passwordHash", "totpSecret"}
+
+	boolColumns = map[string]bool{"disabled": true, "immutable": true, "hasPassword": true, "totpEnabled": true}
+	intColumns  = map[string]bool{"retentionDays": true, "listMaxEntries": true, "uploadBytesPerSec": true, "downloadBytesPerSec": true, "quotaBytes": true, "quotaFiles": true, "inactivityDays": true, "version": true}
+	listColumns = map[string]bool{"publicKeys": true, "allowedCIDRs": true, "immutablePaths": true, "groups": true}
+)
+
+// csvRow renders rec in the order of columns.
+func csvRow(rec userRecord, columns []string) []string {
+	var m map[string]any
+	b, _ := json.Marshal(rec)
+	_ = json.Unmarshal(b, &m)
+	row := make([]string, len(columns))
+	for i, col := range columns {
+		switch v := m[col].(type) {
+		case nil:
+		case []any:
+			items := make([]string, len(v))
+			for j, item := range v {
+				items[j] = fmt.Sprint(item)
+			}
+			row[i] = strings.Join(items, "\n")
+		case float64:
+			row[i] = strconv.FormatInt(int64(v), 10)
+		default:
+			row[i] = fmt.Sprint(v)
+		}
+	}
+	return row
+}
+
+// parseCSVRow turns a CSV row into a record; empty cells are left unset.
+// On error the record still has the username, for the report.
+func parseCSVRow(header, row []string) (userRecord, error) {
+	m := map[string]any{}
+	var bad userRecord
+	for i, col := range header {
+		if col == "username" {
+			bad.Username = strings.TrimSpace(row[i])
+		}
+	}
+	for i, col := range header {
+		cell := strings.TrimSpace(row[i])
+		if cell == "" {
+			continue
+		}
+		switch {
+		case boolColumns[col]:
+			b, err := strconv.ParseBool(cell)
+			if err != nil {
+				return bad, fmt.Errorf("%s: not a boolean: %q", col, cell)
+			}
+			m[col] = b
+		case intColumns[col]:
+			n, err := strconv.ParseInt(cell, 10, 64)
+			if err != nil {
+				return bad, fmt.Errorf("%s: not an integer: %q", col, cell)
+			}
+			m[col] = n
+		case listColumns[col]:
+			m[col] = strings.FieldsFunc(cell, func(r rune) bool { return r == '\n' || r == '\r' || r == ';' })
+		default:
+			m[col] = cell
+		}
+	}
+	b, _ := json.Marshal(m)
+	return decodeRecord(b)
+}
+
+// decodeRecord decodes one JSON record, refusing unknown fields. On error
+// the record still has the username if there is one, for the report.
+func decodeRecord(b []byte) (userRecord, error) {
+	var rec userRecord
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rec); err != nil {
+		var named struct {
+			Username string `json:"username"`
+		}
+		_ = json.Unmarshal(b, &named)
+		return userRecord{User: User{Username: named.Username}}, err
+	}
+	return rec, nil
+}
+
+// importInput is one parsed row: its line in the upload and the record or
+// why it could not be read.
+type importInput struct {
+	line int
+	rec  userRecord
+	err  error
+}
+
+// readImport parses a CSV or JSON lines upload. An error means the upload
+// as a whole is unusable; bad rows are returned with their error.
+func readImport(body io.Reader, format string) ([]importInput, error) {
+	var rows []importInput
+	if format == "csv" {
+		r := csv.NewReader(body)
+		r.FieldsPerRecord = 0
+		header, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("CSV header: %w", err)
+		}
+		known := map[string]bool{"password": true, "hasPassword": true, "totpEnabled": true, "version": true}
+		for _, col := range append(append([]string{}, userColumns...), secretColumns...) {
+			known[col] = true
+		}
+		for i, col := range header {
+			header[i] = strings.TrimSpace(strings.TrimPrefix(col, "\ufeff"))
+			if !known[header[i]] {
+				return nil, fmt.Errorf("unknown CSV column %q", header[i])
+			}
+		}
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				var perr *csv.ParseError
+				if !errors.As(err, &perr) {
+					return nil, err
+				}
+				rows = append(rows, importInput{line: perr.StartLine, err: err})
+			} else {
+				line, _ := r.FieldPos(0)
+				rec, err := parseCSVRow(header, row)
+				rows = append(rows, importInput{line: line, rec: rec, err: err})
+			}
+			if len(rows) > maxImportRows {
+				return nil, fmt.Errorf("at most %d rows per import", maxImportRows)
+			}
+		}
+		return rows, nil
+	}
+
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		rec, err := decodeRecord(b)
+		rows = append(rows, importInput{line: line, rec: rec, err: err})
+		if len(rows) > maxImportRows {
+			return nil, fmt.Errorf("at most %d rows per import", maxImportRows)
+		}
+	}
+	return rows, sc.Err()
+}
+
+// importRow reports what happened to one row.
+type importRow struct {
+	Line     int    `json:"line"`
+	Username string `json:"username,omitempty"`
+	Status   string `json:"status"` // created, updated, unchanged, skipped, failed
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	DryRun bool           `json:"dryRun"`
+	Mode   string         `json:"mode"`
+	Counts map[string]int `json:"counts"`
+	Rows   []importRow    `json:"rows"`
+}
+
+// importer applies rows one after another; owners tracks key ownership
+// including the rows already imported, so a key given to two users in one
+// file is caught too.
+type importer struct {
+	req         *http.Request
+	c           *hv.Client
+	usersPrefix string
+	upsert      bool
+	dryRun      bool
+	owners      map[string][]keyOwner
+	seen        map[string]bool
+}
+
+func (im *importer) apply(in importInput) importRow {
+	row := importRow{Line: in.line, Username: in.rec.Username}
+	fail := func(code string, err error) importRow {
+		row.Status, row.Code, row.Error = "failed", code, err.Error()
+		return row
+	}
+	if in.err != nil {
+		return fail("INVALID_INPUT", in.err)
+	}
+	ctx := im.req.Context()
+
+	u := in.rec.User
+	u.Username = strings.TrimSpace(u.Username)
+	row.Username = u.Username
+	if !usernameRe.MatchString(u.Username) {
+		return fail("INVALID_INPUT", errors.New("invalid username"))
+	}
+	if im.seen[u.Username] {
+		return fail("INVALID_INPUT", errors.New("username appears more than once in this import"))
+	}
+	im.seen[u.Username] = true
+	if err := scopeUser(im.req, &u); err != nil {
+		return fail("FORBIDDEN", err)
+	}
+
+	existing, err := readUserKV2(ctx, im.c, im.usersPrefix, u.Username)
+	var before *User
+	cas := int64(0)
+	switch {
+	case errors.Is(err, errDeleted):
+		h, err := readUserHistory(ctx, im.c, im.usersPrefix, u.Username)
+		if err != nil {
+			return fail("VAULT_ERROR", err)
+		}
+		if !inTenantScope(im.req, h.Tenant) {
+			return fail("CONFLICT", errors.New("username is not available"))
+		}
+		cas = existing.Version // written as the next version of the deleted user
+	case errors.Is(err, errNotFound):
+	case err != nil:
+		return fail("VAULT_ERROR", err)
+	default:
+		if !inTenantScope(im.req, existing.Tenant) {
+			return fail("CONFLICT", errors.New("username is not available"))
+		}
+		if !im.upsert {
+			row.Status, row.Code = "skipped", "EXISTS"
+			return row
+		}
+		before, cas = &existing, existing.Version
+	}
+
+	// Credentials: given as hash or secret, else a new password, else kept.
+	if before != nil {
+		u.passwordHash, u.totpSecret = before.passwordHash, before.totpSecret
+	}
+	if in.rec.PasswordHash != "" {
+		if err := checkPasswordHash(in.rec.PasswordHash); err != nil {
+			return fail("INVALID_INPUT", err)
+		}
+		u.passwordHash = in.rec.PasswordHash
+	} else if u.Password != "" {
+		if err := setPassword(&u, u.Password); err != nil {
+			return fail("INVALID_INPUT", err)
+		}
+	}
+	u.Password = ""
+	if in.rec.TOTPSecret != "" {
+		if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(in.rec.TOTPSecret, "=")); err != nil {
+			return fail("INVALID_INPUT", errors.New("totpSecret must be base32"))
+		}
+		u.totpSecret = in.rec.TOTPSecret
+	}
+	if err := normalizeAndValidateUser(&u, "", true); err != nil {
+		return fail("INVALID_INPUT", err)
+	}
+	if code, err := checkUserGroups(im.req, before, &u); err != nil {
+		return fail(code, err)
+	}
+	if conflict := checkNewKeys(im.req, im.owners, u.Username, newKeys(before, &u)); conflict != nil {
+		msg := conflict.message
+		if owner, ok := conflict.details["username"]; ok {
+			msg = fmt.Sprintf("%s: %s (%s)", msg, owner, conflict.details["fingerprint"])
+		} else if conflict.code == "KEY_IN_USE" {
+			msg = fmt.Sprintf("%s (%s)", msg, conflict.details["fingerprint"])
+		}
+		return fail(conflict.code, errors.New(msg))
+	}
+
+	changes := diffUsers(before, &u)
+	switch {
+	case before == nil:
+		row.Status = "created"
+	case len(changes) == 0:
+		row.Status = "unchanged"
+		return row
+	default:
+		row.Status = "updated"
+	}
+	if !im.dryRun {
+		_, err := writeUserKV2(ctx, im.c, im.usersPrefix, u, cas)
+		auditRequest(im.req, auditEvent{Action: "user_import", Target: u.Username, Changes: changes}, err)
+		if err != nil {
+			code := "VAULT_ERROR"
+			if errors.Is(err, errVersionConflict) {
+				code = "VERSION_CONFLICT"
+			}
+			return fail(code, err)
+		}
+	}
+	im.trackKeys(before, &u)
+	return row
+}
+
+// trackKeys moves the key ownership of a user from before to after.
+func (im *importer) trackKeys(before, after *User) {
+	if before != nil {
+		for _, k := range before.PublicKeys {
+			fp := keyFingerprint(k)
+			kept := im.owners[fp][:0]
+			for _, o := range im.owners[fp] {
+				if o.Username != before.Username {
+					kept = append(kept, o)
+				}
+			}
+			im.owners[fp] = kept
+		}
+	}
+	for _, k := range after.PublicKeys {
+		fp := keyFingerprint(k)
+		im.owners[fp] = append(im.owners[fp], keyOwner{Username: after.Username, Tenant: after.Tenant})
+	}
+}
+
+// bulkFormat picks csv or jsonl from ?format= or the content type.
+func bulkFormat(req *http.Request, contentType string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(req.URL.Query().Get("format"))); f {
+	case "csv", "jsonl":
+		return f, nil
+	case "":
+	default:
+		return "", fmt.Errorf("format must be csv or jsonl")
+	}
+	if strings.HasPrefix(strings.ToLower(contentType), "text/csv") {
+		return "csv", nil
+	}
+	return "jsonl", nil
+}
+
+// importUsersHandler serves POST /users:import. Query parameters: format
+// (csv or jsonl; default from Content-Type), mode (create skips existing
+// users, upsert replaces them) and dryRun (validate only).
+func importUsersHandler(c *hv.Client, usersPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(time.Now().Add(bulkTimeout))
+		_ = rc.SetWriteDeadline(time.Now().Add(bulkTimeout))
+
+		qs := req.URL.Query()
+		format, err := bulkFormat(req, req.Header.Get("Content-Type"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error(), nil)
+			return
+		}
+		mode := strings.TrimSpace(qs.Get("mode"))
+		switch mode {
+		case "":
+			mode = "create"
+		case "create", "upsert":
+		default:
+			writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", "mode must be create or upsert", map[string]any{"mode": mode})
+			return
+		}
+		dryRun := false
+		if raw := qs.Get("dryRun"); raw != "" {
+			if dryRun, err = strconv.ParseBool(raw); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", "invalid 'dryRun' query param", map[string]any{"dryRun": raw})
+				return
+			}
+		}
+
+		rows, err := readImport(http.MaxBytesReader(w, req.Body, maxImportBytes), format)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+			return
+		}
+		owners, err := keyOwners(req.Context())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+
+		im := &importer{req: req, c: c, usersPrefix: usersPrefix, upsert: mode == "upsert", dryRun: dryRun,
+			owners: owners, seen: map[string]bool{}}
+		report := importReport{DryRun: dryRun, Mode: mode, Counts: map[string]int{}, Rows: make([]importRow, 0, len(rows))}
+		for _, in := range rows {
+			row := im.apply(in)
+			report.Counts[row.Status]++
+			report.Rows = append(report.Rows, row)
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: report})
+	}
+}
+
+// exportUsersHandler serves GET /users:export: every user (of the caller's
+// tenant, if scoped), streamed as JSON lines or CSV (?format=).
+func exportUsersHandler(c *hv.Client, usersPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Now().Add(bulkTimeout))
+
+		format, err := bulkFormat(req, "")
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error(), nil)
+			return
+		}
+		secrets, _ := strconv.ParseBool(req.URL.Query().Get("secrets"))
+		if secrets && principalFrom(req).Role < roleAdmin {
+			writeAPIError(w, http.StatusForbidden, "FORBIDDEN", "secrets=true requires the admin role", nil)
+			return
+		}
+
+		_, _, metadataBase, err := kv2Paths(usersPrefix, "")
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		sec, err := c.Logical().ListWithContext(req.Context(), metadataBase)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		var usernames []string
+		if sec != nil && sec.Data != nil {
+			usernames = asStrings(sec.Data["keys"])
+		}
+
+		columns := userColumns
+		if secrets {
+			columns = append(append([]string{}, userColumns...), secretColumns...)
+		}
+		stamp := time.Now().UTC().Format("20060102T150405Z")
+		var cw *csv.Writer
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="users-`+stamp+`.csv"`)
+			cw = csv.NewWriter(w)
+			_ = cw.Write(columns)
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="users-`+stamp+`.jsonl"`)
+		}
+		enc := json.NewEncoder(w)
+		tenant := principalFrom(req).Tenant
+
+		n := 0
+		for _, username := range usernames {
+			u, err := readUserKV2(req.Context(), c, usersPrefix, username)
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			if err != nil {
+				// Headers are gone; abort so the client sees a broken transfer
+				// rather than a silently short export.
+				log.Printf("users export: %s: %v", username, err)
+				panic(http.ErrAbortHandler)
+			}
+			if tenant != "" && u.Tenant != tenant {
+				continue
+			}
+			rec := userRecord{User: u}
+			rec.Version = 0 // meaningless in another cluster
+			if secrets {
+				rec.PasswordHash, rec.TOTPSecret = u.passwordHash, u.totpSecret
+			}
+			if cw != nil {
+				_ = cw.Write(csvRow(rec, columns))
+			} else {
+				_ = enc.Encode(rec)
+			}
+			if n++; n%100 == 0 {
+				if cw != nil {
+					cw.Flush()
+				}
+				_ = rc.Flush()
+			}
+		}
+		if cw != nil {
+			cw.Flush()
+		}
+	}
+}
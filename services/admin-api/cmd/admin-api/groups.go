@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// Groups carry defaults shared by their members: quota, permissions,
+// allowed source networks, shared folders and retention. A user lists its
+// groups in "groups"; sftp-server resolves them when it loads the user.
+// Fields the user sets win; otherwise the first of the user's groups that
+// sets a field applies, and the shared folders of all groups are mounted.
+// A group may belong to a tenant, and then only that tenant's users can
+// join it and only that tenant's (or unscoped) principals can see it.
+// Groups are KV v2 secrets under VAULT_GROUPS_PREFIX.
+
+// SharedFolder is a folder a group shares with its members: it appears as
+// Name at the top of each member's root. Path is relative to the tenant's
+// share area on the server (see the README). Its files count against its
+// own quota, not the members'; a writable folder must have quotaBytes.
+type SharedFolder struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	ReadOnly   bool   `json:"readOnly,omitempty"`
+	QuotaBytes int64  `json:"quotaBytes,omitempty"`
+	QuotaFiles int64  `json:"quotaFiles,omitempty"`
+}
+
+type Group struct {
+	Name        string `json:"name"`
+	Tenant      string `json:"tenant,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Defaults for members (0 / empty = not set by this group).
+	QuotaBytes    int64          `json:"quotaBytes,omitempty"`
+	QuotaFiles    int64          `json:"quotaFiles,omitempty"`
+	Permissions   string         `json:"permissions,omitempty"`
+	AllowedCIDRs  []string       `json:"allowedCIDRs,omitempty"`
+	SharedFolders []SharedFolder `json:"sharedFolders,omitempty"`
+	RetentionDays int64          `json:"retentionDays,omitempty"`
+
+	UpdatedAt string `json:"updatedAt,omitempty"`
+	Version   int64  `json:"version,omitempty"`
+
+	// Usernames of the members; read-only, set by GET /groups/{group}.
+	Members []string `json:"members,omitempty"`
+}
+
+// SFTP operations for permissions (as sftp-server's permissions= key option).
+var permissionOps = map[string][]string{
+	"read": {"read"}, "list": {"list"}, "write": {"write"}, "delete": {"delete"}, "rename": {"rename"},
+	"ro":  {"list", "read"},
+	"rw":  {"delete", "list", "read", "rename", "write"},
+	"all": {"delete", "list", "read", "rename", "write"},
+}
+
+// normalizePermissions validates a comma-separated permission list and
+// returns it sorted with shorthands expanded ("" stays "").
+func normalizePermissions(v string) (string, error) {
+	set := map[string]bool{}
+	for _, op := range strings.Split(v, ",") {
+		op = strings.ToLower(strings.TrimSpace(op))
+		if op == "" {
+			continue
+		}
+		ops, ok := permissionOps[op]
+		if !ok {
+			return "", fmt.Errorf("unknown permission %q", op)
+		}
+		for _, o := range ops {
+			set[o] = true
+		}
+	}
+	out := make([]string, 0, len(set))
+	for op := range set {
+		out = append(out, op)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ","), nil
+}
+
+func normalizeAndValidateGroup(g *Group, nameFromPath string) error {
+	if nameFromPath != "" {
+		g.Name = nameFromPath
+	}
+	g.Name = strings.TrimSpace(g.Name)
+	g.Tenant = strings.TrimSpace(g.Tenant)
+	g.Description = strings.TrimSpace(g.Description)
+	g.Members = nil
+	if !usernameRe.MatchString(g.Name) {
+		return fmt.Errorf("invalid group name")
+	}
+	if g.Tenant != "" && !usernameRe.MatchString(g.Tenant) {
+		return fmt.Errorf("invalid tenant")
+	}
+	if g.QuotaBytes < 0 || g.QuotaFiles < 0 {
+		return fmt.Errorf("quotaBytes and quotaFiles must be >= 0")
+	}
+	if g.RetentionDays < 0 {
+		return fmt.Errorf("retentionDays must be >= 0")
+	}
+	perms, err := normalizePermissions(g.Permissions)
+	if err != nil {
+		return err
+	}
+	g.Permissions = perms
+
+	cidrs := make([]string, 0, len(g.AllowedCIDRs))
+	for _, c := range g.AllowedCIDRs {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		nc, err := normalizeCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid allowedCIDRs: %w", err)
+		}
+		cidrs = append(cidrs, nc)
+	}
+	g.AllowedCIDRs = cidrs
+
+	seen := map[string]bool{}
+	for i := range g.SharedFolders {
+		f := &g.SharedFolders[i]
+		f.Name = strings.TrimSpace(f.Name)
+		f.Path = strings.Trim(strings.TrimSpace(f.Path), "/")
+		if f.Name == "" || strings.HasPrefix(f.Name, ".") || strings.ContainsAny(f.Name, `/\`) {
+			return fmt.Errorf("invalid sharedFolders: name %q must be a single visible folder name", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("invalid sharedFolders: %q appears more than once", f.Name)
+		}
+		seen[f.Name] = true
+		if f.Path == "" {
+			f.Path = f.Name
+		}
+		p, err := normalizeSFTPPath(f.Path)
+		if err != nil || p == "/" {
+			return fmt.Errorf("invalid sharedFolders: path %q", f.Path)
+		}
+		f.Path = strings.TrimPrefix(p, "/")
+		if f.QuotaBytes < 0 || f.QuotaFiles < 0 {
+			return fmt.Errorf("invalid sharedFolders: %q: quotaBytes and quotaFiles must be >= 0", f.Name)
+		}
+		if !f.ReadOnly && f.QuotaBytes == 0 {
+			return fmt.Errorf("invalid sharedFolders: writable folder %q needs quotaBytes", f.Name)
+		}
+	}
+	return nil
+}
+
+// groupStore reads and writes groups.
+type groupStore struct {
+	c      *hv.Client
+	prefix string
+}
+
+// groupsStore is set up by main.
+var groupsStore *groupStore
+
+func (s *groupStore) read(ctx context.Context, name string) (Group, error) {
+	dataPath, _, _, err := kv2Paths(s.prefix, name)
+	if err != nil {
+		return Group{}, err
+	}
+	sec, err := s.c.Logical().ReadWithContext(ctx, dataPath)
+	if err != nil {
+		return Group{}, err
+	}
+	if sec == nil || sec.Data == nil {
+		return Group{}, errNotFound
+	}
+	m, ok := sec.Data["data"].(map[string]any)
+	if !ok {
+		return Group{}, errNotFound
+	}
+	g := Group{Name: name}
+	if md, ok := sec.Data["metadata"].(map[string]any); ok {
+		g.Version = asInt64(md["version"])
+	}
+	g.Tenant, _ = m["tenant"].(string)
+	g.Description, _ = m["description"].(string)
+	g.QuotaBytes = asInt64(m["quotaBytes"])
+	g.QuotaFiles = asInt64(m["quotaFiles"])
+	g.Permissions, _ = m["permissions"].(string)
+	g.AllowedCIDRs = asStrings(m["allowedCIDRs"])
+	g.RetentionDays = asInt64(m["retentionDays"])
+	g.UpdatedAt, _ = m["updatedAt"].(string)
+	folders, _ := m["sharedFolders"].([]any)
+	for _, raw := range folders {
+		fm, _ := raw.(map[string]any)
+		f := SharedFolder{}
+		f.Name, _ = fm["name"].(string)
+		f.Path, _ = fm["path"].(string)
+		f.ReadOnly, _ = fm["readOnly"].(bool)
+		f.QuotaBytes = asInt64(fm["quotaBytes"])
+		f.QuotaFiles = asInt64(fm["quotaFiles"])
+		g.SharedFolders = append(g.SharedFolders, f)
+	}
+	return g, nil
+}
+
+// write stores g based on version cas (0 = must not exist, noCAS =
+// unconditional) and returns the new version.
+func (s *groupStore) write(ctx context.Context, g Group, cas int64) (int64, error) {
+	dataPath, _, _, err := kv2Paths(s.prefix, g.Name)
+	if err != nil {
+		return 0, err
+	}
+	folders := make([]map[string]any, 0, len(g.SharedFolders))
+	for _, f := range g.SharedFolders {
+		folders = append(folders, map[string]any{"name": f.Name, "path": f.Path, "readOnly": f.ReadOnly,
+			"quotaBytes": f.QuotaBytes, "quotaFiles": f.QuotaFiles})
+	}
+	payload := map[string]any{
+		"data": map[string]any{
+			"name":          g.Name,
+			"tenant":        g.Tenant,
+			"description":   g.Description,
+			"quotaBytes":    g.QuotaBytes,
+			"quotaFiles":    g.QuotaFiles,
+			"permissions":   g.Permissions,
+			"allowedCIDRs":  g.AllowedCIDRs,
+			"sharedFolders": folders,
+			"retentionDays": g.RetentionDays,
+			"updatedAt":     time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	if cas != noCAS {
+		payload["options"] = map[string]any{"cas": cas}
+	}
+	sec, err := s.c.Logical().WriteWithContext(ctx, dataPath, payload)
+	if err != nil {
+		return 0, casError(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return 0, nil
+	}
+	return asInt64(sec.Data["version"]), nil
+}
+
+// remove deletes the group with all its versions.
+func (s *groupStore) remove(ctx context.Context, name string) error {
+	_, metadataPath, _, err := kv2Paths(s.prefix, name)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.Logical().DeleteWithContext(ctx, metadataPath)
+	return err
+}
+
+func (s *groupStore) list(ctx context.Context) ([]Group, error) {
+	_, _, metadataBase, err := kv2Paths(s.prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	sec, err := s.c.Logical().ListWithContext(ctx, metadataBase)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if sec != nil && sec.Data != nil {
+		names = asStrings(sec.Data["keys"])
+	}
+	sort.Strings(names)
+	groups := make([]Group, 0, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		g, err := s.read(ctx, name)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read group %s: %w", name, err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// dropStaleGroups removes the groups u may no longer be in (deleted, or
+// of another tenant) and returns their names. It is for users restored as
+// they were, whom sftp-server would refuse otherwise.
+func dropStaleGroups(ctx context.Context, u *User) ([]string, error) {
+	var kept, dropped []string
+	for _, name := range u.Groups {
+		g, err := groupsStore.read(ctx, name)
+		switch {
+		case errors.Is(err, errNotFound):
+			dropped = append(dropped, name)
+		case err != nil:
+			return nil, err
+		case g.Tenant != "" && g.Tenant != u.Tenant:
+			dropped = append(dropped, name)
+		default:
+			kept = append(kept, name)
+		}
+	}
+	if len(dropped) > 0 {
+		u.Groups = kept
+	}
+	return dropped, nil
+}
+
+// groupVisible reports whether req's principal may see g.
+func groupVisible(req *http.Request, g Group) bool {
+	t := principalFrom(req).Tenant
+	return t == "" || g.Tenant == t
+}
+
+// checkUserGroups verifies the groups u joins (those not in before, or all
+// of them when u changes tenant): they must exist, be visible to req and
+// belong to u's tenant or none. The shared folders of all of u's groups
+// must have distinct names. It returns an API error code with the error.
+func checkUserGroups(req *http.Request, before, u *User) (string, error) {
+	groups := make([]Group, 0, len(u.Groups))
+	for _, name := range u.Groups {
+		known := before != nil && before.Tenant == u.Tenant && slices.Contains(before.Groups, name)
+		g, err := groupsStore.read(req.Context(), name)
+		if known && errors.Is(err, errNotFound) {
+			continue
+		}
+		if errors.Is(err, errNotFound) || (err == nil && !known && !groupVisible(req, g)) {
+			return "INVALID_INPUT", fmt.Errorf("group %s does not exist", name)
+		}
+		if err != nil {
+			return "VAULT_ERROR", err
+		}
+		if !known && g.Tenant != "" && g.Tenant != u.Tenant {
+			return "INVALID_INPUT", fmt.Errorf("group %s belongs to tenant %s", name, g.Tenant)
+		}
+		groups = append(groups, g)
+	}
+	if err := folderClash(groups); err != nil {
+		return "INVALID_INPUT", err
+	}
+	return "", nil
+}
+
+// folderClash reports two of groups sharing folders of the same name;
+// both would be mounted at the same place in a member's root.
+func folderClash(groups []Group) error {
+	owner := map[string]string{}
+	for _, g := range groups {
+		for _, f := range g.SharedFolders {
+			if other, ok := owner[f.Name]; ok && other != g.Name {
+				return fmt.Errorf("shared folder %s of group %s clashes with group %s", f.Name, g.Name, other)
+			}
+			owner[f.Name] = g.Name
+		}
+	}
+	return nil
+}
+
+// memberFolderClash runs folderClash for every member of g (as g will be
+// stored) with the member's other groups. It returns an API error code
+// with the error.
+func memberFolderClash(ctx context.Context, g Group) (string, error) {
+	if len(g.SharedFolders) == 0 {
+		return "", nil
+	}
+	usersIndex.invalidate()
+	users, err := usersIndex.users(ctx)
+	if err != nil {
+		return "VAULT_ERROR", err
+	}
+	read := map[string]Group{g.Name: g}
+	for _, u := range users {
+		if !slices.Contains(u.Groups, g.Name) {
+			continue
+		}
+		groups := make([]Group, 0, len(u.Groups))
+		for _, name := range u.Groups {
+			other, ok := read[name]
+			if !ok {
+				other, err = groupsStore.read(ctx, name)
+				if errors.Is(err, errNotFound) {
+					continue
+				}
+				if err != nil {
+					return "VAULT_ERROR", err
+				}
+				read[name] = other
+			}
+			groups = append(groups, other)
+		}
+		if err := folderClash(groups); err != nil {
+			return "FOLDER_CLASH", fmt.Errorf("member %s: %w", u.Username, err)
+		}
+	}
+	return "", nil
+}
+
+// vetGroups runs checkUserGroups for a handler, writing the error response
+// itself; it reports whether to go on.
+func vetGroups(w http.ResponseWriter, req *http.Request, before, u *User) bool {
+	code, err := checkUserGroups(req, before, u)
+	if err == nil {
+		return true
+	}
+	status := http.StatusBadRequest
+	if code == "VAULT_ERROR" {
+		status = http.StatusInternalServerError
+	}
+	writeAPIError(w, status, code, err.Error(), nil)
+	return false
+}
+
+// groupMembers lists the users in group, by username. With fresh, the
+// index is reloaded first so changes by other replicas are seen; checks
+// that guard a group's deletion or tenant use it. Deleted users are not
+// members; they drop missing groups when restored (dropStaleGroups).
+func groupMembers(ctx context.Context, group string, fresh bool) ([]string, error) {
+	if fresh {
+		usersIndex.invalidate()
+	}
+	users, err := usersIndex.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members := []string{}
+	for _, u := range users {
+		if slices.Contains(u.Groups, group) {
+			members = append(members, u.Username)
+		}
+	}
+	return members, nil
+}
+
+func diffGroups(before, after *Group) map[string]fieldChange {
+	view := func(g *Group) map[string]any {
+		if g == nil {
+			return nil
+		}
+		raw, _ := json.Marshal(g)
+		var m map[string]any
+		_ = json.Unmarshal(raw, &m)
+		delete(m, "updatedAt")
+		delete(m, "version")
+		delete(m, "members")
+		return m
+	}
+	b, a := view(before), view(after)
+	changes := map[string]fieldChange{}
+	for _, k := range unionKeys(b, a) {
+		if !reflect.DeepEqual(b[k], a[k]) {
+			changes[k] = fieldChange{From: b[k], To: a[k]}
+		}
+	}
+	return changes
+}
+
+// loadGroup reads the {group} of req, answering 404 (also for groups of
+// other tenants) or 500 itself.
+func loadGroup(w http.ResponseWriter, req *http.Request) (Group, bool) {
+	name := chi.URLParam(req, "group")
+	if !usernameRe.MatchString(name) {
+		writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid group name", map[string]any{"group": name})
+		return Group{}, false
+	}
+	g, err := groupsStore.read(req.Context(), name)
+	if errors.Is(err, errNotFound) || (err == nil && !groupVisible(req, g)) {
+		writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "group not found", map[string]any{"group": name})
+		return Group{}, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+		return Group{}, false
+	}
+	return g, true
+}
+
+// scopeGroup puts g in the tenant of a tenant-scoped principal, refusing
+// any other tenant.
+func scopeGroup(req *http.Request, g *Group) error {
+	u := User{Tenant: g.Tenant}
+	if err := scopeUser(req, &u); err != nil {
+		return err
+	}
+	g.Tenant = u.Tenant
+	return nil
+}
+
+func mountGroupRoutes(r chi.Router, c *hv.Client, usersPrefix string) {
+	r.Get("/groups", func(w http.ResponseWriter, req *http.Request) {
+		groups, err := groupsStore.list(req.Context())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		tenant := strings.TrimSpace(req.URL.Query().Get("tenant"))
+		out := make([]Group, 0, len(groups))
+		for _, g := range groups {
+			if groupVisible(req, g) && (tenant == "" || g.Tenant == tenant) {
+				out = append(out, g)
+			}
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: out})
+	})
+
+	r.With(requireRole(roleAdmin)).Post("/groups", func(w http.ResponseWriter, req *http.Request) {
+		var g Group
+		if err := json.NewDecoder(req.Body).Decode(&g); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
+			return
+		}
+		if err := scopeGroup(req, &g); err != nil {
+			writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+			return
+		}
+		if err := normalizeAndValidateGroup(&g, ""); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+			return
+		}
+		version, err := groupsStore.write(req.Context(), g, 0)
+		if errors.Is(err, errVersionConflict) {
+			err = errors.New("group already exists")
+			auditRequest(req, auditEvent{Action: "group_create", Target: g.Name}, err)
+			writeAPIError(w, http.StatusConflict, "CONFLICT", err.Error(), map[string]any{"group": g.Name})
+			return
+		}
+		auditRequest(req, auditEvent{Action: "group_create", Target: g.Name, Changes: diffGroups(nil, &g)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+
+	r.Route("/groups/{group}", func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			g, ok := loadGroup(w, req)
+			if !ok {
+				return
+			}
+			members, err := groupMembers(req.Context(), g.Name, false)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+				return
+			}
+			g.Members = members
+			w.Header().Set("ETag", userETag(g.Version))
+			writeJSON(w, http.StatusOK, apiOK{OK: true, Data: g})
+		})
+
+		// PUT = replace
+		r.With(requireRole(roleAdmin)).Put("/", func(w http.ResponseWriter, req *http.Request) {
+			var g Group
+			if err := json.NewDecoder(req.Body).Decode(&g); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
+				return
+			}
+			want, ok := requestVersion(w, req, g.Version)
+			if !ok {
+				return
+			}
+			before, ok := loadGroup(w, req)
+			if !ok {
+				return
+			}
+			if err := scopeGroup(req, &g); err != nil {
+				writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+				return
+			}
+			if err := normalizeAndValidateGroup(&g, before.Name); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+				return
+			}
+			if code, err := memberFolderClash(req.Context(), g); err != nil {
+				status := http.StatusConflict
+				if code == "VAULT_ERROR" {
+					status = http.StatusInternalServerError
+				}
+				writeAPIError(w, status, code, err.Error(), map[string]any{"group": g.Name})
+				return
+			}
+			if g.Tenant != before.Tenant {
+				// Members were checked against the old tenant.
+				members, err := groupMembers(req.Context(), g.Name, true)
+				if err != nil {
+					writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+					return
+				}
+				if len(members) > 0 {
+					writeAPIError(w, http.StatusConflict, "GROUP_IN_USE", "cannot change the tenant of a group with members",
+						map[string]any{"group": g.Name, "members": len(members)})
+					return
+				}
+			}
+			cas := want
+			if cas == 0 {
+				cas = before.Version
+			}
+			version, err := groupsStore.write(req.Context(), g, cas)
+			auditRequest(req, auditEvent{Action: "group_replace", Target: g.Name, Changes: diffGroups(&before, &g)}, err)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			w.Header().Set("ETag", userETag(version))
+			writeJSON(w, http.StatusOK, apiOK{OK: true})
+		})
+
+		r.With(requireRole(roleAdmin)).Delete("/", func(w http.ResponseWriter, req *http.Request) {
+			want, ok := optionalVersion(w, req)
+			if !ok {
+				return
+			}
+			g, ok := loadGroup(w, req)
+			if !ok {
+				return
+			}
+			if want != 0 && want != g.Version {
+				writeStoreError(w, errVersionConflict)
+				return
+			}
+			members, err := groupMembers(req.Context(), g.Name, true)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+				return
+			}
+			if len(members) > 0 {
+				writeAPIError(w, http.StatusConflict, "GROUP_IN_USE", "group still has members",
+					map[string]any{"group": g.Name, "members": len(members)})
+				return
+			}
+			err = groupsStore.remove(req.Context(), g.Name)
+			auditRequest(req, auditEvent{Action: "group_delete", Target: g.Name, Changes: diffGroups(&g, nil)}, err)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+				return
+			}
+			writeJSON(w, http.StatusOK, apiOK{OK: true})
+		})
+
+		// Membership: PUT adds the user to the group, DELETE removes it.
+		// Both update the user record (audited as user_update).
+		member := func(join bool) http.HandlerFunc {
+			return func(w http.ResponseWriter, req *http.Request) {
+				g, ok := loadGroup(w, req)
+				if !ok {
+					return
+				}
+				username := chi.URLParam(req, "username")
+				u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+				if !ok {
+					return
+				}
+				if t := principalFrom(req).Tenant; t != "" && u.Tenant != t {
+					writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
+					return
+				}
+				if slices.Contains(u.Groups, g.Name) == join {
+					writeJSON(w, http.StatusOK, apiOK{OK: true})
+					return
+				}
+				before := u
+				if join {
+					u.Groups = append(slices.Clone(u.Groups), g.Name)
+				} else {
+					u.Groups = slices.DeleteFunc(slices.Clone(u.Groups), func(s string) bool { return s == g.Name })
+				}
+				if !vetGroups(w, req, &before, &u) {
+					return
+				}
+				_, err := writeUserKV2(req.Context(), c, usersPrefix, u, u.Version)
+				auditRequest(req, auditEvent{Action: "user_update", Target: username, Changes: diffUsers(&before, &u)}, err)
+				if err != nil {
+					writeStoreError(w, err)
+					return
+				}
+				writeJSON(w, http.StatusOK, apiOK{OK: true})
+			}
+		}
+		r.With(requireRole(roleOperator)).Put("/members/{username}", member(true))
+		r.With(requireRole(roleOperator)).Delete("/members/{username}", member(false))
+	})
+}
+
+// normalizeGroupNames validates and de-duplicates a user's groups, keeping
+// their order (it decides which group's defaults win).
+func normalizeGroupNames(u *User) error {
+	out := make([]string, 0, len(u.Groups))
+	for _, name := range u.Groups {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(out, name) {
+			continue
+		}
+		if !usernameRe.MatchString(name) {
+			return fmt.Errorf("invalid group name %q", name)
+		}
+		out = append(out, name)
+	}
+	u.Groups = out
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// User history: every write is a KV v2 version, so earlier versions of a
+// user can be listed, read and rolled back to. DELETE only deletes the
+// current version (a soft delete): the user disappears for sftp-server and
+// the listing, but can be undeleted within USER_UNDELETE_WINDOW. Purge
+// removes the user with all its versions for good.
+
+// userVersion describes one KV v2 version of a user record.
+type userVersion struct {
+	Version      int64  `json:"version"`
+	CreatedTime  string `json:"createdTime"`
+	DeletionTime string `json:"deletionTime,omitempty"`
+	Destroyed    bool   `json:"destroyed,omitempty"`
+}
+
+// userHistory is the KV v2 metadata of a user record.
+type userHistory struct {
+	Username       string        `json:"username"`
+	CurrentVersion int64         `json:"currentVersion"`
+	Deleted        bool          `json:"deleted"`
+	Versions       []userVersion `json:"versions"` // newest first
+
+	// Tenant recorded by deleteUserKV2 (the data is unreadable once deleted).
+	Tenant string `json:"-"`
+}
+
+func (h userHistory) current() userVersion {
+	for _, v := range h.Versions {
+		if v.Version == h.CurrentVersion {
+			return v
+		}
+	}
+	return userVersion{Version: h.CurrentVersion}
+}
+
+func readUserHistory(ctx context.Context, c *hv.Client, usersPrefix, username string) (userHistory, error) {
+	_, metadataPath, _, err := kv2Paths(usersPrefix, username)
+	if err != nil {
+		return userHistory{}, err
+	}
+	sec, err := c.Logical().ReadWithContext(ctx, metadataPath)
+	if err != nil {
+		return userHistory{}, err
+	}
+	if sec == nil || sec.Data == nil {
+		return userHistory{}, errNotFound
+	}
+
+	h := userHistory{Username: username, CurrentVersion: asInt64(sec.Data["current_version"])}
+	if cm, ok := sec.Data["custom_metadata"].(map[string]any); ok {
+		h.Tenant, _ = cm["tenant"].(string)
+	}
+	versions, _ := sec.Data["versions"].(map[string]any)
+	for n, raw := range versions {
+		m, _ := raw.(map[string]any)
+		v := userVersion{Version: asInt64(n)}
+		v.CreatedTime, _ = m["created_time"].(string)
+		v.DeletionTime, _ = m["deletion_time"].(string)
+		v.Destroyed, _ = m["destroyed"].(bool)
+		h.Versions = append(h.Versions, v)
+	}
+	sort.Slice(h.Versions, func(i, j int) bool { return h.Versions[i].Version > h.Versions[j].Version })
+	cur := h.current()
+	h.Deleted = cur.DeletionTime != "" || cur.Destroyed
+	return h, nil
+}
+
+// kv2ActionPath is the "<mount>/<action>/<path>" endpoint (delete,
+// undelete, destroy) for a user.
+func kv2ActionPath(usersPrefix, action, username string) (string, error) {
+	_, metadataPath, _, err := kv2Paths(usersPrefix, username)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(metadataPath, "/metadata/", "/"+action+"/", 1), nil
+}
+
+// mountHistoryRoutes adds under /users/{username}:
+//
+//	GET  /versions      list versions (newest first) and whether the user is deleted
+//	GET  /versions/{n}  the user as of version n
+//	POST /rollback      {"version": n}: write version n again as the current one
+//	POST /undelete      restore a deleted user within the undelete window
+//	POST /purge         remove a deleted user and all its versions
+func mountHistoryRoutes(r chi.Router, c *hv.Client, usersPrefix string, undeleteWindow time.Duration) {
+	r.Get("/versions", func(w http.ResponseWriter, req *http.Request) {
+		h, ok := loadHistory(w, req, c, usersPrefix)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: h})
+	})
+
+	r.Get("/versions/{version}", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		if !usernameRe.MatchString(username) {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
+			return
+		}
+		raw := chi.URLParam(req, "version")
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid version", map[string]any{"version": raw})
+			return
+		}
+		u, err := readUserVersionKV2(req.Context(), c, usersPrefix, username, n)
+		switch {
+		case errors.Is(err, errDeleted):
+			writeAPIError(w, http.StatusGone, "VERSION_DELETED", "version was deleted or destroyed", map[string]any{"username": username, "version": n})
+		case errors.Is(err, errNotFound):
+			writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "version not found", map[string]any{"username": username, "version": n})
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+		default:
+			writeJSON(w, http.StatusOK, apiOK{OK: true, Data: u})
+		}
+	})
+
+	// Rollback restores the settings of version n but keeps the current
+	// password and TOTP secret: credentials that were rotated stay rotated.
+	r.With(requireRole(roleOperator)).Post("/rollback", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		var body struct {
+			Version int64 `json:"version"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
+			return
+		}
+		if body.Version <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "version required", nil)
+			return
+		}
+		want, ok := optionalVersion(w, req)
+		if !ok {
+			return
+		}
+
+		current, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		u, err := readUserVersionKV2(req.Context(), c, usersPrefix, username, body.Version)
+		switch {
+		case errors.Is(err, errDeleted):
+			writeAPIError(w, http.StatusGone, "VERSION_DELETED", "version was deleted or destroyed", map[string]any{"username": username, "version": body.Version})
+			return
+		case errors.Is(err, errNotFound):
+			writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "version not found", map[string]any{"username": username, "version": body.Version})
+			return
+		case err != nil:
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		u.passwordHash, u.totpSecret = current.passwordHash, current.totpSecret
+		if err := scopeUser(req, &u); err != nil {
+			writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+			return
+		}
+		if err := normalizeAndValidateUser(&u, username, true); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "version "+strconv.FormatInt(body.Version, 10)+" is no longer valid: "+err.Error(), nil)
+			return
+		}
+		if !vetNewKeys(w, req, c, usersPrefix, &current, &u) || !vetGroups(w, req, &current, &u) {
+			return
+		}
+
+		version, err := writeUserKV2(req.Context(), c, usersPrefix, u, casVersion(current, want))
+		auditRequest(req, auditEvent{Action: "user_rollback", Path: fmt.Sprintf("versions/%d", body.Version), Target: username,
+			Changes: diffUsers(&current, &u)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+
+	r.With(requireRole(roleAdmin)).Post("/undelete", func(w http.ResponseWriter, req *http.Request) {
+		h, ok := loadHistory(w, req, c, usersPrefix)
+		if !ok {
+			return
+		}
+		cur := h.current()
+		if !h.Deleted {
+			writeAPIError(w, http.StatusConflict, "NOT_DELETED", "user is not deleted", map[string]any{"username": h.Username})
+			return
+		}
+		deletedAt, _ := time.Parse(time.RFC3339Nano, cur.DeletionTime)
+		if cur.Destroyed || time.Since(deletedAt) > undeleteWindow {
+			writeAPIError(w, http.StatusGone, "UNDELETE_EXPIRED", "the undelete window has passed", map[string]any{
+				"username": h.Username, "deletionTime": cur.DeletionTime, "window": undeleteWindow.String()})
+			return
+		}
+
+		path, err := kv2ActionPath(usersPrefix, "undelete", h.Username)
+		if err == nil {
+			_, err = c.Logical().WriteWithContext(req.Context(), path, map[string]any{"versions": []int64{cur.Version}})
+		}
+		var after *User
+		var dropped []string
+		version := cur.Version
+		if err == nil {
+			var u User
+			u, err = readUserKV2(req.Context(), c, usersPrefix, h.Username)
+			if err == nil {
+				dropped, err = dropStaleGroups(req.Context(), &u)
+			}
+			if err == nil && len(dropped) > 0 {
+				// Groups deleted meanwhile would keep the user from logging in.
+				version, err = writeUserKV2(req.Context(), c, usersPrefix, u, u.Version)
+			}
+			if err == nil {
+				after = &u
+				usersIndex.update(u)
+			} else {
+				usersIndex.invalidate()
+			}
+		}
+		auditRequest(req, auditEvent{Action: "user_undelete", Target: h.Username, Changes: diffUsers(nil, after)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+		if len(dropped) > 0 {
+			writeJSON(w, http.StatusOK, apiOK{OK: true, Data: map[string]any{"droppedGroups": dropped}})
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+
+	r.With(requireRole(roleAdmin)).Post("/purge", func(w http.ResponseWriter, req *http.Request) {
+		h, ok := loadHistory(w, req, c, usersPrefix)
+		if !ok {
+			return
+		}
+		if !h.Deleted {
+			writeAPIError(w, http.StatusConflict, "NOT_DELETED", "only deleted users can be purged; DELETE the user first", map[string]any{"username": h.Username})
+			return
+		}
+		_, metadataPath, _, err := kv2Paths(usersPrefix, h.Username)
+		if err == nil {
+			_, err = c.Logical().DeleteWithContext(req.Context(), metadataPath)
+		}
+		auditRequest(req, auditEvent{Action: "user_purge", Target: h.Username}, err)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+}
+
+// loadHistory validates username and reads its history, writing the error
+// response itself on failure.
+func loadHistory(w http.ResponseWriter, req *http.Request, c *hv.Client, usersPrefix string) (userHistory, bool) {
+	username := chi.URLParam(req, "username")
+	if !usernameRe.MatchString(username) {
+		writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
+		return userHistory{}, false
+	}
+	h, err := readUserHistory(req.Context(), c, usersPrefix, username)
+	if errors.Is(err, errNotFound) {
+		writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
+		return userHistory{}, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+		return userHistory{}, false
+	}
+	return h, true
+}
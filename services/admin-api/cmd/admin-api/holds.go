@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// LegalHold pins files under Path (relative to the user's SFTP root) so that
+// sftp-server refuses to overwrite, remove, rename or setstat them until the
+// hold is released. Holds for a user are stored as one KV v2 secret under
+// VAULT_HOLDS_PREFIX.
+type LegalHold struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Reason   string `json:"reason,omitempty"`
+	PlacedBy string `json:"placedBy,omitempty"`
+	PlacedAt string `json:"placedAt,omitempty"`
+}
+
+func mountHoldRoutes(r chi.Router, c *hv.Client, usersPrefix, holdsPrefix string) {
+	r.Get("/holds", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		if !usernameRe.MatchString(username) {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
+			return
+		}
+		holds, err := readHoldsKV2(req.Context(), c, holdsPrefix, username)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: holds})
+	})
+
+	r.With(requireRole(roleAdmin)).Post("/holds", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		if !usernameRe.MatchString(username) {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
+			return
+		}
+		actor := requestActor(req)
+
+		var h LegalHold
+		if err := json.NewDecoder(req.Body).Decode(&h); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
+			return
+		}
+		if strings.TrimSpace(h.Path) == "" {
+			h.Path = "/"
+		}
+		p, err := normalizeSFTPPath(strings.TrimSpace(h.Path))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+			return
+		}
+
+		if _, err := readUserKV2(req.Context(), c, usersPrefix, username); err != nil {
+			if errors.Is(err, errNotFound) {
+				writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
+				return
+			}
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+
+		holds, err := readHoldsKV2(req.Context(), c, holdsPrefix, username)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+
+		hold := LegalHold{
+			ID:       newHoldID(),
+			Path:     p,
+			Reason:   strings.TrimSpace(h.Reason),
+			PlacedBy: actor,
+			PlacedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		holds = append(holds, hold)
+
+		err = writeHoldsKV2(req.Context(), c, holdsPrefix, username, holds)
+		auditRequest(req, auditEvent{Action: "hold_place", Path: hold.Path, Target: username,
+			Changes: map[string]fieldChange{"hold": {From: nil, To: hold}}}, err)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: hold})
+	})
+
+	r.With(requireRole(roleAdmin)).Delete("/holds/{holdID}", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		holdID := chi.URLParam(req, "holdID")
+		if !usernameRe.MatchString(username) {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
+			return
+		}
+		holds, err := readHoldsKV2(req.Context(), c, holdsPrefix, username)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+
+		kept := make([]LegalHold, 0, len(holds))
+		var released *LegalHold
+		for i := range holds {
+			if holds[i].ID == holdID {
+				released = &holds[i]
+				continue
+			}
+			kept = append(kept, holds[i])
+		}
+		if released == nil {
+			writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "hold not found", map[string]any{"username": username, "holdId": holdID})
+			return
+		}
+
+		err = writeHoldsKV2(req.Context(), c, holdsPrefix, username, kept)
+		auditRequest(req, auditEvent{Action: "hold_release", Path: released.Path, Target: username,
+			Changes: map[string]fieldChange{"hold": {From: *released, To: nil}}}, err)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+}
+
+func newHoldID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func readHoldsKV2(ctx context.Context, c *hv.Client, holdsPrefix, username string) ([]LegalHold, error) {
+	dataPath, _, _, err := kv2Paths(holdsPrefix, username)
+	if err != nil {
+		return nil, err
+	}
+
+	sec, err := c.Logical().ReadWithContext(ctx, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || sec.Data == nil {
+		return []LegalHold{}, nil
+	}
+	m, ok := sec.Data["data"].(map[string]any)
+	if !ok {
+		return []LegalHold{}, nil
+	}
+
+	b, err := json.Marshal(m["holds"])
+	if err != nil {
+		return nil, err
+	}
+	holds := []LegalHold{}
+	if err := json.Unmarshal(b, &holds); err != nil {
+		return nil, fmt.Errorf("unexpected holds payload: %w", err)
+	}
+	if holds == nil {
+		holds = []LegalHold{}
+	}
+	return holds, nil
+}
+
+func writeHoldsKV2(ctx context.Context, c *hv.Client, holdsPrefix, username string, holds []LegalHold) error {
+	dataPath, _, _, err := kv2Paths(holdsPrefix, username)
+	if err != nil {
+		return err
+	}
+	payload := map[string]any{
+		"data": map[string]any{
+			"holds":     holds,
+			"updatedAt": time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	_, err = c.Logical().WriteWithContext(ctx, dataPath, payload)
+	return err
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH public keys of a user are authorized_keys lines (options such as
+// from="..." are kept as given). They are parsed like sftp-server does;
+// newly added keys must not be weak or already belong to another user.
+
+const minRSABits = 3072
+
+// publicKeyInfo describes one authorized_keys line of a user.
+type publicKeyInfo struct {
+	Fingerprint string   `json:"fingerprint"`
+	Type        string   `json:"type"`
+	Bits        int      `json:"bits,omitempty"`
+	Comment     string   `json:"comment,omitempty"`
+	Options     []string `json:"options,omitempty"`
+	Key         string   `json:"key"`
+}
+
+// parsePublicKey parses an authorized_keys line.
+func parsePublicKey(line string) (publicKeyInfo, error) {
+	pk, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return publicKeyInfo{}, fmt.Errorf("invalid SSH public key: %v", err)
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return publicKeyInfo{}, fmt.Errorf("invalid SSH public key: one key per entry")
+	}
+	return publicKeyInfo{
+		Fingerprint: ssh.FingerprintSHA256(pk),
+		Type:        pk.Type(),
+		Bits:        keyBits(pk),
+		Comment:     comment,
+		Options:     options,
+		Key:         line,
+	}, nil
+}
+
+// keyBits is the key size; 0 if unknown.
+func keyBits(pk ssh.PublicKey) int {
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		pk = cert.Key
+	}
+	switch pk.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519:
+		return 256
+	case ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+	cpk, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return k.P.BitLen()
+	}
+	return 0
+}
+
+// checkKeyStrength rejects DSA and RSA keys shorter than minRSABits.
+func checkKeyStrength(k publicKeyInfo) error {
+	switch {
+	case k.Type == ssh.KeyAlgoDSA || k.Type == ssh.CertAlgoDSAv01:
+		return fmt.Errorf("DSA keys are not allowed (%s)", k.Fingerprint)
+	case (k.Type == ssh.KeyAlgoRSA || k.Type == ssh.CertAlgoRSAv01) && k.Bits < minRSABits:
+		return fmt.Errorf("RSA keys must have at least %d bits, %s has %d", minRSABits, k.Fingerprint, k.Bits)
+	}
+	return nil
+}
+
+// normalizePublicKeys trims and parses u's keys and rejects a key listed
+// twice.
+func normalizePublicKeys(u *User) error {
+	clean := make([]string, 0, len(u.PublicKeys))
+	seen := map[string]bool{}
+	for i, k := range u.PublicKeys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		info, err := parsePublicKey(k)
+		if err != nil {
+			return fmt.Errorf("publicKeys[%d]: %w", i, err)
+		}
+		if seen[info.Fingerprint] {
+			return fmt.Errorf("publicKeys[%d]: duplicate key %s", i, info.Fingerprint)
+		}
+		seen[info.Fingerprint] = true
+		clean = append(clean, k)
+	}
+	u.PublicKeys = clean
+	return nil
+}
+
+// keyConflict is a new key that is weak or already another user's.
+type keyConflict struct {
+	status  int
+	code    string
+	message string
+	details map[string]any
+}
+
+// newKeys returns the keys of after that before did not have; keys that
+// were already stored are left alone.
+func newKeys(before, after *User) []publicKeyInfo {
+	old := map[string]bool{}
+	if before != nil {
+		for _, k := range before.PublicKeys {
+			old[keyFingerprint(k)] = true
+		}
+	}
+	var added []publicKeyInfo
+	for _, k := range after.PublicKeys {
+		info, err := parsePublicKey(k)
+		if err == nil && !old[info.Fingerprint] {
+			added = append(added, info)
+		}
+	}
+	return added
+}
+
+// checkNewKeys vets keys added to username: strength, and that no other
+// user in owners has them. Another user is only named if req may see it.
+func checkNewKeys(req *http.Request, owners map[string][]keyOwner, username string, added []publicKeyInfo) *keyConflict {
+	for _, info := range added {
+		if err := checkKeyStrength(info); err != nil {
+			return &keyConflict{http.StatusBadRequest, "WEAK_KEY", err.Error(), map[string]any{"fingerprint": info.Fingerprint}}
+		}
+	}
+	tenant := principalFrom(req).Tenant
+	for _, info := range added {
+		for _, o := range owners[info.Fingerprint] {
+			if o.Username == username {
+				continue
+			}
+			details := map[string]any{"fingerprint": info.Fingerprint}
+			if tenant == "" || o.Tenant == tenant {
+				details["username"] = o.Username
+			}
+			return &keyConflict{http.StatusConflict, "KEY_IN_USE", "key is already assigned to another user", details}
+		}
+	}
+	return nil
+}
+
+// vetNewKeys runs checkNewKeys for a handler, reading the key owners only
+// if keys were added. It writes the error response itself and reports
+// whether to go on.
+func vetNewKeys(w http.ResponseWriter, req *http.Request, c *hv.Client, usersPrefix string, before, after *User) bool {
+	added := newKeys(before, after)
+	if len(added) == 0 {
+		return true
+	}
+	owners, err := keyOwners(req.Context())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+		return false
+	}
+	if conflict := checkNewKeys(req, owners, after.Username, added); conflict != nil {
+		writeAPIError(w, conflict.status, conflict.code, conflict.message, conflict.details)
+		return false
+	}
+	return true
+}
+
+type keyOwner struct {
+	Username string
+	Tenant   string
+}
+
+// keyOwners maps every key fingerprint to the users holding it.
+func keyOwners(ctx context.Context) (map[string][]keyOwner, error) {
+	users, err := usersIndex.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners := map[string][]keyOwner{}
+	for _, u := range users {
+		for _, k := range u.PublicKeys {
+			fp := keyFingerprint(k)
+			owners[fp] = append(owners[fp], keyOwner{Username: u.Username, Tenant: u.Tenant})
+		}
+	}
+	return owners, nil
+}
+
+// normalizeFingerprint accepts "SHA256:..." with or without the prefix, in
+// standard or URL-safe base64 (fingerprints contain '/' and '+').
+func normalizeFingerprint(raw string) string {
+	fp, err := url.PathUnescape(strings.TrimSpace(raw))
+	if err != nil {
+		fp = raw
+	}
+	fp = strings.TrimPrefix(fp, "SHA256:")
+	fp = strings.NewReplacer("-", "+", "_", "/").Replace(strings.TrimRight(fp, "="))
+	return "SHA256:" + fp
+}
+
+// mountKeyRoutes adds key management under /users/{username}:
+//
+//	GET    /keys                list keys with fingerprint, type, bits and comment
+//	POST   /keys                {"key": "<authorized_keys line>"}: add a key
+//	DELETE /keys/{fingerprint}  remove the key ("SHA256:..." or URL-safe)
+//
+// If-Match is honoured but, unlike PUT/PATCH of the whole user, optional.
+func mountKeyRoutes(r chi.Router, c *hv.Client, usersPrefix string) {
+	r.Get("/keys", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		out := make([]publicKeyInfo, 0, len(u.PublicKeys))
+		for _, k := range u.PublicKeys {
+			info, err := parsePublicKey(k)
+			if err != nil {
+				info = publicKeyInfo{Type: "invalid", Key: k}
+			}
+			out = append(out, info)
+		}
+		w.Header().Set("ETag", userETag(u.Version))
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: out})
+	})
+
+	r.With(requireRole(roleOperator)).Post("/keys", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		var body struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
+			return
+		}
+		info, err := parsePublicKey(strings.TrimSpace(body.Key))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+			return
+		}
+		want, ok := optionalVersion(w, req)
+		if !ok {
+			return
+		}
+		u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		before := u
+		for _, k := range u.PublicKeys {
+			if keyFingerprint(k) == info.Fingerprint {
+				writeAPIError(w, http.StatusConflict, "KEY_EXISTS", "user already has this key", map[string]any{"fingerprint": info.Fingerprint})
+				return
+			}
+		}
+		u.PublicKeys = append(append([]string{}, u.PublicKeys...), info.Key)
+		if err := normalizeAndValidateUser(&u, username, true); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+			return
+		}
+		if !vetNewKeys(w, req, c, usersPrefix, &before, &u) {
+			return
+		}
+
+		version, err := writeUserKV2(req.Context(), c, usersPrefix, u, casVersion(before, want))
+		auditRequest(req, auditEvent{Action: "key_add", Target: username, Changes: diffUsers(&before, &u)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+		writeJSON(w, http.StatusCreated, apiOK{OK: true, Data: info})
+	})
+
+	r.With(requireRole(roleOperator)).Delete("/keys/{fingerprint}", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		fp := normalizeFingerprint(chi.URLParam(req, "fingerprint"))
+		want, ok := optionalVersion(w, req)
+		if !ok {
+			return
+		}
+		u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		before := u
+		kept := make([]string, 0, len(u.PublicKeys))
+		for _, k := range u.PublicKeys {
+			if keyFingerprint(k) != fp {
+				kept = append(kept, k)
+			}
+		}
+		if len(kept) == len(u.PublicKeys) {
+			writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "key not found", map[string]any{"username": username, "fingerprint": fp})
+			return
+		}
+		u.PublicKeys = kept
+		if err := normalizeAndValidateUser(&u, username, true); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+			return
+		}
+
+		version, err := writeUserKV2(req.Context(), c, usersPrefix, u, casVersion(before, want))
+		auditRequest(req, auditEvent{Action: "key_remove", Target: username, Changes: diffUsers(&before, &u)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+}
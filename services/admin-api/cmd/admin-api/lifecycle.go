@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+)
+
+// Account lifecycle. validFrom/validUntil bound when a user may log in, and
+// a user who has not logged in for inactivityDays (USER_INACTIVITY_DAYS when
+// 0, -1 = never) counts as inactive. sftp-server enforces all of it at login
+// and records each successful login under VAULT_ACTIVITY_PREFIX. The
+// sweeper here also sets disabled on inactive users, so that it shows and
+// outlasts a later login attempt. Inactivity is counted from the latest of
+// the last login, validFrom and the last change to the user, so re-enabling
+// a user gives them a fresh period.
+
+const (
+	lifecycleActive   = "active"
+	lifecyclePending  = "pending" // before validFrom
+	lifecycleExpired  = "expired" // at or after validUntil
+	lifecycleInactive = "inactive"
+	lifecycleDisabled = "disabled"
+)
+
+// normalizeValidity checks validFrom, validUntil and inactivityDays and
+// writes the times in UTC.
+func normalizeValidity(u *User) error {
+	var from, until time.Time
+	for _, f := range []struct {
+		name string
+		v    *string
+		t    *time.Time
+	}{{"validFrom", &u.ValidFrom, &from}, {"validUntil", &u.ValidUntil, &until}} {
+		*f.v = strings.TrimSpace(*f.v)
+		if *f.v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, *f.v)
+		if err != nil {
+			return fmt.Errorf("%s must be an RFC 3339 time", f.name)
+		}
+		*f.t = t.UTC()
+		*f.v = f.t.Format(time.RFC3339)
+	}
+	if !from.IsZero() && !until.IsZero() && !until.After(from) {
+		return fmt.Errorf("validUntil must be after validFrom")
+	}
+	if u.InactivityDays < -1 {
+		return fmt.Errorf("inactivityDays must be >= -1")
+	}
+	return nil
+}
+
+// lifecyclePolicy evaluates users against their validity and inactivity
+// settings.
+type lifecyclePolicy struct {
+	defaultDays int64 // USER_INACTIVITY_DAYS; 0 = off
+}
+
+// inactivityDays is the period that applies to u; 0 = none.
+func (p lifecyclePolicy) inactivityDays(u User) int64 {
+	switch {
+	case u.InactivityDays > 0:
+		return u.InactivityDays
+	case u.InactivityDays == 0 && p.defaultDays > 0:
+		return p.defaultDays
+	}
+	return 0
+}
+
+// lifecycleStatus is the response of GET /users/{username}/lifecycle.
+type lifecycleStatus struct {
+	Username       string `json:"username"`
+	Status         string `json:"status"`
+	ValidFrom      string `json:"validFrom,omitempty"`
+	ValidUntil     string `json:"validUntil,omitempty"`
+	LastLoginAt    string `json:"lastLoginAt,omitempty"`
+	InactivityDays int64  `json:"inactivityDays,omitempty"` // in effect
+	InactiveSince  string `json:"inactiveSince,omitempty"`
+	DisableAt      string `json:"disableAt,omitempty"`
+}
+
+// idleSince is when u's inactivity period started: the latest of the last
+// login, validFrom and updatedAt.
+func idleSince(u User, lastLogin string) time.Time {
+	var latest time.Time
+	for _, s := range []string{lastLogin, u.ValidFrom, u.UpdatedAt} {
+		if t, err := time.Parse(time.RFC3339, s); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+func (p lifecyclePolicy) status(u User, a userActivity, now time.Time) lifecycleStatus {
+	st := lifecycleStatus{Username: u.Username, Status: lifecycleActive, ValidFrom: u.ValidFrom, ValidUntil: u.ValidUntil,
+		LastLoginAt: a.LastLoginAt, InactivityDays: p.inactivityDays(u)}
+	var disableAt time.Time
+	if st.InactivityDays > 0 {
+		since := idleSince(u, a.LastLoginAt)
+		disableAt = since.AddDate(0, 0, int(st.InactivityDays))
+		st.InactiveSince, st.DisableAt = since.Format(time.RFC3339), disableAt.Format(time.RFC3339)
+	}
+	from, _ := time.Parse(time.RFC3339, u.ValidFrom)
+	until, _ := time.Parse(time.RFC3339, u.ValidUntil)
+	switch {
+	case u.Disabled:
+		st.Status = lifecycleDisabled
+	case !from.IsZero() && now.Before(from):
+		st.Status = lifecyclePending
+	case !until.IsZero() && !now.Before(until):
+		st.Status = lifecycleExpired
+	case !disableAt.IsZero() && !now.Before(disableAt):
+		st.Status = lifecycleInactive
+	}
+	return st
+}
+
+// mountLifecycleRoutes adds GET /users/{username}/lifecycle: whether the
+// user can log in now and, if inactivity applies, when they will be disabled.
+func mountLifecycleRoutes(r chi.Router, c *hv.Client, usersPrefix, activityPrefix string, policy lifecyclePolicy) {
+	r.Get("/lifecycle", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		a, err := readActivity(req.Context(), c, activityPrefix, username)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: policy.status(u, a, time.Now().UTC())})
+	})
+}
+
+// lifecycleSweeper disables inactive users every interval.
+type lifecycleSweeper struct {
+	c              *hv.Client
+	usersPrefix    string
+	activityPrefix string
+	policy         lifecyclePolicy
+	interval       time.Duration
+}
+
+func (s *lifecycleSweeper) run(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.sweep(ctx); err != nil {
+				log.Printf("lifecycle sweep: %v", err)
+			}
+		}
+	}
+}
+
+func (s *lifecycleSweeper) sweep(ctx context.Context) error {
+	users, err := usersIndex.users(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, u := range users {
+		days := s.policy.inactivityDays(u)
+		// Users changed within the period cannot be inactive: skip the read.
+		if u.Disabled || days <= 0 || now.Before(idleSince(u, "").AddDate(0, 0, int(days))) {
+			continue
+		}
+		a, err := readActivity(ctx, s.c, s.activityPrefix, u.Username)
+		if err != nil {
+			return fmt.Errorf("activity of %s: %w", u.Username, err)
+		}
+		if s.policy.status(u, a, now).Status != lifecycleInactive {
+			continue
+		}
+		s.disable(ctx, u.Username, a)
+	}
+	return nil
+}
+
+// disable sets disabled on an inactive user, unless it changed meanwhile.
+func (s *lifecycleSweeper) disable(ctx context.Context, username string, a userActivity) {
+	u, err := readUserKV2(ctx, s.c, s.usersPrefix, username)
+	if errors.Is(err, errNotFound) {
+		return
+	}
+	if err == nil && s.policy.status(u, a, time.Now().UTC()).Status != lifecycleInactive {
+		return
+	}
+	before := u
+	if err == nil {
+		u.Disabled = true
+		_, err = writeUserKV2(ctx, s.c, s.usersPrefix, u, u.Version)
+	}
+	if errors.Is(err, errVersionConflict) {
+		return // changed by an admin; the next sweep decides again
+	}
+	ev := emitAudit(auditEvent{User: "system:lifecycle", Action: "user_auto_disable", Target: username,
+		Changes: diffUsers(&before, &u)}, err)
+	auditLog.store(ev)
+}
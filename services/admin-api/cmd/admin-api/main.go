@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	hv "github.com/hashicorp/vault/api"
 )
 
@@ -23,14 +26,92 @@ type User struct {
 	PublicKeys []string `json:"publicKeys"`
 	RootSubdir string   `json:"rootSubdir"`
 	UpdatedAt  string   `json:"updatedAt,omitempty"`
+
+	// KV v2 version of the record, also sent as ETag; see concurrency.go.
+	Version int64 `json:"version,omitempty"`
+
+	// Tenant the user belongs to; tenant-scoped admins only see their own.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Source networks the user may connect from (IPs or CIDRs; empty = anywhere).
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+
+	// Login method enforced by sftp-server; see mfa.go. Password is write-only
+	// (stored as an Argon2id hash); the TOTP secret is enrolled via /totp.
+	AuthMode    string `json:"authMode,omitempty"`
+	Password    string `json:"password,omitempty"`
+	HasPassword bool   `json:"hasPassword"`
+	TOTPEnabled bool   `json:"totpEnabled"`
+
+	passwordHash string
+	totpSecret   string
+
+	// WORM settings enforced by sftp-server; see holds.go for legal holds.
+	Immutable      bool     `json:"immutable"`
+	ImmutablePaths []string `json:"immutablePaths,omitempty"`
+	RetentionDays  int64    `json:"retentionDays,omitempty"`
+
+	// Directory listing policy enforced by sftp-server ("none", "name", "mtime").
+	ListSort       string `json:"listSort,omitempty"`
+	ListMaxEntries int64  `json:"listMaxEntries,omitempty"`
+
+	// Bandwidth limits in bytes/s enforced by sftp-server (0 = unlimited).
+	UploadBytesPerSec   int64 `json:"uploadBytesPerSec,omitempty"`
+	DownloadBytesPerSec int64 `json:"downloadBytesPerSec,omitempty"`
+
+	// Storage quota enforced by sftp-server (0 = unlimited).
+	QuotaBytes int64 `json:"quotaBytes,omitempty"`
+	QuotaFiles int64 `json:"quotaFiles,omitempty"`
+
+	// Account lifecycle enforced by sftp-server; see lifecycle.go.
+	ValidFrom      string `json:"validFrom,omitempty"`
+	ValidUntil     string `json:"validUntil,omitempty"`
+	InactivityDays int64  `json:"inactivityDays,omitempty"`
+
+	// Groups whose defaults apply where the user sets nothing (first wins),
+	// and the SFTP operations allowed ("" = from the groups, else all); see
+	// groups.go.
+	Groups      []string `json:"groups,omitempty"`
+	Permissions string   `json:"permissions,omitempty"`
+
+	// Recorded by sftp-server, read-only; see activity.go.
+	Activity *userActivity `json:"activity,omitempty"`
 }
 
 // PartialUser is used by PATCH endpoints.
 // Fields are pointers so we can distinguish "unset" vs "set to zero value".
 type PartialUser struct {
+	Version *int64 `json:"version,omitempty"` // alternative to If-Match
+
 	Disabled   *bool     `json:"disabled,omitempty"`
 	PublicKeys *[]string `json:"publicKeys,omitempty"`
 	RootSubdir *string   `json:"rootSubdir,omitempty"`
+	Tenant     *string   `json:"tenant,omitempty"`
+
+	AllowedCIDRs *[]string `json:"allowedCIDRs,omitempty"`
+
+	AuthMode *string `json:"authMode,omitempty"`
+	Password *string `json:"password,omitempty"` // "" removes the password
+
+	Immutable      *bool     `json:"immutable,omitempty"`
+	ImmutablePaths *[]string `json:"immutablePaths,omitempty"`
+	RetentionDays  *int64    `json:"retentionDays,omitempty"`
+
+	ListSort       *string `json:"listSort,omitempty"`
+	ListMaxEntries *int64  `json:"listMaxEntries,omitempty"`
+
+	UploadBytesPerSec   *int64 `json:"uploadBytesPerSec,omitempty"`
+	DownloadBytesPerSec *int64 `json:"downloadBytesPerSec,omitempty"`
+
+	QuotaBytes *int64 `json:"quotaBytes,omitempty"`
+	QuotaFiles *int64 `json:"quotaFiles,omitempty"`
+
+	ValidFrom      *string `json:"validFrom,omitempty"` // "" removes the bound
+	ValidUntil     *string `json:"validUntil,omitempty"`
+	InactivityDays *int64  `json:"inactivityDays,omitempty"`
+
+	Groups      *[]string `json:"groups,omitempty"`
+	Permissions *string   `json:"permissions,omitempty"`
 }
 
 type apiError struct {
@@ -53,6 +134,16 @@ var (
 	usernameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
 )
 
+// siblingPrefix replaces the last segment of a Vault prefix:
+// ("kv/sftp/users", "holds") -> "kv/sftp/holds".
+func siblingPrefix(prefix, name string) string {
+	p := strings.Trim(prefix, "/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i+1] + name
+	}
+	return p + "/" + name
+}
+
 func env(key, def string) string {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
@@ -65,11 +156,37 @@ func main() {
 	listen := env("LISTEN_ADDR", "0.0.0.0:8080")
 	vaultAddr := env("VAULT_ADDR", "")
 	usersPrefix := env("VAULT_USERS_PREFIX", "kv/sftp/users")
+	holdsPrefix := env("VAULT_HOLDS_PREFIX", siblingPrefix(usersPrefix, "holds"))
+	bansPrefix := env("VAULT_BANS_PREFIX", siblingPrefix(usersPrefix, "bans"))
+	auditPrefix := env("VAULT_AUDIT_PREFIX", siblingPrefix(usersPrefix, "audit"))
+	activityPrefix := env("VAULT_ACTIVITY_PREFIX", siblingPrefix(usersPrefix, "activity"))
+	groupsPrefix := env("VAULT_GROUPS_PREFIX", siblingPrefix(usersPrefix, "groups"))
 	token := strings.TrimSpace(os.Getenv("VAULT_TOKEN"))
 
 	if vaultAddr == "" || token == "" {
 		log.Fatal("VAULT_ADDR and VAULT_TOKEN must be set for admin-api")
 	}
+	undeleteWindow, err := time.ParseDuration(env("USER_UNDELETE_WINDOW", "720h"))
+	if err != nil || undeleteWindow < 0 {
+		log.Fatalf("invalid USER_UNDELETE_WINDOW %q", os.Getenv("USER_UNDELETE_WINDOW"))
+	}
+	indexTTL, err := time.ParseDuration(env("USER_INDEX_TTL", "10s"))
+	if err != nil || indexTTL < 0 {
+		log.Fatalf("invalid USER_INDEX_TTL %q", os.Getenv("USER_INDEX_TTL"))
+	}
+	indexConcurrency, err := strconv.Atoi(env("USER_INDEX_CONCURRENCY", "16"))
+	if err != nil || indexConcurrency < 1 {
+		log.Fatalf("invalid USER_INDEX_CONCURRENCY %q", os.Getenv("USER_INDEX_CONCURRENCY"))
+	}
+	inactivityDays, err := strconv.ParseInt(env("USER_INACTIVITY_DAYS", "0"), 10, 64)
+	if err != nil || inactivityDays < 0 {
+		log.Fatalf("invalid USER_INACTIVITY_DAYS %q", os.Getenv("USER_INACTIVITY_DAYS"))
+	}
+	lifecycleInterval, err := time.ParseDuration(env("USER_LIFECYCLE_INTERVAL", "1h"))
+	if err != nil || lifecycleInterval < 0 {
+		log.Fatalf("invalid USER_LIFECYCLE_INTERVAL %q", os.Getenv("USER_LIFECYCLE_INTERVAL"))
+	}
+	policy := lifecyclePolicy{defaultDays: inactivityDays}
 
 	cfg := hv.DefaultConfig()
 	cfg.Address = vaultAddr
@@ -78,57 +195,108 @@ func main() {
 		log.Fatal(err)
 	}
 	c.SetToken(token)
+	if auditPrefix != "off" {
+		auditLog = &auditStore{c: c, prefix: auditPrefix}
+	}
+	groupsStore = &groupStore{c: c, prefix: groupsPrefix}
+	usersIndex = &userIndex{c: c, usersPrefix: usersPrefix, activityPrefix: activityPrefix, ttl: indexTTL, concurrency: indexConcurrency}
+	if lifecycleInterval > 0 {
+		sweeper := &lifecycleSweeper{c: c, usersPrefix: usersPrefix, activityPrefix: activityPrefix, policy: policy, interval: lifecycleInterval}
+		go sweeper.run(context.Background())
+	}
+
+	auth, err := newAuthenticator()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID, requestIDHeader)
 
 	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
 	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(auth.middleware)
+
 		// Users collection
 		r.Get("/users", func(w http.ResponseWriter, req *http.Request) {
-			q := strings.TrimSpace(req.URL.Query().Get("q"))
-			disabledQ := strings.TrimSpace(req.URL.Query().Get("disabled"))
-			limit := parseLimit(req.URL.Query().Get("limit"), 200)
-
-			var filterDisabled *bool
-			if disabledQ != "" {
-				b, err := strconv.ParseBool(disabledQ)
-				if err != nil {
-					writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", "invalid 'disabled' query param", map[string]any{"disabled": disabledQ})
-					return
-				}
-				filterDisabled = &b
+			q, err := parseUserQuery(req)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error(), nil)
+				return
 			}
-
-			users, err := listUsers(req.Context(), c, usersPrefix, q, filterDisabled, limit)
+			page, err := listUsers(req.Context(), q)
 			if err != nil {
 				writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
 				return
 			}
-			writeJSON(w, http.StatusOK, apiOK{OK: true, Data: users})
+			writeJSON(w, http.StatusOK, apiPage{OK: true, Data: page.Users, Total: page.Total, NextCursor: page.NextCursor})
 		})
 
-		r.Post("/users", func(w http.ResponseWriter, req *http.Request) {
+		r.With(requireRole(roleOperator)).Post("/users", func(w http.ResponseWriter, req *http.Request) {
 			var u User
 			if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
 				writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
 				return
 			}
+			if err := scopeUser(req, &u); err != nil {
+				writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+				return
+			}
+			before, err := applyCredentials(req.Context(), c, usersPrefix, &u, u.Username)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+				return
+			}
+			if before != nil && !inTenantScope(req, before.Tenant) {
+				writeAPIError(w, http.StatusConflict, "CONFLICT", "username is not available", map[string]any{"username": u.Username})
+				return
+			}
 			if err := normalizeAndValidateUser(&u, "", true); err != nil {
 				writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
 				return
 			}
-			if err := writeUserKV2(req.Context(), c, usersPrefix, u); err != nil {
+			if !vetNewKeys(w, req, c, usersPrefix, before, &u) || !vetGroups(w, req, before, &u) {
+				return
+			}
+			// Guard against a change between the read above and this write;
+			// a deleted user keeps its versions and is written as the next one.
+			cas := int64(0)
+			if before != nil {
+				cas = before.Version
+			} else if h, err := readUserHistory(req.Context(), c, usersPrefix, u.Username); err == nil {
+				if !inTenantScope(req, h.Tenant) {
+					writeAPIError(w, http.StatusConflict, "CONFLICT", "username is not available", map[string]any{"username": u.Username})
+					return
+				}
+				cas = h.CurrentVersion
+			} else if !errors.Is(err, errNotFound) {
 				writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
 				return
 			}
+			version, err := writeUserKV2(req.Context(), c, usersPrefix, u, cas)
+			auditRequest(req, auditEvent{Action: "user_create", Target: u.Username, Changes: diffUsers(before, &u)}, err)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			w.Header().Set("ETag", userETag(version))
 			writeJSON(w, http.StatusOK, apiOK{OK: true})
 		})
 
+		// Bulk import/export (see bulk.go)
+		r.With(requireRole(roleOperator)).Post("/users:import", importUsersHandler(c, usersPrefix))
+		r.Get("/users:export", exportUsersHandler(c, usersPrefix))
+
+		// Groups and membership (see groups.go)
+		mountGroupRoutes(r, c, usersPrefix)
+
 		// User item
 		r.Route("/users/{username}", func(r chi.Router) {
+			r.Use(tenantScope(c, usersPrefix))
+
 			r.Get("/", func(w http.ResponseWriter, req *http.Request) {
 				username := chi.URLParam(req, "username")
 				if !usernameRe.MatchString(username) {
@@ -144,30 +312,60 @@ func main() {
 					writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
 					return
 				}
+				a, err := readActivity(req.Context(), c, activityPrefix, username)
+				if err != nil {
+					writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+					return
+				}
+				u.Activity = &a
+				w.Header().Set("ETag", userETag(u.Version))
 				writeJSON(w, http.StatusOK, apiOK{OK: true, Data: u})
 			})
 
 			// PUT = replace
-			r.Put("/", func(w http.ResponseWriter, req *http.Request) {
+			r.With(requireRole(roleOperator)).Put("/", func(w http.ResponseWriter, req *http.Request) {
 				username := chi.URLParam(req, "username")
 				var u User
 				if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
 					writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", err.Error(), nil)
 					return
 				}
+				if err := scopeUser(req, &u); err != nil {
+					writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+					return
+				}
+				want, ok := requestVersion(w, req, u.Version)
+				if !ok {
+					return
+				}
+				before, err := applyCredentials(req.Context(), c, usersPrefix, &u, username)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+					return
+				}
+				if before == nil {
+					writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
+					return
+				}
 				if err := normalizeAndValidateUser(&u, username, true); err != nil {
 					writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
 					return
 				}
-				if err := writeUserKV2(req.Context(), c, usersPrefix, u); err != nil {
-					writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+				if !vetNewKeys(w, req, c, usersPrefix, before, &u) || !vetGroups(w, req, before, &u) {
+					return
+				}
+				version, err := writeUserKV2(req.Context(), c, usersPrefix, u, casVersion(*before, want))
+				auditRequest(req, auditEvent{Action: "user_replace", Target: u.Username, Changes: diffUsers(before, &u)}, err)
+				if err != nil {
+					writeStoreError(w, err)
 					return
 				}
+				w.Header().Set("ETag", userETag(version))
 				writeJSON(w, http.StatusOK, apiOK{OK: true})
 			})
 
 			// PATCH = partial update
-			r.Patch("/", func(w http.ResponseWriter, req *http.Request) {
+			r.With(requireRole(roleOperator)).Patch("/", func(w http.ResponseWriter, req *http.Request) {
 				username := chi.URLParam(req, "username")
 				if !usernameRe.MatchString(username) {
 					writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
@@ -180,6 +378,15 @@ func main() {
 					return
 				}
 
+				var bodyVersion int64
+				if p.Version != nil {
+					bodyVersion = *p.Version
+				}
+				want, ok := requestVersion(w, req, bodyVersion)
+				if !ok {
+					return
+				}
+
 				u, err := readUserKV2(req.Context(), c, usersPrefix, username)
 				if errors.Is(err, errNotFound) {
 					writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
@@ -190,44 +397,142 @@ func main() {
 					return
 				}
 
+				before := u
+
 				if p.Disabled != nil {
 					u.Disabled = *p.Disabled
 				}
 				if p.RootSubdir != nil {
 					u.RootSubdir = *p.RootSubdir
 				}
+				if p.Tenant != nil {
+					u.Tenant = *p.Tenant
+				}
 				if p.PublicKeys != nil {
 					u.PublicKeys = *p.PublicKeys
 				}
+				if p.Immutable != nil {
+					u.Immutable = *p.Immutable
+				}
+				if p.ImmutablePaths != nil {
+					u.ImmutablePaths = *p.ImmutablePaths
+				}
+				if p.AllowedCIDRs != nil {
+					u.AllowedCIDRs = *p.AllowedCIDRs
+				}
+				if p.AuthMode != nil {
+					u.AuthMode = *p.AuthMode
+				}
+				if p.Password != nil {
+					if err := setPassword(&u, *p.Password); err != nil {
+						writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
+						return
+					}
+				}
+				if p.RetentionDays != nil {
+					u.RetentionDays = *p.RetentionDays
+				}
+				if p.ListSort != nil {
+					u.ListSort = *p.ListSort
+				}
+				if p.ListMaxEntries != nil {
+					u.ListMaxEntries = *p.ListMaxEntries
+				}
+				if p.UploadBytesPerSec != nil {
+					u.UploadBytesPerSec = *p.UploadBytesPerSec
+				}
+				if p.DownloadBytesPerSec != nil {
+					u.DownloadBytesPerSec = *p.DownloadBytesPerSec
+				}
+				if p.QuotaBytes != nil {
+					u.QuotaBytes = *p.QuotaBytes
+				}
+				if p.QuotaFiles != nil {
+					u.QuotaFiles = *p.QuotaFiles
+				}
+				if p.ValidFrom != nil {
+					u.ValidFrom = *p.ValidFrom
+				}
+				if p.ValidUntil != nil {
+					u.ValidUntil = *p.ValidUntil
+				}
+				if p.InactivityDays != nil {
+					u.InactivityDays = *p.InactivityDays
+				}
+				if p.Groups != nil {
+					u.Groups = *p.Groups
+				}
+				if p.Permissions != nil {
+					u.Permissions = *p.Permissions
+				}
 
+				if err := scopeUser(req, &u); err != nil {
+					writeAPIError(w, http.StatusForbidden, "FORBIDDEN", err.Error(), nil)
+					return
+				}
 				if err := normalizeAndValidateUser(&u, username, true); err != nil {
 					writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", err.Error(), nil)
 					return
 				}
-				if err := writeUserKV2(req.Context(), c, usersPrefix, u); err != nil {
-					writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+				if !vetNewKeys(w, req, c, usersPrefix, &before, &u) || !vetGroups(w, req, &before, &u) {
+					return
+				}
+				version, err := writeUserKV2(req.Context(), c, usersPrefix, u, casVersion(before, want))
+				auditRequest(req, auditEvent{Action: "user_update", Target: username, Changes: diffUsers(&before, &u)}, err)
+				if err != nil {
+					writeStoreError(w, err)
 					return
 				}
+				w.Header().Set("ETag", userETag(version))
 				writeJSON(w, http.StatusOK, apiOK{OK: true})
 			})
 
-			r.Delete("/", func(w http.ResponseWriter, req *http.Request) {
+			r.With(requireRole(roleAdmin)).Delete("/", func(w http.ResponseWriter, req *http.Request) {
 				username := chi.URLParam(req, "username")
 				if !usernameRe.MatchString(username) {
 					writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
 					return
 				}
-				if err := deleteUserKV2(req.Context(), c, usersPrefix, username); err != nil {
+				var queryVersion int64
+				if raw := req.URL.Query().Get("version"); raw != "" {
+					n, err := strconv.ParseInt(raw, 10, 64)
+					if err != nil || n <= 0 {
+						writeAPIError(w, http.StatusBadRequest, "INVALID_QUERY", "invalid 'version' query param", map[string]any{"version": raw})
+						return
+					}
+					queryVersion = n
+				}
+				want, ok := requestVersion(w, req, queryVersion)
+				if !ok {
+					return
+				}
+				before, err := deleteUserKV2(req.Context(), c, usersPrefix, username, want)
+				if !errors.Is(err, errNotFound) {
+					auditRequest(req, auditEvent{Action: "user_delete", Target: username, Changes: diffUsers(before, nil)}, err)
+				}
+				if err != nil {
 					if errors.Is(err, errNotFound) {
 						writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
 						return
 					}
-					writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+					writeStoreError(w, err)
 					return
 				}
 				writeJSON(w, http.StatusOK, apiOK{OK: true})
 			})
+
+			mountHoldRoutes(r, c, usersPrefix, holdsPrefix)
+			mountHistoryRoutes(r, c, usersPrefix, undeleteWindow)
+			mountKeyRoutes(r, c, usersPrefix)
+			mountTOTPRoutes(r, c, usersPrefix)
+			mountLifecycleRoutes(r, c, usersPrefix, activityPrefix, policy)
 		})
+
+		// Brute-force bans placed by sftp-server
+		mountBanRoutes(r, c, bansPrefix)
+
+		// Audit trail of the mutations above
+		mountAuditRoutes(r)
 	})
 
 	log.Printf("admin-api listening on %s", listen)
@@ -276,10 +581,14 @@ func normalizeAndValidateUser(u *User, usernameFromPath string, requireKeys bool
 	}
 	u.Username = strings.TrimSpace(u.Username)
 	u.RootSubdir = strings.TrimSpace(u.RootSubdir)
+	u.Tenant = strings.TrimSpace(u.Tenant)
 
 	if !usernameRe.MatchString(u.Username) {
 		return fmt.Errorf("invalid username")
 	}
+	if u.Tenant != "" && !usernameRe.MatchString(u.Tenant) {
+		return fmt.Errorf("invalid tenant")
+	}
 
 	if u.RootSubdir == "" {
 		u.RootSubdir = u.Username
@@ -288,34 +597,134 @@ func normalizeAndValidateUser(u *User, usernameFromPath string, requireKeys bool
 	if strings.Contains(u.RootSubdir, "..") || strings.HasPrefix(u.RootSubdir, "/") || strings.Contains(u.RootSubdir, "\\") {
 		return fmt.Errorf("invalid rootSubdir")
 	}
+	// Dot-folders under DATA_ROOT are reserved for the server (e.g. .sftp-events).
+	if strings.HasPrefix(u.RootSubdir, ".") {
+		return fmt.Errorf("invalid rootSubdir")
+	}
 
-	// Normalize keys
-	clean := make([]string, 0, len(u.PublicKeys))
-	for _, k := range u.PublicKeys {
-		k = strings.TrimSpace(k)
-		if k == "" {
+	if err := normalizePublicKeys(u); err != nil {
+		return err
+	}
+
+	cidrs := make([]string, 0, len(u.AllowedCIDRs))
+	for _, c := range u.AllowedCIDRs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		nc, err := normalizeCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid allowedCIDRs: %w", err)
+		}
+		cidrs = append(cidrs, nc)
+	}
+	u.AllowedCIDRs = cidrs
+
+	if u.RetentionDays < 0 {
+		return fmt.Errorf("retentionDays must be >= 0")
+	}
+	u.ListSort = strings.TrimSpace(u.ListSort)
+	switch u.ListSort {
+	case "", "none", "name", "mtime":
+	default:
+		return fmt.Errorf("listSort must be none, name or mtime")
+	}
+	if u.ListMaxEntries < 0 {
+		return fmt.Errorf("listMaxEntries must be >= 0")
+	}
+	if u.UploadBytesPerSec < 0 || u.DownloadBytesPerSec < 0 {
+		return fmt.Errorf("uploadBytesPerSec and downloadBytesPerSec must be >= 0")
+	}
+	if u.QuotaBytes < 0 || u.QuotaFiles < 0 {
+		return fmt.Errorf("quotaBytes and quotaFiles must be >= 0")
+	}
+	if err := normalizeValidity(u); err != nil {
+		return err
+	}
+	if err := normalizeGroupNames(u); err != nil {
+		return err
+	}
+	perms, err := normalizePermissions(u.Permissions)
+	if err != nil {
+		return err
+	}
+	u.Permissions = perms
+	paths := make([]string, 0, len(u.ImmutablePaths))
+	for _, p := range u.ImmutablePaths {
+		p = strings.TrimSpace(p)
+		if p == "" {
 			continue
 		}
-		clean = append(clean, k)
+		np, err := normalizeSFTPPath(p)
+		if err != nil {
+			return fmt.Errorf("invalid immutablePaths: %w", err)
+		}
+		paths = append(paths, np)
+	}
+	u.ImmutablePaths = paths
+
+	u.AuthMode = strings.TrimSpace(u.AuthMode)
+	switch u.AuthMode {
+	case "", authModePublicKey, authModePublicKeyTOTP:
+	case authModePasswordTOTP:
+		if u.passwordHash == "" {
+			return fmt.Errorf("password required for authMode %s", u.AuthMode)
+		}
+		requireKeys = false
+	default:
+		return fmt.Errorf("authMode must be %s, %s or %s", authModePublicKey, authModePublicKeyTOTP, authModePasswordTOTP)
+	}
+	// sftp-server refuses every login of a +totp user without a secret.
+	if strings.HasSuffix(u.AuthMode, "+totp") && u.totpSecret == "" {
+		return fmt.Errorf("authMode %s needs an enrolled TOTP secret (POST .../totp first)", u.AuthMode)
 	}
-	u.PublicKeys = clean
 
 	if requireKeys && len(u.PublicKeys) == 0 {
 		return fmt.Errorf("publicKeys required")
 	}
-	// light sanity check (the SFTP server does the real parsing)
-	for _, k := range u.PublicKeys {
-		parts := strings.Fields(k)
-		if len(parts) < 2 {
-			return fmt.Errorf("invalid SSH public key format")
+
+	return nil
+}
+
+// normalizeSFTPPath turns a user-visible path into its canonical "/a/b" form,
+// rejecting anything that could climb out of the user's root.
+func normalizeSFTPPath(p string) (string, error) {
+	if strings.Contains(p, "\\") {
+		return "", fmt.Errorf("backslashes not allowed in %q", p)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("'..' not allowed in %q", p)
 		}
 	}
+	return path.Clean("/" + p), nil
+}
 
-	return nil
+// normalizeCIDR accepts "10.0.0.0/8" or a bare IP and returns CIDR form.
+func normalizeCIDR(s string) (string, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", fmt.Errorf("%q is not an IP or CIDR", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not an IP or CIDR", s)
+	}
+	return n.String(), nil
 }
 
 var errNotFound = errors.New("not found")
 
+// errDeleted is returned for a soft-deleted user (see history.go); it is
+// also an errNotFound.
+var errDeleted = fmt.Errorf("%w: user deleted", errNotFound)
+
 // kv2Paths derives the KV v2 data and metadata paths from a prefix like "kv/sftp/users".
 func kv2Paths(usersPrefix, username string) (dataPath string, metadataPath string, metadataBase string, err error) {
 	base := strings.Trim(usersPrefix, "/")
@@ -333,32 +742,85 @@ func kv2Paths(usersPrefix, username string) (dataPath string, metadataPath strin
 	return mount + "/data/" + sub + "/" + username, mount + "/metadata/" + sub + "/" + username, metadataBase, nil
 }
 
-func writeUserKV2(ctx context.Context, c *hv.Client, usersPrefix string, u User) error {
+// writeUserKV2 stores u and returns the new version. cas is the version the
+// write is based on (0 = the user must not exist yet, noCAS = unconditional);
+// a mismatch is errVersionConflict.
+func writeUserKV2(ctx context.Context, c *hv.Client, usersPrefix string, u User, cas int64) (int64, error) {
 	dataPath, _, _, err := kv2Paths(usersPrefix, u.Username)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	u.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 	payload := map[string]any{
 		"data": map[string]any{
 			"username":   u.Username,
 			"disabled":   u.Disabled,
 			"rootSubdir": u.RootSubdir,
 			"publicKeys": u.PublicKeys,
-			"updatedAt":  time.Now().UTC().Format(time.RFC3339),
+			"updatedAt":  u.UpdatedAt,
+			"tenant":     u.Tenant,
+
+			"allowedCIDRs": u.AllowedCIDRs,
+
+			"authMode":     u.AuthMode,
+			"passwordHash": u.passwordHash,
+			"totpSecret":   u.totpSecret,
+
+			"immutable":      u.Immutable,
+			"immutablePaths": u.ImmutablePaths,
+			"retentionDays":  u.RetentionDays,
+
+			"listSort":       u.ListSort,
+			"listMaxEntries": u.ListMaxEntries,
+
+			"uploadBytesPerSec":   u.UploadBytesPerSec,
+			"downloadBytesPerSec": u.DownloadBytesPerSec,
+
+			"quotaBytes": u.QuotaBytes,
+			"quotaFiles": u.QuotaFiles,
+
+			"validFrom":      u.ValidFrom,
+			"validUntil":     u.ValidUntil,
+			"inactivityDays": u.InactivityDays,
+
+			"groups":      u.Groups,
+			"permissions": u.Permissions,
 		},
 	}
-	_, err = c.Logical().WriteWithContext(ctx, dataPath, payload)
-	return err
+	if cas != noCAS {
+		payload["options"] = map[string]any{"cas": cas}
+	}
+	sec, err := c.Logical().WriteWithContext(ctx, dataPath, payload)
+	if err != nil {
+		return 0, casError(err)
+	}
+	if sec == nil || sec.Data == nil {
+		usersIndex.invalidate()
+		return 0, nil
+	}
+	u.Version = asInt64(sec.Data["version"])
+	usersIndex.update(u)
+	return u.Version, nil
 }
 
 func readUserKV2(ctx context.Context, c *hv.Client, usersPrefix, username string) (User, error) {
+	return readUserVersionKV2(ctx, c, usersPrefix, username, 0)
+}
+
+// readUserVersionKV2 reads the given version of a user (0 = current). A
+// deleted or destroyed version is errDeleted, with only Version set.
+func readUserVersionKV2(ctx context.Context, c *hv.Client, usersPrefix, username string, version int64) (User, error) {
 	dataPath, _, _, err := kv2Paths(usersPrefix, username)
 	if err != nil {
 		return User{}, err
 	}
 
-	sec, err := c.Logical().ReadWithContext(ctx, dataPath)
+	var params map[string][]string
+	if version > 0 {
+		params = map[string][]string{"version": {strconv.FormatInt(version, 10)}}
+	}
+	sec, err := c.Logical().ReadWithDataWithContext(ctx, dataPath, params)
 	if err != nil {
 		return User{}, err
 	}
@@ -366,16 +828,23 @@ func readUserKV2(ctx context.Context, c *hv.Client, usersPrefix, username string
 		return User{}, errNotFound
 	}
 
+	u := User{Username: username}
+	if md, ok := sec.Data["metadata"].(map[string]any); ok {
+		u.Version = asInt64(md["version"])
+	}
+
 	raw, ok := sec.Data["data"]
 	if !ok {
 		return User{}, errNotFound
 	}
+	if raw == nil {
+		// KV v2 keeps the metadata of a deleted version, but not its data
+		return u, errDeleted
+	}
 	m, ok := raw.(map[string]any)
 	if !ok {
 		return User{}, fmt.Errorf("unexpected vault payload")
 	}
-
-	u := User{Username: username}
 	if v, ok := m["disabled"].(bool); ok {
 		u.Disabled = v
 	}
@@ -385,106 +854,133 @@ func readUserKV2(ctx context.Context, c *hv.Client, usersPrefix, username string
 	if v, ok := m["updatedAt"].(string); ok {
 		u.UpdatedAt = v
 	}
+	u.Tenant, _ = m["tenant"].(string)
+	if v, ok := m["immutable"].(bool); ok {
+		u.Immutable = v
+	}
+	u.AllowedCIDRs = asStrings(m["allowedCIDRs"])
+	if v, ok := m["authMode"].(string); ok {
+		u.AuthMode = v
+	}
+	u.passwordHash, _ = m["passwordHash"].(string)
+	u.totpSecret, _ = m["totpSecret"].(string)
+	u.HasPassword = u.passwordHash != ""
+	u.TOTPEnabled = u.totpSecret != ""
+	u.ImmutablePaths = asStrings(m["immutablePaths"])
+	u.RetentionDays = asInt64(m["retentionDays"])
+	if v, ok := m["listSort"].(string); ok {
+		u.ListSort = v
+	}
+	u.ListMaxEntries = asInt64(m["listMaxEntries"])
+	u.UploadBytesPerSec = asInt64(m["uploadBytesPerSec"])
+	u.DownloadBytesPerSec = asInt64(m["downloadBytesPerSec"])
+	u.QuotaBytes = asInt64(m["quotaBytes"])
+	u.QuotaFiles = asInt64(m["quotaFiles"])
+	u.ValidFrom, _ = m["validFrom"].(string)
+	u.ValidUntil, _ = m["validUntil"].(string)
+	u.InactivityDays = asInt64(m["inactivityDays"])
+	u.Groups = asStrings(m["groups"])
+	u.Permissions, _ = m["permissions"].(string)
 	// publicKeys may come back as []interface{}
-	switch v := m["publicKeys"].(type) {
+	u.PublicKeys = asStrings(m["publicKeys"])
+
+	return u, nil
+}
+
+// asStrings converts a Vault list value ([]string or []interface{}) to []string.
+func asStrings(v any) []string {
+	switch x := v.(type) {
 	case []string:
-		u.PublicKeys = v
+		return x
 	case []any:
-		keys := make([]string, 0, len(v))
-		for _, x := range v {
-			if s, ok := x.(string); ok {
-				keys = append(keys, s)
+		out := make([]string, 0, len(x))
+		for _, item := range x {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
 			}
 		}
-		u.PublicKeys = keys
+		return out
 	}
+	return nil
+}
 
-	return u, nil
+// asInt64 converts a Vault numeric value (json.Number with the Vault client)
+// to int64; anything unparsable becomes 0.
+func asInt64(v any) int64 {
+	switch x := v.(type) {
+	case json.Number:
+		n, _ := x.Int64()
+		return n
+	case float64:
+		return int64(x)
+	case int64:
+		return x
+	case int:
+		return int64(x)
+	case string:
+		n, _ := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+		return n
+	}
+	return 0
 }
 
-func deleteUserKV2(ctx context.Context, c *hv.Client, usersPrefix, username string) error {
-	_, metadataPath, _, err := kv2Paths(usersPrefix, username)
+// deleteUserKV2 soft-deletes the user (the current KV v2 version; see
+// history.go) and returns the record it had. A version other than 0 must
+// match the current one (errVersionConflict otherwise).
+//
+// Vault has no check-and-set delete, so with a version the record is first
+// written again with cas=version and then that new version is deleted. A
+// write that raced the read fails the check-and-set instead of being
+// deleted unseen; one that lands between the two steps stays current and
+// the delete reports a conflict.
+func deleteUserKV2(ctx context.Context, c *hv.Client, usersPrefix, username string, version int64) (*User, error) {
+	dataPath, metadataPath, _, err := kv2Paths(usersPrefix, username)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Best-effort check if exists
-	_, err = readUserKV2(ctx, c, usersPrefix, username)
+	u, err := readUserKV2(ctx, c, usersPrefix, username)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if version != 0 && version != u.Version {
+		return nil, errVersionConflict
 	}
 
-	_, err = c.Logical().DeleteWithContext(ctx, metadataPath)
-	return err
-}
-
-func listUsers(ctx context.Context, c *hv.Client, usersPrefix, q string, filterDisabled *bool, limit int) ([]map[string]any, error) {
-	_, _, metadataBase, err := kv2Paths(usersPrefix, "")
-	if err != nil {
+	// The data of a deleted version is unreadable; keep the tenant in the
+	// metadata so tenantScope still applies to the deleted user.
+	if _, err := c.Logical().JSONMergePatch(ctx, metadataPath, map[string]any{
+		"custom_metadata": map[string]any{"tenant": u.Tenant},
+	}); err != nil {
 		return nil, err
 	}
+	if version == 0 {
+		if _, err = c.Logical().DeleteWithContext(ctx, dataPath); err != nil {
+			return &u, err
+		}
+		usersIndex.remove(username)
+		return &u, nil
+	}
 
-	sec, err := c.Logical().ListWithContext(ctx, metadataBase)
+	claimed, err := writeUserKV2(ctx, c, usersPrefix, u, version)
 	if err != nil {
 		return nil, err
 	}
-	if sec == nil || sec.Data == nil {
-		return []map[string]any{}, nil
+	deletePath, err := kv2ActionPath(usersPrefix, "delete", username)
+	if err == nil {
+		_, err = c.Logical().WriteWithContext(ctx, deletePath, map[string]any{"versions": []int64{claimed}})
 	}
-
-	rawKeys, ok := sec.Data["keys"]
-	if !ok {
-		return []map[string]any{}, nil
+	if err != nil {
+		return &u, err
 	}
-
-	var keys []string
-	switch v := rawKeys.(type) {
-	case []string:
-		keys = v
-	case []any:
-		for _, x := range v {
-			if s, ok := x.(string); ok {
-				keys = append(keys, s)
-			}
-		}
-	default:
-		return nil, fmt.Errorf("unexpected list response")
+	usersIndex.remove(username)
+	h, err := readUserHistory(ctx, c, usersPrefix, username)
+	if err != nil {
+		return &u, err
 	}
-
-	out := make([]map[string]any, 0, len(keys))
-	q = strings.ToLower(strings.TrimSpace(q))
-
-	for _, username := range keys {
-		if username == "" {
-			continue
-		}
-		if q != "" && !strings.Contains(strings.ToLower(username), q) {
-			continue
-		}
-
-		u, err := readUserKV2(ctx, c, usersPrefix, username)
-		if errors.Is(err, errNotFound) {
-			continue
-		}
-		if err != nil {
-			return nil, err
-		}
-		if filterDisabled != nil && u.Disabled != *filterDisabled {
-			continue
-		}
-
-		out = append(out, map[string]any{
-			"username":   u.Username,
-			"disabled":   u.Disabled,
-			"rootSubdir": u.RootSubdir,
-			"keyCount":   len(u.PublicKeys),
-			"updatedAt":  u.UpdatedAt,
-		})
-
-		if len(out) >= limit {
-			break
-		}
+	if h.CurrentVersion != claimed {
+		usersIndex.invalidate()
+		return nil, errVersionConflict
 	}
-
-	return out, nil
+	return &u, nil
 }
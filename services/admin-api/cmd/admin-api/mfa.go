@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	hv "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/argon2"
+)
+
+// Login methods understood by sftp-server (see its mfa.go).
+const (
+	authModePublicKey     = "publickey"
+	authModePublicKeyTOTP = "publickey+totp"
+	authModePasswordTOTP  = "password+totp"
+)
+
+const minPasswordLen = 12
+
+// Argon2id parameters for new password hashes (RFC 9106 second recommended
+// option, with 64 MiB memory).
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+)
+
+// Bounds on imported hashes; sftp-server refuses anything above them
+// (each login attempt allocates m KiB).
+const (
+	argonMaxMemory     = 256 * 1024
+	argonMaxIterations = 16
+	argonMaxThreads    = 16
+)
+
+// checkPasswordHash validates an imported
+// "$argon2id$v=19$m=...,t=...,p=...$salt$hash" string.
+func checkPasswordHash(encoded string) error {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return errors.New("passwordHash must be an Argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return fmt.Errorf("passwordHash: unsupported argon2 version %q", parts[2])
+	}
+	var mem, iters, threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iters, &threads); err != nil {
+		return fmt.Errorf("passwordHash: invalid parameters %q", parts[3])
+	}
+	if mem > argonMaxMemory || iters == 0 || iters > argonMaxIterations || threads == 0 || threads > argonMaxThreads {
+		return fmt.Errorf("passwordHash: parameters must be at most m=%d,t=%d,p=%d", argonMaxMemory, argonMaxIterations, argonMaxThreads)
+	}
+	if _, err := base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return errors.New("passwordHash: invalid salt")
+	}
+	if key, err := base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return errors.New("passwordHash: invalid hash")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// setPassword hashes password into u; "" removes the password.
+func setPassword(u *User, password string) error {
+	u.Password = ""
+	if password == "" {
+		u.passwordHash = ""
+		return nil
+	}
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLen)
+	}
+	h, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.passwordHash = h
+	return nil
+}
+
+// applyCredentials keeps the stored password hash and TOTP secret across a
+// full replace (POST/PUT), and hashes a new password if one was given. It
+// returns the stored record (nil if there is none) for the audit diff.
+func applyCredentials(ctx context.Context, c *hv.Client, usersPrefix string, u *User, username string) (*User, error) {
+	var before *User
+	if username != "" && usernameRe.MatchString(username) {
+		old, err := readUserKV2(ctx, c, usersPrefix, username)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			before = &old
+		}
+		u.passwordHash, u.totpSecret = old.passwordHash, old.totpSecret
+	}
+	if u.Password != "" {
+		return before, setPassword(u, u.Password)
+	}
+	return before, nil
+}
+
+// mountTOTPRoutes adds TOTP enrollment under /users/{username}:
+//
+//	POST   /totp  generate a new secret; returned once as secret + otpauth URI
+//	DELETE /totp  remove the secret (refused while a +totp mode is set)
+func mountTOTPRoutes(r chi.Router, c *hv.Client, usersPrefix string) {
+	issuer := env("TOTP_ISSUER", "sftp-service")
+
+	r.With(requireRole(roleOperator)).Post("/totp", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		before := u
+
+		b := make([]byte, 20)
+		if _, err := rand.Read(b); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "INTERNAL", err.Error(), nil)
+			return
+		}
+		secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+		u.totpSecret = secret
+
+		version, err := writeUserKV2(req.Context(), c, usersPrefix, u, before.Version)
+		auditRequest(req, auditEvent{Action: "totp_enroll", Target: username, Changes: diffUsers(&before, &u)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+
+		label := url.PathEscape(issuer + ":" + username)
+		q := url.Values{"secret": {secret}, "issuer": {issuer}, "algorithm": {"SHA1"}, "digits": {"6"}, "period": {"30"}}
+		writeJSON(w, http.StatusOK, apiOK{OK: true, Data: map[string]any{
+			"secret":     secret,
+			"otpauthUrl": "otpauth://totp/" + label + "?" + q.Encode(),
+		}})
+	})
+
+	r.With(requireRole(roleOperator)).Delete("/totp", func(w http.ResponseWriter, req *http.Request) {
+		username := chi.URLParam(req, "username")
+		u, ok := loadUserForUpdate(w, req, c, usersPrefix, username)
+		if !ok {
+			return
+		}
+		before := u
+		if strings.HasSuffix(u.AuthMode, "+totp") {
+			writeAPIError(w, http.StatusConflict, "TOTP_IN_USE", "authMode "+u.AuthMode+" needs the TOTP secret; change authMode first",
+				map[string]any{"username": username})
+			return
+		}
+
+		u.totpSecret = ""
+		version, err := writeUserKV2(req.Context(), c, usersPrefix, u, before.Version)
+		auditRequest(req, auditEvent{Action: "totp_remove", Target: username, Changes: diffUsers(&before, &u)}, err)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(version))
+		writeJSON(w, http.StatusOK, apiOK{OK: true})
+	})
+}
+
+// loadUserForUpdate validates username and reads the user, writing the
+// error response itself on failure.
+func loadUserForUpdate(w http.ResponseWriter, req *http.Request, c *hv.Client, usersPrefix, username string) (User, bool) {
+	if !usernameRe.MatchString(username) {
+		writeAPIError(w, http.StatusBadRequest, "INVALID_INPUT", "invalid username", map[string]any{"username": username})
+		return User{}, false
+	}
+	u, err := readUserKV2(req.Context(), c, usersPrefix, username)
+	if errors.Is(err, errNotFound) {
+		writeAPIError(w, http.StatusNotFound, "NOT_FOUND", "user not found", map[string]any{"username": username})
+		return User{}, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "VAULT_ERROR", err.Error(), nil)
+		return User{}, false
+	}
+	return u, true
+}
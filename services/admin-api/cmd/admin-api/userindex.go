@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hv "github.com/hashicorp/vault/api"
+)
+
+// User index: listing, filtering and duplicate-key checks work on an
+// in-memory copy of all users instead of reading every record per request.
+// It is loaded with one LIST and USER_INDEX_CONCURRENCY parallel reads, and
+// reloaded when older than USER_INDEX_TTL. Writes made through this process
+// update it right away; other replicas' changes show up after the TTL.
+// Credentials are not kept in it; each user's activity record is, read
+// along with the user, so listings can sort by it.
+
+type userIndex struct {
+	c              *hv.Client
+	usersPrefix    string
+	activityPrefix string
+	ttl            time.Duration
+	concurrency    int
+
+	mu      sync.Mutex
+	byName  map[string]User
+	sorted  []User // by username; nil when byName changed since
+	loaded  time.Time
+	loadErr error
+	loading chan struct{}    // closed when the running reload ends
+	recent  map[string]*User // writes during the running reload (nil = removed)
+}
+
+// usersIndex is set up by main.
+var usersIndex *userIndex
+
+func (ix *userIndex) fresh() bool {
+	return ix.byName != nil && time.Since(ix.loaded) < ix.ttl
+}
+
+func (ix *userIndex) sortedLocked() []User {
+	if ix.sorted == nil {
+		s := make([]User, 0, len(ix.byName))
+		for _, u := range ix.byName {
+			s = append(s, u)
+		}
+		sort.Slice(s, func(i, j int) bool { return s[i].Username < s[j].Username })
+		ix.sorted = s
+	}
+	return ix.sorted
+}
+
+// users returns all (not deleted) users sorted by username. The slice is
+// shared: callers must not modify it.
+func (ix *userIndex) users(ctx context.Context) ([]User, error) {
+	ix.mu.Lock()
+	if ix.fresh() {
+		defer ix.mu.Unlock()
+		return ix.sortedLocked(), nil
+	}
+	done := ix.loading
+	if done == nil {
+		done = make(chan struct{})
+		ix.loading, ix.recent = done, map[string]*User{}
+		// Not tied to ctx: other requests may be waiting for the same load.
+		go ix.reload(done)
+	}
+	ix.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.loadErr != nil {
+		return nil, ix.loadErr
+	}
+	return ix.sortedLocked(), nil
+}
+
+func (ix *userIndex) reload(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	started := time.Now()
+	byName, err := ix.fetch(ctx)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.loadErr = err
+	if err == nil {
+		for name, u := range ix.recent {
+			if u == nil {
+				delete(byName, name)
+			} else {
+				v := *u
+				if v.Activity == nil {
+					v.Activity = byName[name].Activity
+				}
+				byName[name] = v
+			}
+		}
+		ix.byName, ix.sorted, ix.loaded = byName, nil, started
+	}
+	ix.loading, ix.recent = nil, nil
+	close(done)
+}
+
+// fetch reads all users with at most ix.concurrency reads in flight.
+func (ix *userIndex) fetch(ctx context.Context) (map[string]User, error) {
+	_, _, metadataBase, err := kv2Paths(ix.usersPrefix, "")
+	if err != nil {
+		return nil, err
+	}
+	sec, err := ix.c.Logical().ListWithContext(ctx, metadataBase)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if sec != nil && sec.Data != nil {
+		names = asStrings(sec.Data["keys"])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		byName   = make(map[string]User, len(names))
+		next     = make(chan string)
+	)
+	for i := 0; i < ix.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range next {
+				u, err := readUserKV2(ctx, ix.c, ix.usersPrefix, name)
+				if err == nil {
+					var a userActivity
+					a, err = readActivity(ctx, ix.c, ix.activityPrefix, name)
+					u.Activity = &a
+				}
+				mu.Lock()
+				switch {
+				case errors.Is(err, errNotFound):
+				case err != nil:
+					if firstErr == nil {
+						firstErr = fmt.Errorf("read user %s: %w", name, err)
+						cancel()
+					}
+				default:
+					byName[u.Username] = indexEntry(u)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		select {
+		case next <- name:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return byName, nil
+}
+
+// indexEntry is u without credentials.
+func indexEntry(u User) User {
+	u.HasPassword = u.passwordHash != ""
+	u.TOTPEnabled = u.totpSecret != ""
+	u.Password, u.passwordHash, u.totpSecret = "", "", ""
+	return u
+}
+
+// update records a user written by this process, keeping the indexed
+// activity (which only sftp-server changes).
+func (ix *userIndex) update(u User) {
+	if ix == nil {
+		return
+	}
+	u = indexEntry(u)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	u.Activity = nil
+	if ix.byName != nil {
+		u.Activity = ix.byName[u.Username].Activity
+		ix.byName[u.Username] = u
+		ix.sorted = nil
+	}
+	if ix.recent != nil {
+		ix.recent[u.Username] = &u
+	}
+}
+
+// remove records a user deleted by this process.
+func (ix *userIndex) remove(username string) {
+	if ix == nil {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.byName != nil {
+		delete(ix.byName, username)
+		ix.sorted = nil
+	}
+	if ix.recent != nil {
+		ix.recent[username] = nil
+	}
+}
+
+// invalidate makes the next lookup reload.
+func (ix *userIndex) invalidate() {
+	if ix == nil {
+		return
+	}
+	ix.mu.Lock()
+	ix.loaded = time.Time{}
+	ix.mu.Unlock()
+}
+
+// ---- listing ----
+
+// userSummary is one row of GET /users.
+type userSummary struct {
+	Username   string   `json:"username"`
+	Disabled   bool     `json:"disabled"`
+	RootSubdir string   `json:"rootSubdir"`
+	Tenant     string   `json:"tenant"`
+	Groups     []string `json:"groups,omitempty"`
+	KeyCount   int      `json:"keyCount"`
+	AuthMode   string   `json:"authMode,omitempty"`
+	QuotaBytes int64    `json:"quotaBytes,omitempty"`
+	QuotaFiles int64    `json:"quotaFiles,omitempty"`
+	UpdatedAt  string   `json:"updatedAt"`
+	Version    int64    `json:"version"`
+
+	LastLoginAt    string `json:"lastLoginAt,omitempty"`
+	LastLoginIP    string `json:"lastLoginIP,omitempty"`
+	LastUploadAt   string `json:"lastUploadAt,omitempty"`
+	LastDownloadAt string `json:"lastDownloadAt,omitempty"`
+}
+
+func summarize(u User) userSummary {
+	a := activityOf(u)
+	return userSummary{
+		Username:   u.Username,
+		Disabled:   u.Disabled,
+		RootSubdir: u.RootSubdir,
+		Tenant:     u.Tenant,
+		Groups:     u.Groups,
+		KeyCount:   len(u.PublicKeys),
+		AuthMode:   u.AuthMode,
+		QuotaBytes: u.QuotaBytes,
+		QuotaFiles: u.QuotaFiles,
+		UpdatedAt:  u.UpdatedAt,
+		Version:    u.Version,
+
+		LastLoginAt:    a.LastLoginAt,
+		LastLoginIP:    a.LastLoginIP,
+		LastUploadAt:   a.LastUploadAt,
+		LastDownloadAt: a.LastDownloadAt,
+	}
+}
+
+// userSorts are the sort columns of GET /users. Users without activity
+// sort before those with it.
+var userSorts = map[string]func(a, b User) int{
+	"username":   func(a, b User) int { return strings.Compare(a.Username, b.Username) },
+	"updatedAt":  func(a, b User) int { return strings.Compare(a.UpdatedAt, b.UpdatedAt) },
+	"rootSubdir": func(a, b User) int { return strings.Compare(a.RootSubdir, b.RootSubdir) },
+	"tenant":     func(a, b User) int { return strings.Compare(a.Tenant, b.Tenant) },
+	"quotaBytes": func(a, b User) int { return compareInt64(a.QuotaBytes, b.QuotaBytes) },
+	"quotaFiles": func(a, b User) int { return compareInt64(a.QuotaFiles, b.QuotaFiles) },
+	"lastLoginAt": func(a, b User) int {
+		return strings.Compare(activityOf(a).LastLoginAt, activityOf(b).LastLoginAt)
+	},
+	"lastUploadAt": func(a, b User) int {
+		return strings.Compare(activityOf(a).LastUploadAt, activityOf(b).LastUploadAt)
+	},
+	"lastDownloadAt": func(a, b User) int {
+		return strings.Compare(activityOf(a).LastDownloadAt, activityOf(b).LastDownloadAt)
+	},
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// userQuery is a parsed GET /users request.
+type userQuery struct {
+	q, tenant, group, rootSubdir, authMode string
+	disabled, hasQuota                     *bool
+	quotaMin, quotaMax                     int64 // -1 = no bound
+	updatedAfter, updatedBefore            time.Time
+
+	sort   string
+	desc   bool
+	limit  int
+	cursor *userCursor
+}
+
+// userCursor marks the last user of a page: the sort it belongs to and
+// that user's sort fields.
+type userCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	User struct {
+		Username   string `json:"u"`
+		UpdatedAt  string `json:"t,omitempty"`
+		RootSubdir string `json:"r,omitempty"`
+		Tenant     string `json:"n,omitempty"`
+		QuotaBytes int64  `json:"b,omitempty"`
+		QuotaFiles int64  `json:"f,omitempty"`
+		Activity   struct {
+			LastLoginAt    string `json:"l,omitempty"`
+			LastUploadAt   string `json:"p,omitempty"`
+			LastDownloadAt string `json:"g,omitempty"`
+		} `json:"a"`
+	} `json:"k"`
+}
+
+func (q userQuery) encodeCursor(u User) string {
+	c := userCursor{Sort: q.sort, Desc: q.desc}
+	c.User.Username, c.User.UpdatedAt, c.User.RootSubdir = u.Username, u.UpdatedAt, u.RootSubdir
+	c.User.Tenant, c.User.QuotaBytes, c.User.QuotaFiles = u.Tenant, u.QuotaBytes, u.QuotaFiles
+	a := activityOf(u)
+	c.User.Activity.LastLoginAt, c.User.Activity.LastUploadAt, c.User.Activity.LastDownloadAt = a.LastLoginAt, a.LastUploadAt, a.LastDownloadAt
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (c userCursor) pivot() User {
+	return User{Username: c.User.Username, UpdatedAt: c.User.UpdatedAt, RootSubdir: c.User.RootSubdir,
+		Tenant: c.User.Tenant, QuotaBytes: c.User.QuotaBytes, QuotaFiles: c.User.QuotaFiles,
+		Activity: &userActivity{LastLoginAt: c.User.Activity.LastLoginAt, LastUploadAt: c.User.Activity.LastUploadAt,
+			LastDownloadAt: c.User.Activity.LastDownloadAt}}
+}
+
+// parseUserQuery reads the filters, sort and page of GET /users.
+func parseUserQuery(req *http.Request) (userQuery, error) {
+	qs := req.URL.Query()
+	q := userQuery{
+		q:          strings.ToLower(strings.TrimSpace(qs.Get("q"))),
+		tenant:     strings.TrimSpace(qs.Get("tenant")),
+		group:      strings.TrimSpace(qs.Get("group")),
+		rootSubdir: strings.TrimSpace(qs.Get("rootSubdir")),
+		authMode:   strings.TrimSpace(qs.Get("authMode")),
+		quotaMin:   -1,
+		quotaMax:   -1,
+		sort:       "username",
+		limit:      parseLimit(qs.Get("limit"), 1000),
+	}
+	if qs.Get("limit") == "" {
+		q.limit = 200
+	}
+	if t := principalFrom(req).Tenant; t != "" {
+		q.tenant = t
+	}
+	for name, dst := range map[string]**bool{"disabled": &q.disabled, "hasQuota": &q.hasQuota} {
+		if raw := strings.TrimSpace(qs.Get(name)); raw != "" {
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return q, fmt.Errorf("invalid '%s' query param", name)
+			}
+			*dst = &b
+		}
+	}
+	for name, dst := range map[string]*int64{"quotaBytesMin": &q.quotaMin, "quotaBytesMax": &q.quotaMax} {
+		if raw := strings.TrimSpace(qs.Get(name)); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid '%s' query param", name)
+			}
+			*dst = n
+		}
+	}
+	now := time.Now().UTC()
+	for name, dst := range map[string]*time.Time{"updatedAfter": &q.updatedAfter, "updatedBefore": &q.updatedBefore} {
+		if raw := strings.TrimSpace(qs.Get(name)); raw != "" {
+			t, err := parseAuditTime(raw, now)
+			if err != nil {
+				return q, fmt.Errorf("invalid '%s' query param: %v", name, err)
+			}
+			*dst = t
+		}
+	}
+
+	if s := strings.TrimSpace(qs.Get("sort")); s != "" {
+		q.desc = strings.HasPrefix(s, "-")
+		q.sort = strings.TrimPrefix(s, "-")
+		if userSorts[q.sort] == nil {
+			return q, fmt.Errorf("sort must be one of username, updatedAt, rootSubdir, tenant, quotaBytes, quotaFiles, lastLoginAt, lastUploadAt, lastDownloadAt (prefix - for descending)")
+		}
+	}
+	if raw := strings.TrimSpace(qs.Get("cursor")); raw != "" {
+		b, err := base64.RawURLEncoding.DecodeString(raw)
+		var c userCursor
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.User.Username == "" {
+			return q, errors.New("invalid cursor")
+		}
+		if c.Sort != q.sort || c.Desc != q.desc {
+			return q, errors.New("cursor belongs to a different sort")
+		}
+		q.cursor = &c
+	}
+	return q, nil
+}
+
+func (q userQuery) matches(u User) bool {
+	if q.q != "" && !strings.Contains(strings.ToLower(u.Username), q.q) {
+		return false
+	}
+	if q.tenant != "" && u.Tenant != q.tenant {
+		return false
+	}
+	if q.group != "" && !slices.Contains(u.Groups, q.group) {
+		return false
+	}
+	if q.rootSubdir != "" && u.RootSubdir != q.rootSubdir && !strings.HasPrefix(u.RootSubdir, strings.TrimSuffix(q.rootSubdir, "/")+"/") {
+		return false
+	}
+	if q.authMode != "" && u.AuthMode != q.authMode && !(q.authMode == authModePublicKey && u.AuthMode == "") {
+		return false
+	}
+	if q.disabled != nil && u.Disabled != *q.disabled {
+		return false
+	}
+	if q.hasQuota != nil && (u.QuotaBytes > 0 || u.QuotaFiles > 0) != *q.hasQuota {
+		return false
+	}
+	if q.quotaMin >= 0 && u.QuotaBytes < q.quotaMin {
+		return false
+	}
+	if q.quotaMax >= 0 && u.QuotaBytes > q.quotaMax {
+		return false
+	}
+	if !q.updatedAfter.IsZero() || !q.updatedBefore.IsZero() {
+		t, err := time.Parse(time.RFC3339, u.UpdatedAt)
+		if err != nil {
+			return false
+		}
+		if !q.updatedAfter.IsZero() && t.Before(q.updatedAfter) {
+			return false
+		}
+		if !q.updatedBefore.IsZero() && !t.Before(q.updatedBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare orders users by the query's sort, ties by username ascending.
+func (q userQuery) compare(a, b User) int {
+	c := userSorts[q.sort](a, b)
+	if q.desc {
+		c = -c
+	}
+	if c == 0 {
+		c = strings.Compare(a.Username, b.Username)
+	}
+	return c
+}
+
+// apiPage is apiOK for a paged list: Total counts all matches,
+// NextCursor fetches the next page.
+type apiPage struct {
+	OK         bool   `json:"ok"`
+	Data       any    `json:"data"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// userPage is one page of GET /users.
+type userPage struct {
+	Users      []userSummary
+	Total      int
+	NextCursor string
+}
+
+// listUsers filters, sorts and pages the index.
+func listUsers(ctx context.Context, q userQuery) (userPage, error) {
+	all, err := usersIndex.users(ctx)
+	if err != nil {
+		return userPage{}, err
+	}
+	matched := make([]User, 0, len(all))
+	for _, u := range all {
+		if q.matches(u) {
+			matched = append(matched, u)
+		}
+	}
+	if q.sort != "username" || q.desc {
+		sort.SliceStable(matched, func(i, j int) bool { return q.compare(matched[i], matched[j]) < 0 })
+	}
+
+	start := 0
+	if q.cursor != nil {
+		pivot := q.cursor.pivot()
+		start = sort.Search(len(matched), func(i int) bool { return q.compare(matched[i], pivot) > 0 })
+	}
+	end := start + q.limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	page := userPage{Users: make([]userSummary, 0, end-start), Total: len(matched)}
+	for _, u := range matched[start:end] {
+		page.Users = append(page.Users, summarize(u))
+	}
+	if end < len(matched) && end > start {
+		page.NextCursor = q.encodeCursor(matched[end-1])
+	}
+	return page, nil
+}
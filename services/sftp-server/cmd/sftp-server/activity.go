@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Per-user activity.
+//
+// Each successful login (time, source IP, key fingerprint) and the last
+// upload and download are recorded in an activityStore, one record per
+// user. A field is written at most once per activityWriteInterval unless
+// its value changes (a login from another IP or key), so busy users do not
+// add a Vault version per login.
+// ACTIVITY_STORE=vault (the default) keeps the records under
+// VAULT_ACTIVITY_PREFIX, shared by all replicas and read by admin-api;
+// "memory" keeps them in this process, "off" records nothing. Writes happen
+// in the background and never delay or fail a login.
+
+// activityWriteInterval limits store writes per user and field.
+const activityWriteInterval = time.Minute
+
+// activityLoginTTL is how long this replica remembers a login itself;
+// older ones are read from the store.
+const activityLoginTTL = 24 * time.Hour
+
+// userActivity is one user's record. Times are RFC 3339 UTC.
+type userActivity struct {
+	LastLoginAt    string `json:"lastLoginAt,omitempty"`
+	LastLoginIP    string `json:"lastLoginIP,omitempty"`
+	LastLoginKey   string `json:"lastLoginKey,omitempty"` // SHA256 fingerprint; empty for password logins
+	LastUploadAt   string `json:"lastUploadAt,omitempty"`
+	LastDownloadAt string `json:"lastDownloadAt,omitempty"`
+}
+
+// activityStore persists activity records. Update merges fields into the
+// user's record, creating it if needed. Implementations must be safe for
+// concurrent use.
+type activityStore interface {
+	Get(ctx context.Context, username string) (userActivity, error)
+	Update(ctx context.Context, username string, fields map[string]interface{}) error
+}
+
+type memoryActivityStore struct {
+	mu      sync.Mutex
+	records map[string]map[string]interface{}
+}
+
+func newMemoryActivityStore() *memoryActivityStore {
+	return &memoryActivityStore{records: map[string]map[string]interface{}{}}
+}
+
+func (s *memoryActivityStore) Get(_ context.Context, username string) (userActivity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return parseActivity(s.records[username]), nil
+}
+
+func (s *memoryActivityStore) Update(_ context.Context, username string, fields map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.records[username]
+	if m == nil {
+		m = map[string]interface{}{}
+		s.records[username] = m
+	}
+	for k, v := range fields {
+		m[k] = v
+	}
+	return nil
+}
+
+// vaultActivityStore keeps one KV v2 secret per user under prefix.
+type vaultActivityStore struct {
+	vc     *vault.Client
+	prefix string
+}
+
+func (s *vaultActivityStore) Get(ctx context.Context, username string) (userActivity, error) {
+	sec, err := s.vc.Logical().ReadWithContext(ctx, kvV2DataPath(s.prefix, username))
+	if err != nil || sec == nil || sec.Data == nil {
+		return userActivity{}, err
+	}
+	m, _ := sec.Data["data"].(map[string]interface{})
+	return parseActivity(m), nil
+}
+
+// Update patches the record, or writes it if there is none yet. The
+// policy needs "patch" as well as "create" and "update" on the prefix.
+func (s *vaultActivityStore) Update(ctx context.Context, username string, fields map[string]interface{}) error {
+	path := kvV2DataPath(s.prefix, username)
+	_, err := s.vc.Logical().JSONMergePatch(ctx, path, map[string]interface{}{"data": fields})
+	var re *vault.ResponseError
+	if errors.As(err, &re) && re.StatusCode == http.StatusNotFound {
+		_, err = s.vc.Logical().WriteWithContext(ctx, path, map[string]interface{}{"data": fields})
+	}
+	return err
+}
+
+func parseActivity(m map[string]interface{}) userActivity {
+	str := func(k string) string { v, _ := asString(m[k]); return v }
+	return userActivity{
+		LastLoginAt:    str("lastLoginAt"),
+		LastLoginIP:    str("lastLoginIP"),
+		LastLoginKey:   str("lastLoginKey"),
+		LastUploadAt:   str("lastUploadAt"),
+		LastDownloadAt: str("lastDownloadAt"),
+	}
+}
+
+// activityTracker records activity and remembers what this replica saw, so
+// recent logins can be checked without a store read.
+type activityTracker struct {
+	store   activityStore
+	timeout time.Duration
+
+	mu         sync.Mutex
+	lastLogins map[string]time.Time
+	written    map[string]activityWrite // last write per user and field
+	swept      time.Time
+}
+
+// activityWrite is the time and value of the last write of a field.
+type activityWrite struct {
+	at    time.Time
+	value string
+}
+
+// activity is set by StartActivityTracking; nil when tracking is off.
+var activity *activityTracker
+
+func StartActivityTracking(cfg config, vc *vault.Client) error {
+	t := &activityTracker{timeout: cfg.VaultTimeout, lastLogins: map[string]time.Time{}, written: map[string]activityWrite{}}
+	switch cfg.ActivityStore {
+	case "off":
+		return nil
+	case "memory":
+		t.store = newMemoryActivityStore()
+	case "vault":
+		t.store = &vaultActivityStore{vc: vc, prefix: cfg.VaultActivityPrefix}
+	default:
+		return fmt.Errorf("unknown activity store %q", cfg.ActivityStore)
+	}
+	activity = t
+	return nil
+}
+
+// recordLogin notes a successful login of user from remote with the key
+// fingerprint (empty if none). Safe to call when tracking is off.
+func recordLogin(user, remote, key string) {
+	t := activity
+	if t == nil {
+		return
+	}
+	now := time.Now().UTC()
+	ip := ""
+	if addr := remoteIP(remote); addr != nil {
+		ip = addr.String()
+	}
+	t.mu.Lock()
+	t.lastLogins[user] = now
+	write := t.due(user, "lastLoginAt", ip+"\x00"+key, now)
+	t.mu.Unlock()
+	if write {
+		t.update(user, map[string]interface{}{
+			"lastLoginAt":  now.Format(time.RFC3339),
+			"lastLoginIP":  ip,
+			"lastLoginKey": key,
+		})
+	}
+}
+
+// recordUpload and recordDownload note a completed upload / opened
+// download. Safe to call when tracking is off.
+func recordUpload(user string)   { recordTransfer(user, "lastUploadAt") }
+func recordDownload(user string) { recordTransfer(user, "lastDownloadAt") }
+
+func recordTransfer(user, field string) {
+	t := activity
+	if t == nil {
+		return
+	}
+	now := time.Now().UTC()
+	t.mu.Lock()
+	write := t.due(user, field, "", now)
+	t.mu.Unlock()
+	if write {
+		t.update(user, map[string]interface{}{field: now.Format(time.RFC3339)})
+	}
+}
+
+// due reports whether field of user should be written now with value, and
+// if so notes the write. Called with t.mu held; it also drops entries that
+// no longer matter, at most once per activityWriteInterval.
+func (t *activityTracker) due(user, field, value string, now time.Time) bool {
+	if now.Sub(t.swept) >= activityWriteInterval {
+		for k, w := range t.written {
+			if now.Sub(w.at) >= activityWriteInterval {
+				delete(t.written, k)
+			}
+		}
+		for u, at := range t.lastLogins {
+			if now.Sub(at) >= activityLoginTTL {
+				delete(t.lastLogins, u)
+			}
+		}
+		t.swept = now
+	}
+	key := user + "\x00" + field
+	if w, ok := t.written[key]; ok && w.value == value && now.Sub(w.at) < activityWriteInterval {
+		return false
+	}
+	t.written[key] = activityWrite{at: now, value: value}
+	return true
+}
+
+func (t *activityTracker) update(user string, fields map[string]interface{}) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		defer cancel()
+		if err := t.store.Update(ctx, user, fields); err != nil {
+			log.Printf("activity store: %s: %v", user, err)
+		}
+	}()
+}
+
+// lastLogin returns user's last login, or the zero time if none is known.
+// A login seen by this replica at or after notBefore answers without a
+// store read.
+func (t *activityTracker) lastLogin(ctx context.Context, user string, notBefore time.Time) (time.Time, error) {
+	t.mu.Lock()
+	local := t.lastLogins[user]
+	t.mu.Unlock()
+	if !local.IsZero() && !local.Before(notBefore) {
+		return local, nil
+	}
+	a, err := t.store.Get(ctx, user)
+	if err != nil {
+		return time.Time{}, err
+	}
+	last, _ := time.Parse(time.RFC3339, a.LastLoginAt)
+	if local.After(last) {
+		last = local
+	}
+	return last, nil
+}
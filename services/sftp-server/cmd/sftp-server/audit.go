@@ -16,19 +16,37 @@ type auditEvent struct {
 	Bytes   int64  `json:"bytes,omitempty"`
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
+
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	// Hash algorithm (check_file)
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// SHA256 fingerprint of the public key (auth events)
+	Key string `json:"key,omitempty"`
+
+	// Negotiated kex, hostKey, cipher and mac (session_start)
+	Algorithms map[string]string `json:"algorithms,omitempty"`
+
+	// session_end, exec and auth_ban
+	Reason     string `json:"reason,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
 }
 
 func audit(user, remote, action, path, target string, bytes int64, err error) {
-	ev := auditEvent{
-		Ts:      time.Now().UTC().Format(time.RFC3339Nano),
-		User:    user,
-		Remote:  remote,
-		Action:  action,
-		Path:    path,
-		Target:  target,
-		Bytes:   bytes,
-		Success: err == nil,
-	}
+	auditEv(auditEvent{
+		User:   user,
+		Remote: remote,
+		Action: action,
+		Path:   path,
+		Target: target,
+		Bytes:  bytes,
+	}, err)
+}
+
+// auditEv logs a prepared event, for callers that set the optional fields.
+func auditEv(ev auditEvent, err error) {
+	ev.Ts = time.Now().UTC().Format(time.RFC3339Nano)
 	if err != nil {
 		ev.Success = false
 		ev.Error = err.Error()
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,44 +11,85 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func makePublicKeyAuthCallback(cfg config, vc *vault.Client, cache *userCache) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+func makePublicKeyAuthCallback(cfg config, vc *vault.Client, cache *userCache, guard *authGuard) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
 	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 		user := c.User()
 		remote := c.RemoteAddr().String()
 
+		if err := guard.check(user, remote); err != nil {
+			audit(user, remote, "auth_fail_locked", "", "", 0, err)
+			return nil, err
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.VaultTimeout)
 		defer cancel()
 
 		ur, err := cache.getOrLoad(ctx, vc, cfg.VaultUsersPrefix, user, cfg.UserCacheTTL)
 		if err != nil {
 			audit(user, remote, "auth_fail_user_load", "", "", 0, err)
+			guard.fail(user, remote)
 			return nil, fmt.Errorf("permission denied")
 		}
 		if ur.Disabled {
 			audit(user, remote, "auth_fail_disabled", "", "", 0, fmt.Errorf("disabled"))
+			guard.fail(user, remote)
+			return nil, fmt.Errorf("permission denied")
+		}
+		if action, err := checkLifecycle(ctx, cfg, ur, time.Now()); err != nil {
+			audit(user, remote, action, "", "", 0, err)
+			guard.fail(user, remote)
+			return nil, fmt.Errorf("permission denied")
+		}
+
+		ip := remoteIP(remote)
+		if !ipAllowed(ip, ur.allowedNets) {
+			audit(user, remote, "auth_fail_source", "", "", 0, fmt.Errorf("source address not in allowedCIDRs"))
+			guard.fail(user, remote)
 			return nil, fmt.Errorf("permission denied")
 		}
 
-		ok := isKeyAllowed(key, ur.PublicKeys)
-		if !ok {
-			audit(user, remote, "auth_fail_key", "", "", 0, fmt.Errorf("key not allowed"))
+		ak, err := matchAuthorizedKey(key, ur.PublicKeys, ip, time.Now())
+		if err != nil {
+			action := "auth_fail_key"
+			if errors.Is(err, errKeyExpired) {
+				action = "auth_fail_key_expired"
+			}
+			// Not counted here: clients offer each key they have in turn.
+			// A connection that never authenticates is counted once by
+			// handleConn.
+			auditEv(auditEvent{User: user, Remote: remote, Action: action, Key: ssh.FingerprintSHA256(key)}, err)
 			return nil, fmt.Errorf("permission denied")
 		}
 
-		// Embed a hint in permissions if you want; not strictly needed.
+		// Describe the matched key for the session (see authkeys.go).
 		perms := &ssh.Permissions{
-			Extensions: map[string]string{
-				"authed": "true",
-			},
+			Extensions: ak.extensions(),
 		}
+		perms.Extensions["authed"] = "true"
+
+		if ur.AuthMode == AuthModePublicKeyTOTP {
+			if ur.TOTPSecret == "" {
+				err := fmt.Errorf("authMode %s but no TOTP secret enrolled", ur.AuthMode)
+				audit(user, remote, "auth_fail_totp", "", "", 0, err)
+				return nil, fmt.Errorf("permission denied")
+			}
+			return nil, &ssh.PartialSuccessError{Next: totpStage(user, remote, ur.TOTPSecret, perms, guard, "publickey")}
+		}
+		if ur.AuthMode == AuthModePasswordTOTP {
+			audit(user, remote, "auth_fail_key", "", "", 0, fmt.Errorf("publickey not enabled for this user"))
+			guard.fail(user, remote)
+			return nil, fmt.Errorf("permission denied")
+		}
+		perms.Extensions[extAuthMethods] = "publickey"
 
-		audit(user, remote, "auth_ok", "", "", 0, nil)
+		// x/crypto also calls this for unsigned key queries, so the login
+		// is only recorded once the handshake is done (see handleConn).
 		return perms, nil
 	}
 }
 
-func makePublicKeyAuthCallbackWithMetrics(cfg config, vc *vault.Client, cache *userCache) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
-    inner := makePublicKeyAuthCallback(cfg, vc, cache)
+func makePublicKeyAuthCallbackWithMetrics(cfg config, vc *vault.Client, cache *userCache, guard *authGuard) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+    inner := makePublicKeyAuthCallback(cfg, vc, cache, guard)
 
     return func(c ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
         start := time.Now()
@@ -55,11 +97,20 @@ func makePublicKeyAuthCallbackWithMetrics(cfg config, vc *vault.Client, cache *u
 
         user := c.User()
         result := AuthOK
+        var partial *ssh.PartialSuccessError
+        if errors.As(err, &partial) || err == nil {
+            // Recorded when the second factor completes, or by handleConn
+            // once the client has proven it holds the key.
+            return perm, err
+        }
         if err != nil {
             // Map your existing error behavior to labels.
             // If your inner() returns specific sentinel errors, map them here.
             // Otherwise, keep it simple:
             result = AuthFailKey
+            if errors.Is(err, errAuthLocked) {
+                result = AuthFailLocked
+            }
         }
 
         ObserveAuth(user, result, time.Since(start))
@@ -67,25 +118,8 @@ func makePublicKeyAuthCallbackWithMetrics(cfg config, vc *vault.Client, cache *u
     }
 }
 
-func isKeyAllowed(presented ssh.PublicKey, allowed []string) bool {
-	pb := presented.Marshal()
-
-	for _, s := range allowed {
-		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
-		if err != nil {
-			continue
-		}
-		ab := parsed.Marshal()
-		if len(ab) != len(pb) {
-			continue
-		}
-		if subtle.ConstantTimeCompare(ab, pb) == 1 {
-			return true
-		}
-	}
-	return false
+// keysEqual compares marshalled public keys in constant time.
+func keysEqual(a, b []byte) bool {
+	return len(a) == len(b) && subtle.ConstantTimeCompare(a, b) == 1
 }
 
-// (Optional helper if you later add time-based disabling, etc.)
-func within(_ time.Time, _ time.Time) bool { return true }
-
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorized_keys handling.
+//
+// publicKeys entries are authorized_keys lines and may carry OpenSSH options
+// in front of the key type. Supported options:
+//
+//	from="pattern-list"   source address restriction; patterns are IPs,
+//	                      CIDRs or wildcards (* ?), "!" negates. Hostnames
+//	                      are not resolved, so hostname patterns never match.
+//	expiry-time="time"    YYYYMMDD[HHMM[SS]], server local time or UTC with
+//	                      a trailing Z; the key is refused afterwards.
+//	permissions="list"    SFTP operations this key may perform (see
+//	                      parseKeyPermissions); all if absent.
+//	restrict, no-*        recorded on the session. PTYs, forwarding and
+//	                      shells are never offered, so they already hold.
+//
+// Unknown options are ignored. A line whose expiry-time or permissions
+// cannot be parsed is never used.
+//
+// The matched key is described to the rest of the session through
+// ssh.Permissions.Extensions (extKey* below).
+
+var (
+	errKeyNotAllowed = errors.New("key not allowed")
+	errKeyFromDenied = errors.New("key not allowed from this address")
+	errKeyExpired    = errors.New("key expired")
+	errKeyBadOptions = errors.New("key has invalid options")
+)
+
+// ssh.Permissions.Extensions set for an authenticated key.
+const (
+	extKeyFingerprint = "key-fingerprint"
+	extKeyComment     = "key-comment"
+	extKeyPermissions = "key-permissions" // canonical list; absent = all
+	extKeyFlags       = "key-flags"       // restrict / no-* options, comma separated
+)
+
+type authorizedKey struct {
+	key     ssh.PublicKey
+	comment string
+	options []string
+
+	perms keyPerms
+	flags []string
+}
+
+// extensions describes the key for ssh.Permissions.
+func (k authorizedKey) extensions() map[string]string {
+	ext := map[string]string{
+		extKeyFingerprint: ssh.FingerprintSHA256(k.key),
+		extKeyComment:     k.comment,
+	}
+	if k.perms != nil {
+		ext[extKeyPermissions] = k.perms.String()
+	}
+	if len(k.flags) > 0 {
+		ext[extKeyFlags] = strings.Join(k.flags, ",")
+	}
+	return ext
+}
+
+// option returns the value of name="value" (or true for a bare flag).
+func (k authorizedKey) option(name string) (string, bool) {
+	for _, o := range k.options {
+		n, v, hasValue := strings.Cut(o, "=")
+		if !strings.EqualFold(strings.TrimSpace(n), name) {
+			continue
+		}
+		if !hasValue {
+			return "", true
+		}
+		return strings.Trim(strings.TrimSpace(v), `"`), true
+	}
+	return "", false
+}
+
+// matchAuthorizedKey finds the first line in allowed that holds presented
+// and whose options admit a connection from ip at now. If the key is listed
+// but every such line refuses it, the error says why (from, expiry, options).
+func matchAuthorizedKey(presented ssh.PublicKey, allowed []string, ip net.IP, now time.Time) (authorizedKey, error) {
+	pb := presented.Marshal()
+	reason := errKeyNotAllowed
+
+	for _, s := range allowed {
+		parsed, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(s))
+		if err != nil {
+			continue
+		}
+		if !keysEqual(parsed.Marshal(), pb) {
+			continue
+		}
+		ak := authorizedKey{key: parsed, comment: comment, options: options}
+		if err := ak.admit(ip, now); err != nil {
+			reason = err
+			continue
+		}
+		return ak, nil
+	}
+	return authorizedKey{}, reason
+}
+
+// admit evaluates the line's options and fills perms and flags.
+func (k *authorizedKey) admit(ip net.IP, now time.Time) error {
+	if v, ok := k.option("expiry-time"); ok {
+		exp, err := parseExpiryTime(v)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errKeyBadOptions, err)
+		}
+		if !now.Before(exp) {
+			return fmt.Errorf("%w at %s", errKeyExpired, exp.UTC().Format(time.RFC3339))
+		}
+	}
+	if from, ok := k.option("from"); ok && !matchFromPatterns(from, ip) {
+		return errKeyFromDenied
+	}
+	if v, ok := k.option("permissions"); ok {
+		p, err := parseKeyPermissions(v)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errKeyBadOptions, err)
+		}
+		k.perms = p
+	}
+	for _, o := range k.options {
+		name := strings.ToLower(strings.TrimSpace(o))
+		if name == "restrict" || (strings.HasPrefix(name, "no-") && !strings.Contains(name, "=")) {
+			k.flags = append(k.flags, name)
+		}
+	}
+	return nil
+}
+
+// parseExpiryTime parses the OpenSSH expiry-time format.
+func parseExpiryTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") || strings.HasSuffix(v, "z") {
+		v, loc = v[:len(v)-1], time.UTC
+	}
+	var layout string
+	switch len(v) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("expiry-time %q: want YYYYMMDD[HHMM[SS]][Z]", v)
+	}
+	return time.ParseInLocation(layout, v, loc)
+}
+
+// SFTP operations a key can be limited to with permissions="...".
+const (
+	PermRead   = "read"   // download, check-file
+	PermList   = "list"   // ls, stat, statvfs
+	PermWrite  = "write"  // upload, mkdir, setstat, copy-data
+	PermDelete = "delete" // rm, rmdir
+	PermRename = "rename" // rename, posix-rename, hardlink
+)
+
+var allPerms = []string{PermRead, PermList, PermWrite, PermDelete, PermRename}
+
+// keyPerms is the set of operations a key may perform; nil allows all.
+type keyPerms map[string]bool
+
+// parseKeyPermissions parses a comma-separated list of operations. The
+// shorthands "ro" (read,list) and "rw"/"all" (everything) are accepted.
+func parseKeyPermissions(v string) (keyPerms, error) {
+	p := keyPerms{}
+	for _, op := range strings.Split(v, ",") {
+		op = strings.ToLower(strings.TrimSpace(op))
+		switch op {
+		case "":
+		case PermRead, PermList, PermWrite, PermDelete, PermRename:
+			p[op] = true
+		case "ro":
+			p[PermRead], p[PermList] = true, true
+		case "rw", "all":
+			for _, a := range allPerms {
+				p[a] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown permission %q", op)
+		}
+	}
+	return p, nil
+}
+
+func (p keyPerms) allows(op string) bool {
+	return p == nil || p[op]
+}
+
+func (p keyPerms) String() string {
+	ops := make([]string, 0, len(p))
+	for op := range p {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return strings.Join(ops, ",")
+}
+
+// keyPermsFromExtensions recovers the matched key's permissions.
+func keyPermsFromExtensions(ext map[string]string) keyPerms {
+	v, ok := ext[extKeyPermissions]
+	if !ok {
+		return nil
+	}
+	p, err := parseKeyPermissions(v)
+	if err != nil {
+		return keyPerms{} // validated at auth; deny everything if not
+	}
+	return p
+}
+
+// matchFromPatterns implements OpenSSH from= semantics for an IP: a match
+// on any negated pattern denies, otherwise any positive match allows.
+func matchFromPatterns(list string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	addr := ip.String()
+	allowed := false
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if p == "" {
+			continue
+		}
+
+		var hit bool
+		if strings.Contains(p, "/") {
+			if _, n, err := net.ParseCIDR(p); err == nil {
+				hit = n.Contains(ip)
+			}
+		} else {
+			hit, _ = path.Match(p, addr)
+		}
+
+		if hit && negate {
+			return false
+		}
+		if hit {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// ipAllowed reports whether ip is inside any of nets; an empty list allows all.
+func ipAllowed(ip net.IP, nets []*net.IPNet) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
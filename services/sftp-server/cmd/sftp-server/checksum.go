@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Checksums of uploaded files.
+//
+// Hashes are computed while WriteAt streams the upload in order; if the
+// client writes out of order the temp file is re-read at commit instead.
+// The result goes into the put_commit audit event and is stored either as
+// extended attributes ("user.sftp.<alg>") or as a JSON sidecar under
+// <DATA_ROOT>/.sftp-checksums, mirroring the file's location.
+
+const (
+	ChecksumStoreXattr   = "xattr"
+	ChecksumStoreSidecar = "sidecar"
+	ChecksumStoreNone    = "none"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newHash returns a hash for the given algorithm name, or nil if unknown.
+// The names follow the SFTP check-file extension where one exists.
+func newHash(alg string) hash.Hash {
+	switch alg {
+	case "sha256":
+		return sha256.New()
+	case "md5":
+		return md5.New()
+	case "crc32c":
+		return crc32.New(crc32cTable)
+	case "sha1":
+		return sha1.New()
+	case "sha512":
+		return sha512.New()
+	case "crc32":
+		return crc32.NewIEEE()
+	default:
+		return nil
+	}
+}
+
+// parseChecksumAlgorithms parses CHECKSUM_ALGORITHMS ("sha256,md5,crc32c").
+// "none" disables checksums.
+func parseChecksumAlgorithms(raw string) ([]string, error) {
+	raw = strings.TrimSpace(strings.ToLower(raw))
+	if raw == "none" {
+		return nil, nil
+	}
+	var algs []string
+	for _, a := range strings.Split(raw, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		switch a {
+		case "sha256", "md5", "crc32c":
+		default:
+			return nil, fmt.Errorf("unsupported checksum algorithm %q (want sha256, md5, crc32c)", a)
+		}
+		if !containsString(algs, a) {
+			algs = append(algs, a)
+		}
+	}
+	return algs, nil
+}
+
+type checksumPolicy struct {
+	algs        []string
+	store       string
+	dataRoot    string
+	sidecarRoot string
+}
+
+func checksumPolicyFromConfig(cfg config) checksumPolicy {
+	return checksumPolicy{
+		algs:        cfg.ChecksumAlgorithms,
+		store:       cfg.ChecksumStore,
+		dataRoot:    cfg.DataRoot,
+		sidecarRoot: filepath.Join(cfg.DataRoot, ".sftp-checksums"),
+	}
+}
+
+func (p checksumPolicy) newHasher() *streamHasher {
+	if len(p.algs) == 0 {
+		return nil
+	}
+	h := &streamHasher{hashes: map[string]hash.Hash{}}
+	for _, a := range p.algs {
+		h.hashes[a] = newHash(a)
+	}
+	return h
+}
+
+func (p checksumPolicy) sidecarPath(abs string) (string, bool) {
+	rel, err := filepath.Rel(p.dataRoot, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.Join(p.sidecarRoot, rel), true
+}
+
+// save stores sums for the committed file at abs.
+func (p checksumPolicy) save(abs string, sums map[string]string) error {
+	if len(sums) == 0 {
+		return nil
+	}
+	switch p.store {
+	case ChecksumStoreXattr:
+		for alg, v := range sums {
+			if err := setXattr(abs, "user.sftp."+alg, []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case ChecksumStoreSidecar:
+		sp, ok := p.sidecarPath(abs)
+		if !ok {
+			return fmt.Errorf("file outside data root")
+		}
+		if err := os.MkdirAll(filepath.Dir(sp), 0o750); err != nil {
+			return err
+		}
+		b, err := json.Marshal(sums)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(sp+".json", b, 0o640)
+	}
+	return nil
+}
+
+// load returns the stored sums for abs (possibly empty).
+func (p checksumPolicy) load(abs string) map[string]string {
+	out := map[string]string{}
+	switch p.store {
+	case ChecksumStoreXattr:
+		for _, alg := range p.algs {
+			if v, err := getXattr(abs, "user.sftp."+alg); err == nil && len(v) > 0 {
+				out[alg] = string(v)
+			}
+		}
+	case ChecksumStoreSidecar:
+		if sp, ok := p.sidecarPath(abs); ok {
+			if b, err := os.ReadFile(sp + ".json"); err == nil {
+				_ = json.Unmarshal(b, &out)
+			}
+		}
+	}
+	return out
+}
+
+// move keeps sidecars in step with renames (xattrs move with the inode).
+func (p checksumPolicy) move(oldAbs, newAbs string) {
+	if p.store != ChecksumStoreSidecar {
+		return
+	}
+	op, ok1 := p.sidecarPath(oldAbs)
+	np, ok2 := p.sidecarPath(newAbs)
+	if !ok1 || !ok2 {
+		return
+	}
+	_ = os.MkdirAll(filepath.Dir(np), 0o750)
+	_ = os.Rename(op+".json", np+".json") // file
+	_ = os.Rename(op, np)                 // directory
+}
+
+func (p checksumPolicy) remove(abs string) {
+	if p.store != ChecksumStoreSidecar {
+		return
+	}
+	if sp, ok := p.sidecarPath(abs); ok {
+		_ = os.Remove(sp + ".json")
+	}
+}
+
+// streamHasher hashes sequential WriteAt calls as they arrive.
+type streamHasher struct {
+	mu     sync.Mutex
+	hashes map[string]hash.Hash
+	next   int64
+	broken bool // saw a non-sequential write; rehash at commit
+}
+
+func (h *streamHasher) write(p []byte, off int64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.broken {
+		return
+	}
+	if off != h.next {
+		h.broken = true
+		return
+	}
+	for _, hh := range h.hashes {
+		hh.Write(p)
+	}
+	h.next += int64(len(p))
+}
+
+// sums returns hex digests for the file at p, re-reading it if streaming
+// could not cover every byte.
+func (h *streamHasher) sums(p string) (map[string]string, error) {
+	if h == nil {
+		return nil, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if h.broken || h.next != info.Size() {
+		for _, hh := range h.hashes {
+			hh.Reset()
+		}
+		if err := hashFile(p, h.hashes); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make(map[string]string, len(h.hashes))
+	for alg, hh := range h.hashes {
+		out[alg] = hex.EncodeToString(hh.Sum(nil))
+	}
+	return out, nil
+}
+
+func hashFile(p string, hashes map[string]hash.Hash) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ws := make([]io.Writer, 0, len(hashes))
+	for _, hh := range hashes {
+		ws = append(ws, hh)
+	}
+	_, err = io.Copy(io.MultiWriter(ws...), f)
+	return err
+}
+
+// formatChecksums renders sums as "alg:hex" pairs in a stable order, for
+// places that want a single string (e.g. exec hook env).
+func formatChecksums(sums map[string]string) string {
+	algs := make([]string, 0, len(sums))
+	for a := range sums {
+		algs = append(algs, a)
+	}
+	sort.Strings(algs)
+	parts := make([]string, 0, len(algs))
+	for _, a := range algs {
+		parts = append(parts, a+":"+sums[a])
+	}
+	return strings.Join(parts, ",")
+}
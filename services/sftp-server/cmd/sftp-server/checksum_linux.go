@@ -0,0 +1,16 @@
+package main
+
+import "syscall"
+
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
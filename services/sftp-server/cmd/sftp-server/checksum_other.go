@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func setXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"fmt"
-	"os"
-	"strconv"
+	"net"
+	"strings"
 	"time"
 )
 
 type config struct {
-	ListenAddr       string
-	DataRoot         string
-	HostKeyPath      string
-	VaultAddr        string
-	VaultToken       string
-	VaultUsersPrefix string
+	ListenAddr          string
+	DataRoot            string
+	HostKeyPaths        []string
+	VaultAddr           string
+	VaultToken          string
+	VaultUsersPrefix    string
+	VaultHoldsPrefix    string
+	VaultBansPrefix     string
+	VaultActivityPrefix string
+	VaultGroupsPrefix   string
 
 	// Defaults if user record omits quota fields
 	DefaultQuotaBytes int64
@@ -24,78 +28,211 @@ type config struct {
 	UserCacheTTL  time.Duration
 	DisableCache  bool
 	LogAuditJSON  bool
+
+	// Event hooks (see hooks.go); disabled when HooksConfigPath is empty
+	HooksConfigPath string
+	HooksQueueDir   string
+
+	// Upload checksums (see checksum.go)
+	ChecksumAlgorithms []string
+	ChecksumStore      string
+
+	// Directory listing defaults (user record may override)
+	ListSort       string
+	ListMaxEntries int64
+
+	// Bandwidth limits in bytes/s, 0 = unlimited (see throttle.go)
+	ThrottleUploadBPS   int64
+	ThrottleDownloadBPS int64
+	ThrottleCIDRs       []cidrLimit
+
+	// Session lifetime (see session.go); 0 disables each check
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+	KeepaliveInterval  time.Duration
+	KeepaliveMaxMisses int
+
+	// Offer password / keyboard-interactive logins (see mfa.go)
+	PasswordAuthEnabled bool
+
+	// "exec" requests: legacy scp and allow-listed commands (see exec.go)
+	SCPEnabled   bool
+	ExecCommands []string
+
+	// Prometheus endpoint (see metrics.go)
+	Metrics MetricsConfig
+
+	// SSH algorithms and host keys (see crypto.go)
+	Crypto               cryptoPolicy
+	HostKeyAnnouncePaths []string
+
+	// PROXY protocol from load balancers (see proxyproto.go)
+	ProxyProtocolEnabled      bool
+	ProxyProtocolTrustedCIDRs []*net.IPNet
+	ProxyProtocolTimeout      time.Duration
+
+	// Brute-force protection (see lockout.go)
+	LockoutEnabled            bool
+	LockoutMaxFailuresIP      int
+	LockoutMaxFailuresUser    int
+	LockoutMaxFailuresUserAny int
+	LockoutWindow             time.Duration
+	LockoutBanDuration        time.Duration
+	LockoutBackoffBase        time.Duration
+	LockoutBackoffMax         time.Duration
+	LockoutAllowCIDRs         []*net.IPNet
+	LockoutStore              string // "memory" or "vault"
+	LockoutSyncInterval       time.Duration
+
+	// Account lifecycle and login tracking (see lifecycle.go, activity.go)
+	ActivityStore  string // "vault", "memory" or "off"
+	InactivityDays int64  // 0 = users are never disabled for inactivity by default
 }
 
-func loadConfigFromEnv() (config, error) {
+// loadConfig reads the configuration from the environment and, if path is
+// set, a config file (see configfile.go). All problems are reported at once.
+func loadConfig(path string) (config, error) {
+	s, err := loadSettings(path)
+	if err != nil {
+		return config{}, err
+	}
 	var c config
 
-	c.ListenAddr = getenv("LISTEN_ADDR", "0.0.0.0:2022")
-	c.DataRoot = getenv("DATA_ROOT", "/data")
-	c.HostKeyPath = getenv("HOST_KEY_PATH", "/keys/ssh_host_ed25519_key")
-
-	c.VaultAddr = getenv("VAULT_ADDR", "")
-	c.VaultToken = getenv("VAULT_TOKEN", "")
-	c.VaultUsersPrefix = getenv("VAULT_USERS_PREFIX", "kv/sftp/users")
+	c.ListenAddr = s.str("LISTEN_ADDR", "0.0.0.0:2022")
+	c.DataRoot = s.str("DATA_ROOT", "/data")
+	c.HostKeyPaths = s.list("HOST_KEY_PATHS", s.str("HOST_KEY_PATH", "/keys/ssh_host_ed25519_key"))
+	c.HostKeyAnnouncePaths = s.list("HOST_KEY_ANNOUNCE_PATHS", "")
+
+	c.VaultAddr = s.str("VAULT_ADDR", "")
+	c.VaultToken = s.str("VAULT_TOKEN", "")
+	c.VaultUsersPrefix = s.str("VAULT_USERS_PREFIX", "kv/sftp/users")
+	// Legal holds live next to the user records by default, e.g. "kv/sftp/holds".
+	c.VaultHoldsPrefix = s.str("VAULT_HOLDS_PREFIX", siblingPrefix(c.VaultUsersPrefix, "holds"))
+	c.VaultBansPrefix = s.str("VAULT_BANS_PREFIX", siblingPrefix(c.VaultUsersPrefix, "bans"))
+	c.VaultActivityPrefix = s.str("VAULT_ACTIVITY_PREFIX", siblingPrefix(c.VaultUsersPrefix, "activity"))
+	c.VaultGroupsPrefix = s.str("VAULT_GROUPS_PREFIX", siblingPrefix(c.VaultUsersPrefix, "groups"))
+
+	c.Metrics = MetricsConfig{
+		Addr:               s.str("METRICS_ADDR", "0.0.0.0:9090"),
+		Path:               s.str("METRICS_PATH", "/metrics"),
+		IncludeUserLabel:   s.bool("METRICS_INCLUDE_USER", false),
+		Namespace:          s.str("METRICS_NAMESPACE", "sftp"),
+		Subsystem:          s.str("METRICS_SUBSYSTEM", "server"),
+		DisableGoCollector: s.bool("METRICS_DISABLE_GO", false),
+		DisableProcess:     s.bool("METRICS_DISABLE_PROCESS", false),
+	}
 
-	c.DefaultQuotaBytes = parseEnvInt64("DEFAULT_QUOTA_BYTES", 0) // 0 = unlimited by default
-	c.DefaultQuotaFiles = parseEnvInt64("DEFAULT_QUOTA_FILES", 0) // 0 = unlimited by default
+	c.DefaultQuotaBytes = s.size("DEFAULT_QUOTA_BYTES", 0) // 0 = unlimited by default
+	c.DefaultQuotaFiles = s.int64("DEFAULT_QUOTA_FILES", 0) // 0 = unlimited by default
 
-	c.VaultTimeout = parseEnvDuration("VAULT_TIMEOUT", 5*time.Second)
-	c.UserCacheTTL = parseEnvDuration("USER_CACHE_TTL", 30*time.Second)
+	c.VaultTimeout = s.duration("VAULT_TIMEOUT", 5*time.Second)
+	c.UserCacheTTL = s.duration("USER_CACHE_TTL", 30*time.Second)
 
-	c.DisableCache = parseEnvBool("DISABLE_USER_CACHE", false)
+	c.DisableCache = s.bool("DISABLE_USER_CACHE", false)
 	c.LogAuditJSON = true // always JSON stdout in this starter kit
 
-	if c.VaultAddr == "" {
-		return c, fmt.Errorf("VAULT_ADDR is required")
+	c.HooksConfigPath = s.str("HOOKS_CONFIG", "")
+	// Must be on persistent storage for events to survive restarts.
+	c.HooksQueueDir = s.str("HOOKS_QUEUE_DIR", c.DataRoot+"/.sftp-events")
+
+	algs, err := parseChecksumAlgorithms(s.str("CHECKSUM_ALGORITHMS", "sha256"))
+	s.check("CHECKSUM_ALGORITHMS", err)
+	c.ChecksumAlgorithms = algs
+	c.ChecksumStore = s.str("CHECKSUM_STORE", ChecksumStoreXattr)
+	switch c.ChecksumStore {
+	case ChecksumStoreXattr, ChecksumStoreSidecar, ChecksumStoreNone:
+	default:
+		s.check("CHECKSUM_STORE", fmt.Errorf("must be %s, %s or %s", ChecksumStoreXattr, ChecksumStoreSidecar, ChecksumStoreNone))
 	}
-	if c.VaultToken == "" {
-		return c, fmt.Errorf("VAULT_TOKEN is required (dev only; use K8s auth in prod)")
+
+	c.ListSort = s.str("LIST_SORT", ListSortNone)
+	if !validListSort(c.ListSort) {
+		s.check("LIST_SORT", fmt.Errorf("must be %s, %s or %s", ListSortNone, ListSortName, ListSortMtime))
 	}
-	return c, nil
-}
+	c.ListMaxEntries = s.int64("LIST_MAX_ENTRIES", 0) // 0 = unlimited
+
+	c.ThrottleUploadBPS = s.size("THROTTLE_UPLOAD_BPS", 0)
+	c.ThrottleDownloadBPS = s.size("THROTTLE_DOWNLOAD_BPS", 0)
+	cidrs, err := parseThrottleCIDRs(s.str("THROTTLE_CIDRS", ""))
+	s.check("THROTTLE_CIDRS", err)
+	c.ThrottleCIDRs = cidrs
+
+	c.IdleTimeout = s.duration("IDLE_TIMEOUT", 0)                // 0 = off
+	c.MaxSessionDuration = s.duration("MAX_SESSION_DURATION", 0) // 0 = unlimited
+	c.KeepaliveInterval = s.duration("KEEPALIVE_INTERVAL", 30*time.Second)
+	c.KeepaliveMaxMisses = int(s.int64("KEEPALIVE_MAX_MISSES", 3))
+	if c.IdleTimeout < 0 || c.MaxSessionDuration < 0 || c.KeepaliveInterval < 0 || c.KeepaliveMaxMisses < 0 {
+		s.fail("IDLE_TIMEOUT, MAX_SESSION_DURATION, KEEPALIVE_INTERVAL, KEEPALIVE_MAX_MISSES", "must not be negative")
+	}
+
+	c.PasswordAuthEnabled = s.bool("PASSWORD_AUTH_ENABLED", false)
 
-func getenv(key, def string) string {
-	v := os.Getenv(key)
-	if v == "" {
-		return def
+	c.SCPEnabled = s.bool("SCP_ENABLED", false)
+	c.ExecCommands = s.list("EXEC_COMMANDS", "")
+	for _, name := range c.ExecCommands {
+		if !validExecCommand(name) {
+			s.check("EXEC_COMMANDS", fmt.Errorf("unknown command %q (supported: sha256sum, sha1sum, md5sum, ls, df)", name))
+		}
 	}
-	return v
-}
 
-func parseEnvInt64(key string, def int64) int64 {
-	v := os.Getenv(key)
-	if v == "" {
-		return def
+	c.Crypto = parseCryptoPolicy(s, s.bool("SSH_ALLOW_INSECURE_ALGORITHMS", false))
+
+	c.LockoutEnabled = s.bool("LOCKOUT_ENABLED", false)
+	c.LockoutMaxFailuresIP = int(s.int64("LOCKOUT_MAX_FAILURES_IP", 20))
+	c.LockoutMaxFailuresUser = int(s.int64("LOCKOUT_MAX_FAILURES_USER", 10))
+	c.LockoutMaxFailuresUserAny = int(s.int64("LOCKOUT_MAX_FAILURES_USER_ANY", 50))
+	c.LockoutWindow = s.duration("LOCKOUT_WINDOW", 15*time.Minute)
+	c.LockoutBanDuration = s.duration("LOCKOUT_BAN_DURATION", 15*time.Minute)
+	c.LockoutBackoffBase = s.duration("LOCKOUT_BACKOFF_BASE", 250*time.Millisecond)
+	c.LockoutBackoffMax = s.duration("LOCKOUT_BACKOFF_MAX", 5*time.Second)
+	c.LockoutSyncInterval = s.duration("LOCKOUT_SYNC_INTERVAL", 10*time.Second)
+	allow, err := parseCIDRList(s.str("LOCKOUT_ALLOW_CIDRS", ""))
+	s.check("LOCKOUT_ALLOW_CIDRS", err)
+	c.LockoutAllowCIDRs = allow
+	c.LockoutStore = s.str("LOCKOUT_STORE", "memory")
+	if c.LockoutStore != "memory" && c.LockoutStore != "vault" {
+		s.check("LOCKOUT_STORE", fmt.Errorf("must be memory or vault"))
 	}
-	n, err := strconv.ParseInt(v, 10, 64)
-	if err != nil {
-		return def
+	if c.LockoutWindow <= 0 || c.LockoutBanDuration <= 0 || c.LockoutSyncInterval <= 0 {
+		s.fail("LOCKOUT_WINDOW, LOCKOUT_BAN_DURATION, LOCKOUT_SYNC_INTERVAL", "must be positive")
 	}
-	return n
-}
 
-func parseEnvBool(key string, def bool) bool {
-	v := os.Getenv(key)
-	if v == "" {
-		return def
+	c.ActivityStore = s.str("ACTIVITY_STORE", "vault")
+	switch c.ActivityStore {
+	case "vault", "memory", "off":
+	default:
+		s.check("ACTIVITY_STORE", fmt.Errorf("must be vault, memory or off"))
 	}
-	b, err := strconv.ParseBool(v)
-	if err != nil {
-		return def
+	c.InactivityDays = s.int64("USER_INACTIVITY_DAYS", 0)
+	if c.InactivityDays < 0 {
+		s.fail("USER_INACTIVITY_DAYS", "must be >= 0")
 	}
-	return b
-}
 
-func parseEnvDuration(key string, def time.Duration) time.Duration {
-	v := os.Getenv(key)
-	if v == "" {
-		return def
+	c.ProxyProtocolEnabled = s.bool("PROXY_PROTOCOL_ENABLED", false)
+	trusted, err := parseCIDRList(s.str("PROXY_PROTOCOL_TRUSTED_CIDRS", ""))
+	s.check("PROXY_PROTOCOL_TRUSTED_CIDRS", err)
+	c.ProxyProtocolTrustedCIDRs = trusted
+	c.ProxyProtocolTimeout = s.duration("PROXY_PROTOCOL_TIMEOUT", 5*time.Second)
+	if c.ProxyProtocolEnabled && len(trusted) == 0 {
+		s.fail("PROXY_PROTOCOL_TRUSTED_CIDRS", "required when PROXY_PROTOCOL_ENABLED=true")
 	}
-	d, err := time.ParseDuration(v)
-	if err != nil {
-		return def
+
+	if c.VaultAddr == "" {
+		s.fail("VAULT_ADDR", "required")
+	}
+	if c.VaultToken == "" {
+		s.fail("VAULT_TOKEN", "required (dev only; use K8s auth in prod)")
+	}
+	return c, s.err()
+}
+
+// siblingPrefix replaces the last segment of a Vault prefix:
+// ("kv/sftp/users", "holds") -> "kv/sftp/holds".
+func siblingPrefix(prefix, name string) string {
+	p := strings.Trim(prefix, "/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i+1] + name
 	}
-	return d
+	return p + "/" + name
 }
 
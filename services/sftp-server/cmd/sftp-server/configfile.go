@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration sources.
+//
+// Every setting is named by its environment variable. A config file (YAML or
+// TOML, chosen by extension; -config or CONFIG_FILE) may set the same
+// settings; nested keys are joined with "_" and upper-cased, so
+//
+//	vault:
+//	  addr: http://vault:8200      ->  VAULT_ADDR
+//	lockout:
+//	  max_failures_ip: 20          ->  LOCKOUT_MAX_FAILURES_IP
+//	host_key_paths: [a, b]         ->  HOST_KEY_PATHS=a,b
+//
+// A non-empty environment variable overrides the file. Values are parsed
+// strictly: every malformed value and every unknown file key is reported,
+// together with where it came from.
+
+// settingValue is a file value and the key it was written as.
+type settingValue struct {
+	val string
+	key string
+}
+
+type settings struct {
+	path string // config file, "" if none
+	file map[string]settingValue
+	used map[string]bool
+	errs []string
+}
+
+// loadSettings reads the config file at path (if any).
+func loadSettings(path string) (*settings, error) {
+	s := &settings{path: path, file: map[string]settingValue{}, used: map[string]bool{}}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		_, err = toml.Decode(string(b), &raw)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := s.flatten(nil, raw); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *settings) flatten(prefix []string, m map[string]any) error {
+	for k, v := range m {
+		keyPath := append(append([]string{}, prefix...), k)
+		if sub, ok := v.(map[string]any); ok {
+			if err := s.flatten(keyPath, sub); err != nil {
+				return err
+			}
+			continue
+		}
+		written := strings.Join(keyPath, ".")
+		val, err := settingString(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", written, err)
+		}
+		name := strings.ToUpper(strings.ReplaceAll(strings.Join(keyPath, "_"), "-", "_"))
+		if prev, ok := s.file[name]; ok {
+			return fmt.Errorf("%s and %s both set %s", prev.key, written, name)
+		}
+		s.file[name] = settingValue{val: val, key: written}
+	}
+	return nil
+}
+
+// settingString renders a scalar or a list of scalars as the env var form.
+func settingString(v any) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case bool, int, int64, uint64:
+		return fmt.Sprint(x), nil
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			return strconv.FormatInt(int64(x), 10), nil
+		}
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	case time.Time:
+		return x.Format(time.RFC3339), nil
+	case []any:
+		parts := make([]string, 0, len(x))
+		for _, item := range x {
+			if _, ok := item.([]any); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			if _, ok := item.(map[string]any); ok {
+				return "", fmt.Errorf("lists of tables are not supported")
+			}
+			p, err := settingString(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, p)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// lookup returns the raw value of key and a description of its source.
+func (s *settings) lookup(key string) (val, source string, ok bool) {
+	s.used[key] = true
+	if v := os.Getenv(key); v != "" {
+		return v, "env " + key, true
+	}
+	if fv, found := s.file[key]; found && fv.val != "" {
+		return fv.val, fmt.Sprintf("%s in %s", fv.key, s.path), true
+	}
+	return "", "", false
+}
+
+func (s *settings) fail(source, format string, args ...any) {
+	s.errs = append(s.errs, source+": "+fmt.Sprintf(format, args...))
+}
+
+// check records err against key, if any.
+func (s *settings) check(key string, err error) {
+	if err == nil {
+		return
+	}
+	_, source, ok := s.lookup(key)
+	if !ok {
+		source = key
+	}
+	s.fail(source, "%v", err)
+}
+
+func (s *settings) str(key, def string) string {
+	if v, _, ok := s.lookup(key); ok {
+		return strings.TrimSpace(v)
+	}
+	return def
+}
+
+func (s *settings) int64(key string, def int64) int64 {
+	v, source, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		s.fail(source, "%q is not a whole number", v)
+		return def
+	}
+	return n
+}
+
+func (s *settings) bool(key string, def bool) bool {
+	v, source, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		s.fail(source, "%q is not true or false", v)
+		return def
+	}
+	return b
+}
+
+func (s *settings) duration(key string, def time.Duration) time.Duration {
+	v, source, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		s.fail(source, "%q is not a duration (e.g. 30s, 15m, 1h30m)", v)
+		return def
+	}
+	return d
+}
+
+// size parses a byte count: a plain number or one with a unit, decimal
+// (KB, MB, GB, TB) or binary (KiB, MiB, GiB, TiB). Negative sizes are
+// refused.
+func (s *settings) size(key string, def int64) int64 {
+	v, source, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		s.fail(source, "%q is not a size (bytes, or with a unit like 500MB or 10GiB)", v)
+		return def
+	}
+	return n
+}
+
+var sizeRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kmgtKMGT]?)(i?)[bB]?$`)
+
+func parseSize(v string) (int64, error) {
+	m := sizeRe.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	base := 1000.0
+	if m[3] == "i" {
+		base = 1024
+	}
+	exp := strings.Index("kmgt", strings.ToLower(m[2])) + 1
+	if m[2] == "" {
+		exp = 0
+	}
+	f *= math.Pow(base, float64(exp))
+	if f > math.MaxInt64 {
+		return 0, fmt.Errorf("size %q too large", v)
+	}
+	return int64(f), nil
+}
+
+// list splits a comma-separated setting.
+func (s *settings) list(key, def string) []string {
+	return splitList(s.str(key, def))
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// err reports every problem found, including file keys nothing read.
+func (s *settings) err() error {
+	var unknown []string
+	for name, fv := range s.file {
+		if !s.used[name] {
+			unknown = append(unknown, fmt.Sprintf("%s in %s: unknown setting (%s)", fv.key, s.path, name))
+		}
+	}
+	sort.Strings(unknown)
+	all := append(append([]string{}, s.errs...), unknown...)
+	switch len(all) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(all[0])
+	}
+	return fmt.Errorf("%d problems:\n  %s", len(all), strings.Join(all, "\n  "))
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH crypto policy and host keys.
+//
+// SSH_CIPHERS, SSH_MACS, SSH_KEX, SSH_HOSTKEY_ALGORITHMS and
+// SSH_PUBKEY_ALGORITHMS are comma-separated algorithm lists in preference
+// order; empty means the x/crypto defaults. Names are checked against the
+// algorithms x/crypto implements, and ones it marks insecure (ssh-rsa with
+// SHA-1, CBC ciphers, diffie-hellman-group1, ...) are refused unless
+// SSH_ALLOW_INSECURE_ALGORITHMS=true. The effective policy is logged at
+// startup and the negotiated algorithms are recorded on session_start.
+//
+// HOST_KEY_PATHS lists the host private keys (ed25519, ECDSA or RSA of at
+// least 2048 bits; RSA signs with rsa-sha2-256/512 only by default). If
+// "<key>-cert.pub" exists next to a key it is served as well, as a host
+// certificate signed by the host CA. HOST_KEY_ANNOUNCE_PATHS are keys that
+// are not used for key exchange but are announced to clients.
+//
+// Host key rotation: after authentication all host keys (in use and
+// announce-only) are sent with hostkeys-00@openssh.com, and possession is
+// proven on hostkeys-prove-00@openssh.com. OpenSSH clients with
+// UpdateHostKeys learn a new key before it is used:
+//
+//  1. add the new key to HOST_KEY_ANNOUNCE_PATHS
+//  2. once clients have connected, swap it with the old key (only one key
+//     per type can be used for key exchange)
+//  3. remove the old key from HOST_KEY_ANNOUNCE_PATHS; clients drop it
+
+type cryptoPolicy struct {
+	Ciphers        []string
+	MACs           []string
+	KeyExchanges   []string
+	HostKeyAlgos   []string
+	PublicKeyAuths []string
+}
+
+const minRSABits = 2048
+
+// parseCryptoPolicy reads the SSH_* algorithm lists.
+func parseCryptoPolicy(s *settings, allowInsecure bool) cryptoPolicy {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	p := cryptoPolicy{
+		Ciphers:        parseAlgorithmList(s, "SSH_CIPHERS", supported.Ciphers, insecure.Ciphers, allowInsecure),
+		MACs:           parseAlgorithmList(s, "SSH_MACS", supported.MACs, insecure.MACs, allowInsecure),
+		KeyExchanges:   parseAlgorithmList(s, "SSH_KEX", supported.KeyExchanges, insecure.KeyExchanges, allowInsecure),
+		HostKeyAlgos:   parseAlgorithmList(s, "SSH_HOSTKEY_ALGORITHMS", supported.HostKeys, insecure.HostKeys, allowInsecure),
+		PublicKeyAuths: parseAlgorithmList(s, "SSH_PUBKEY_ALGORITHMS", supported.PublicKeyAuths, insecure.PublicKeyAuths, allowInsecure),
+	}
+	if len(p.HostKeyAlgos) == 0 {
+		p.HostKeyAlgos = supported.HostKeys
+	}
+	return p
+}
+
+func parseAlgorithmList(s *settings, key string, supported, insecure []string, allowInsecure bool) []string {
+	var out []string
+	for _, a := range s.list(key, "") {
+		switch {
+		case slices.Contains(supported, a):
+		case slices.Contains(insecure, a):
+			if !allowInsecure {
+				s.check(key, fmt.Errorf("%q is insecure (set SSH_ALLOW_INSECURE_ALGORITHMS=true to allow it)", a))
+				continue
+			}
+		default:
+			s.check(key, fmt.Errorf("unsupported algorithm %q", a))
+			continue
+		}
+		if !slices.Contains(out, a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// apply sets the policy on sshCfg. Host key algorithms are applied per key
+// by loadHostKeys.
+func (p cryptoPolicy) apply(sshCfg *ssh.ServerConfig) {
+	sshCfg.Ciphers = p.Ciphers
+	sshCfg.MACs = p.MACs
+	sshCfg.KeyExchanges = p.KeyExchanges
+	sshCfg.PublicKeyAuthAlgorithms = p.PublicKeyAuths
+}
+
+// logPolicy prints the effective algorithms, filling in x/crypto defaults.
+func (p cryptoPolicy) logPolicy(keys *hostKeySet) {
+	or := func(v []string, def []string) string {
+		if len(v) == 0 {
+			return strings.Join(def, ",") + " (default)"
+		}
+		return strings.Join(v, ",")
+	}
+	// Mirror x/crypto's defaults by instantiating them on a throwaway config.
+	var d ssh.Config
+	d.SetDefaults()
+	log.Printf("ssh crypto policy: ciphers=%s", or(p.Ciphers, d.Ciphers))
+	log.Printf("ssh crypto policy: macs=%s", or(p.MACs, d.MACs))
+	log.Printf("ssh crypto policy: kex=%s", or(p.KeyExchanges, d.KeyExchanges))
+	log.Printf("ssh crypto policy: pubkey=%s", or(p.PublicKeyAuths, ssh.SupportedAlgorithms().PublicKeyAuths))
+	for _, s := range keys.active {
+		log.Printf("ssh host key: %s %s algorithms=%s", s.PublicKey().Type(), ssh.FingerprintSHA256(s.PublicKey()), strings.Join(s.Algorithms(), ","))
+	}
+	for _, s := range keys.announceOnly {
+		log.Printf("ssh host key (announce only): %s %s", s.PublicKey().Type(), ssh.FingerprintSHA256(s.PublicKey()))
+	}
+}
+
+// hostKeySet holds the loaded host keys.
+type hostKeySet struct {
+	active       []ssh.MultiAlgorithmSigner // used for key exchange, certificates included
+	announceOnly []ssh.MultiAlgorithmSigner
+	plain        []ssh.MultiAlgorithmSigner // every non-certificate key, for hostkeys-00
+}
+
+// loadHostKeys reads paths (and their certificates) and announce, limiting
+// each key's signature algorithms to algos.
+func loadHostKeys(paths, announce []string, algos []string) (*hostKeySet, error) {
+	hk := &hostKeySet{}
+	seen := map[string]bool{}
+	load := func(path string) (ssh.Signer, ssh.MultiAlgorithmSigner, error) {
+		s, err := readHostKey(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("host key %q: %w", path, err)
+		}
+		blob := string(s.PublicKey().Marshal())
+		if seen[blob] {
+			return nil, nil, fmt.Errorf("host key %q: listed twice", path)
+		}
+		seen[blob] = true
+		ms, err := restrictSigner(s, algos, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("host key %q: %w", path, err)
+		}
+		hk.plain = append(hk.plain, ms)
+		return s, ms, nil
+	}
+
+	types := map[string]string{}
+	for _, path := range paths {
+		s, ms, err := load(path)
+		if err != nil {
+			return nil, err
+		}
+		// ssh.ServerConfig keeps one key per type.
+		t := ms.PublicKey().Type()
+		if other, ok := types[t]; ok {
+			return nil, fmt.Errorf("host keys %q and %q are both %s; use HOST_KEY_ANNOUNCE_PATHS for the new key", other, path, t)
+		}
+		types[t] = path
+		hk.active = append(hk.active, ms)
+
+		cert, err := readHostCert(path + "-cert.pub")
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil {
+			continue
+		}
+		cs, err := ssh.NewCertSigner(cert, s)
+		if err != nil {
+			return nil, fmt.Errorf("host certificate %q: %w", path+"-cert.pub", err)
+		}
+		mcs, err := restrictSigner(cs, algos, true)
+		if err != nil {
+			return nil, fmt.Errorf("host certificate %q: %w", path+"-cert.pub", err)
+		}
+		hk.active = append(hk.active, mcs)
+	}
+	for _, path := range announce {
+		_, ms, err := load(path)
+		if err != nil {
+			return nil, err
+		}
+		hk.announceOnly = append(hk.announceOnly, ms)
+	}
+	if len(hk.active) == 0 {
+		return nil, fmt.Errorf("no host keys configured")
+	}
+	return hk, nil
+}
+
+// restrictSigner limits s to the signature algorithms in algos. Certificate
+// algorithm names map to the signature algorithm they wrap.
+func restrictSigner(s ssh.Signer, algos []string, cert bool) (ssh.MultiAlgorithmSigner, error) {
+	as, ok := s.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("key type %s cannot be used", s.PublicKey().Type())
+	}
+	keyType := s.PublicKey().Type()
+	if cert {
+		keyType = s.PublicKey().(*ssh.Certificate).Key.Type()
+	}
+	switch keyType {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+	case ssh.KeyAlgoRSA:
+		pub := s.PublicKey()
+		if c, ok := pub.(*ssh.Certificate); ok {
+			pub = c.Key
+		}
+		if ck, ok := pub.(ssh.CryptoPublicKey); ok {
+			if k, ok := ck.CryptoPublicKey().(*rsa.PublicKey); ok && k.N.BitLen() < minRSABits {
+				return nil, fmt.Errorf("RSA key has %d bits, need at least %d", k.N.BitLen(), minRSABits)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported host key type %s", keyType)
+	}
+
+	var allowed []string
+	for _, a := range algos {
+		isCert := strings.HasSuffix(a, "-cert-v01@openssh.com")
+		if isCert != cert {
+			continue
+		}
+		a = strings.TrimSuffix(a, "-cert-v01@openssh.com")
+		if a == ssh.KeyAlgoRSASHA256 || a == ssh.KeyAlgoRSASHA512 || a == ssh.KeyAlgoRSA {
+			if keyType == ssh.KeyAlgoRSA {
+				allowed = append(allowed, a)
+			}
+		} else if a == keyType {
+			allowed = append(allowed, a)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no algorithm in SSH_HOSTKEY_ALGORITHMS for %s", s.PublicKey().Type())
+	}
+	return ssh.NewSignerWithAlgorithms(as, allowed)
+}
+
+func readHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// readHostCert returns the host certificate at path, or nil if there is none.
+func readHostCert(path string) (*ssh.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("host certificate %q: %w", path, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("host certificate %q: %w", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("host certificate %q: not a host certificate", path)
+	}
+	return cert, nil
+}
+
+// addTo registers the key exchange keys with sshCfg.
+func (hk *hostKeySet) addTo(sshCfg *ssh.ServerConfig) {
+	for _, s := range hk.active {
+		sshCfg.AddHostKey(s)
+	}
+}
+
+// announce sends hostkeys-00@openssh.com with every plain host key.
+func (hk *hostKeySet) announce(conn ssh.Conn) {
+	var payload []byte
+	for _, s := range hk.plain {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{s.PublicKey().Marshal()})...)
+	}
+	_, _, _ = conn.SendRequest("hostkeys-00@openssh.com", false, payload)
+}
+
+// prove answers hostkeys-prove-00@openssh.com: for every requested key, a
+// signature over the request name, session ID and key blob.
+func (hk *hostKeySet) prove(conn ssh.Conn, payload []byte) ([]byte, error) {
+	negotiated := ""
+	if ac, ok := conn.(ssh.AlgorithmsConnMetadata); ok {
+		negotiated = ac.Algorithms().HostKey
+	}
+
+	var out []byte
+	for len(payload) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, err
+		}
+		payload = blob.Rest
+
+		var signer ssh.MultiAlgorithmSigner
+		for _, s := range hk.plain {
+			if bytes.Equal(s.PublicKey().Marshal(), blob.Key) {
+				signer = s
+				break
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("unknown host key requested")
+		}
+
+		data := ssh.Marshal(struct {
+			Name      string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", conn.SessionID(), blob.Key})
+
+		// RSA proofs use the negotiated rsa-sha2 variant, else SHA-512 like sshd.
+		algo := signer.Algorithms()[0]
+		if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			switch {
+			case slices.Contains(signer.Algorithms(), negotiated):
+				algo = negotiated
+			case slices.Contains(signer.Algorithms(), ssh.KeyAlgoRSASHA512):
+				algo = ssh.KeyAlgoRSASHA512
+			}
+		}
+		sig, err := signer.SignWithAlgorithm(rand.Reader, data, algo)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+	}
+	return out, nil
+}
+
+// serveGlobalRequests handles connection-level requests: host key proofs,
+// everything else is refused.
+func (hk *hostKeySet) serveGlobalRequests(conn ssh.Conn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "hostkeys-prove-00@openssh.com" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		resp, err := hk.prove(conn, req.Payload)
+		if req.WantReply {
+			_ = req.Reply(err == nil, resp)
+		}
+	}
+}
+
+// negotiatedAlgorithms describes conn's algorithms for session_start.
+func negotiatedAlgorithms(conn ssh.Conn) map[string]string {
+	ac, ok := conn.(ssh.AlgorithmsConnMetadata)
+	if !ok {
+		return nil
+	}
+	a := ac.Algorithms()
+	m := map[string]string{
+		"kex":     a.KeyExchange,
+		"hostKey": a.HostKey,
+		"cipher":  a.Read.Cipher,
+	}
+	if a.Read.MAC != "" { // empty for AEAD ciphers
+		m["mac"] = a.Read.MAC
+	}
+	return m
+}
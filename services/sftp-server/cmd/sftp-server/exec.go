@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// "exec" requests on the session channel.
+//
+// There is no shell: the command line is split into words (with '', ""
+// and \ quoting) and the first word must be scp (SCP_ENABLED, see scp.go)
+// or one of EXEC_COMMANDS. Every command is implemented here on top of the
+// session's jailedFS, so the jail, key permissions, quotas, WORM rules,
+// throttling and audit log apply exactly as they do for SFTP.
+//
+//	sha256sum, sha1sum, md5sum FILE...   "<hex>  FILE" per file
+//	ls [-l] [-a] [-1] [PATH...]          one name per line, -l for details
+//	df [-h] [PATH]                       quota (or filesystem) usage
+
+var execChecksums = map[string]func() hash.Hash{
+	"sha256sum": sha256.New,
+	"sha1sum":   sha1.New,
+	"md5sum":    md5.New,
+}
+
+// validExecCommand reports whether name can be listed in EXEC_COMMANDS.
+func validExecCommand(name string) bool {
+	_, ok := execChecksums[name]
+	return ok || name == "ls" || name == "df"
+}
+
+// execEnv is what a command runs with. Exit code 0 is success, 1 a failure
+// on some operand, 2 a usage error.
+type execEnv struct {
+	ctx    context.Context
+	fs     jailedFS
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (e execEnv) errorf(prog, format string, args ...any) {
+	fmt.Fprintf(e.stderr, "%s: %s\n", prog, fmt.Sprintf(format, args...))
+}
+
+// runExec runs argv and returns its exit status.
+func runExec(e execEnv, argv []string) int {
+	switch prog := argv[0]; {
+	case prog == "scp":
+		return runSCP(e, argv[1:])
+	case execChecksums[prog] != nil:
+		return execChecksum(e, prog, argv[1:])
+	case prog == "ls":
+		return execLs(e, argv[1:])
+	case prog == "df":
+		return execDf(e, argv[1:])
+	}
+	return 127
+}
+
+// acceptExec answers an "exec" request: it replies true and returns the
+// command's words if the command may run, otherwise replies false and
+// audits exec_rejected.
+func acceptExec(cfg config, user, remote string, req *ssh.Request) ([]string, bool) {
+	line := parseSubsystem(req.Payload) // same encoding: one SSH string
+	argv, err := splitCommand(line)
+	if err == nil && !execAllowed(cfg, argv) {
+		err = errors.New("command not allowed")
+	}
+	if err != nil {
+		_ = req.Reply(false, nil)
+		audit(user, remote, "exec_rejected", "", line, 0, err)
+		return nil, false
+	}
+	_ = req.Reply(true, nil)
+	return argv, true
+}
+
+// serveExec runs argv on ch and reports its exit status.
+func serveExec(ch ssh.Channel, fs jailedFS, argv []string) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	code := runExec(execEnv{ctx: ctx, fs: fs, stdin: ch, stdout: ch, stderr: ch.Stderr()}, argv)
+
+	_ = ch.CloseWrite()
+	sendExitStatus(ch, code)
+	var err error
+	if code != 0 {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	auditEv(auditEvent{
+		User:       fs.user,
+		Remote:     fs.remote,
+		Action:     "exec",
+		Target:     strings.Join(argv, " "),
+		DurationMs: time.Since(start).Milliseconds(),
+	}, err)
+}
+
+// execAllowed reports whether argv may run for cfg.
+func execAllowed(cfg config, argv []string) bool {
+	if len(argv) == 0 {
+		return false
+	}
+	if argv[0] == "scp" {
+		return cfg.SCPEnabled
+	}
+	for _, c := range cfg.ExecCommands {
+		if c == argv[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCommand splits a command line into words like a POSIX shell would,
+// without expansion. Unbalanced quotes are an error.
+func splitCommand(s string) ([]string, error) {
+	var (
+		words  []string
+		cur    strings.Builder
+		inWord bool
+		quote  rune
+	)
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		c := rs[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case quote == '"':
+			switch {
+			case c == '"':
+				quote = 0
+			case c == '\\' && i+1 < len(rs) && strings.ContainsRune(`"\$`+"`", rs[i+1]):
+				i++
+				cur.WriteRune(rs[i])
+			default:
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == '\\':
+			if i+1 < len(rs) {
+				i++
+				cur.WriteRune(rs[i])
+				inWord = true
+			}
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unbalanced quotes")
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+// sendExitStatus reports a command's exit status to the client.
+func sendExitStatus(ch ssh.Channel, code int) {
+	_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+}
+
+// stat returns the FileInfo for p through fs (audited as "stat").
+func (e execEnv) stat(p string) (os.FileInfo, error) {
+	l, err := e.fs.Filelist(sftp.NewRequest("Stat", p))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 1)
+	if n, err := l.ListAt(infos, 0); n != 1 {
+		if err == nil || err == io.EOF {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+// list returns the entries of directory p through fs (audited as "ls").
+func (e execEnv) list(p string) ([]os.FileInfo, error) {
+	l, err := e.fs.Filelist(sftp.NewRequest("List", p))
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := l.(io.Closer); ok {
+		defer c.Close()
+	}
+	var out []os.FileInfo
+	buf := make([]os.FileInfo, 128)
+	for {
+		n, err := l.ListAt(buf, int64(len(out)))
+		out = append(out, buf[:n]...)
+		if err == io.EOF || (err == nil && n == 0) {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+// open returns a reader for file p through fs (audited as "get_open").
+func (e execEnv) open(p string) (io.ReaderAt, error) {
+	req := sftp.NewRequest("Get", p).WithContext(e.ctx)
+	return e.fs.Fileread(req)
+}
+
+func closeReader(r io.ReaderAt) {
+	if c, ok := r.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// errText renders err like coreutils does for common cases.
+func errText(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "No such file or directory"
+	case errors.Is(err, os.ErrPermission), errors.Is(err, sftp.ErrSSHFxPermissionDenied):
+		return "Permission denied"
+	}
+	return err.Error()
+}
+
+func execChecksum(e execEnv, prog string, args []string) int {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		e.errorf(prog, "no file given (reading stdin is not supported)")
+		return 2
+	}
+	code := 0
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			e.errorf(prog, "unsupported option %s", a)
+			return 2
+		}
+		sum, err := e.checksum(a, execChecksums[prog]())
+		if err != nil {
+			e.errorf(prog, "%s: %s", a, errText(err))
+			code = 1
+			continue
+		}
+		fmt.Fprintf(e.stdout, "%s  %s\n", sum, a)
+	}
+	return code
+}
+
+func (e execEnv) checksum(p string, h hash.Hash) (string, error) {
+	info, err := e.stat(p)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errors.New("Is a directory")
+	}
+	r, err := e.open(p)
+	if err != nil {
+		return "", err
+	}
+	defer closeReader(r)
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, info.Size())); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func execLs(e execEnv, args []string) int {
+	var long, all bool
+	var paths []string
+	for i, a := range args {
+		if a == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			paths = append(paths, a)
+			continue
+		}
+		for _, f := range a[1:] {
+			switch f {
+			case 'l':
+				long = true
+			case 'a', 'A':
+				all = true
+			case '1':
+			default:
+				e.errorf("ls", "unsupported option -%c", f)
+				return 2
+			}
+		}
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	code := 0
+	print := func(info os.FileInfo, name string) {
+		if !long {
+			fmt.Fprintln(e.stdout, name)
+			return
+		}
+		// like coreutils: time of day within six months, else the year
+		layout := "Jan _2 15:04"
+		if mt := info.ModTime(); time.Since(mt) > 182*24*time.Hour || mt.After(time.Now()) {
+			layout = "Jan _2  2006"
+		}
+		fmt.Fprintf(e.stdout, "%s 1 %s %s %12d %s %s\n", info.Mode().String(), e.fs.user, e.fs.user,
+			info.Size(), info.ModTime().Format(layout), name)
+	}
+	for i, p := range paths {
+		info, err := e.stat(p)
+		if err != nil {
+			e.errorf("ls", "cannot access '%s': %s", p, errText(err))
+			code = 1
+			continue
+		}
+		if !info.IsDir() {
+			print(info, p)
+			continue
+		}
+		entries, err := e.list(p)
+		if err != nil {
+			e.errorf("ls", "cannot open directory '%s': %s", p, errText(err))
+			code = 1
+			continue
+		}
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(e.stdout)
+			}
+			fmt.Fprintf(e.stdout, "%s:\n", p)
+		}
+		for _, info := range entries {
+			if !all && strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			print(info, info.Name())
+		}
+	}
+	return code
+}
+
+func execDf(e execEnv, args []string) int {
+	human := false
+	p := "/"
+	for _, a := range args {
+		switch {
+		case a == "-h":
+			human = true
+		case a == "-k" || a == "-P":
+		case strings.HasPrefix(a, "-"):
+			e.errorf("df", "unsupported option %s", a)
+			return 2
+		default:
+			p = a
+		}
+	}
+	st, err := e.fs.StatVFS(sftp.NewRequest("StatVFS", p))
+	if err != nil {
+		e.errorf("df", "%s: %s", p, errText(err))
+		return 1
+	}
+	total := int64(st.Blocks * st.Frsize)
+	avail := int64(st.Bavail * st.Frsize)
+	used := total - int64(st.Bfree*st.Frsize)
+	pct := 0
+	if used+avail > 0 {
+		pct = int((used*100 + used + avail - 1) / (used + avail))
+	}
+	size := func(n int64) string {
+		if human {
+			return humanSize(n)
+		}
+		return fmt.Sprint((n + 1023) / 1024)
+	}
+	header := "1K-blocks"
+	if human {
+		header = "Size"
+	}
+	fmt.Fprintf(e.stdout, "%-10s %10s %10s %10s %4s %s\n", "Filesystem", header, "Used", "Available", "Use%", "Mounted on")
+	fmt.Fprintf(e.stdout, "%-10s %10s %10s %10s %3d%% %s\n", "sftp", size(total), size(used), size(avail), pct, path.Clean("/"+p))
+	return 0
+}
+
+// humanSize formats n like df -h (powers of 1024, one decimal below 10).
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprint(n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if f < 10 {
+		return fmt.Sprintf("%.1f%c", f, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", f, units[i])
+}
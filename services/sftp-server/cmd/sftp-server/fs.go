@@ -6,8 +6,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
+	"golang.org/x/time/rate"
 )
 
 // jailedFS implements pkg/sftp interfaces (note the lowercase method names in your version).
@@ -18,6 +21,68 @@ type jailedFS struct {
 	remote     string
 	quotaBytes int64
 	quotaFiles int64
+	worm       wormPolicy
+	sums       checksumPolicy
+	list       listPolicy
+
+	// Operations the authenticating key allows (permissions= option), and
+	// those the user (or its groups) allows.
+	perms     keyPerms
+	userPerms keyPerms
+
+	// Shared folders mounted at the top of the root (see groups.go).
+	shares []sharedMount
+
+	// Bandwidth buckets that apply to this session (see throttle.go).
+	upLimits      []*rate.Limiter
+	downLimits    []*rate.Limiter
+	releaseLimits func()
+
+	// writers holds this session's in-flight uploads (for copy-data).
+	writers *openWriters
+}
+
+// permit refuses op if the session's key or user does not allow it, or
+// if it would change a read-only shared folder or a mount point.
+func (fs jailedFS) permit(op, action, rel string) error {
+	if !fs.perms.allows(op) {
+		err := fmt.Errorf("%w: key does not permit %s", sftp.ErrSSHFxPermissionDenied, op)
+		audit(fs.user, fs.remote, action+"_denied_key", rel, "", 0, err)
+		return err
+	}
+	if !fs.userPerms.allows(op) {
+		err := fmt.Errorf("%w: user does not permit %s", sftp.ErrSSHFxPermissionDenied, op)
+		audit(fs.user, fs.remote, action+"_denied_user", rel, "", 0, err)
+		return err
+	}
+	if op == PermRead || op == PermList {
+		return nil
+	}
+	return fs.writable(action, rel)
+}
+
+// writable refuses changes in read-only shared folders and to the mount
+// points themselves.
+func (fs jailedFS) writable(action, rel string) error {
+	m, sub := mountFor(fs.shares, filepath.FromSlash(strings.TrimPrefix(rel, "/")))
+	if m == nil || (!m.readOnly && sub != ".") {
+		return nil
+	}
+	err := fmt.Errorf("%w: shared folder %s is read-only", sftp.ErrSSHFxPermissionDenied, m.name)
+	if !m.readOnly {
+		err = fmt.Errorf("%w: %s is a shared folder", sftp.ErrSSHFxPermissionDenied, m.name)
+	}
+	audit(fs.user, fs.remote, action+"_denied_shared", rel, "", 0, err)
+	return err
+}
+
+// quotaFor returns the directory whose usage a change at rel counts
+// against, with its limits: a shared folder's own, or the user's root.
+func (fs jailedFS) quotaFor(rel string) (string, int64, int64) {
+	if m, _ := mountFor(fs.shares, filepath.FromSlash(strings.TrimPrefix(rel, "/"))); m != nil {
+		return m.dir, m.quotaBytes, m.quotaFiles
+	}
+	return fs.root, fs.quotaBytes, fs.quotaFiles
 }
 
 func (fs jailedFS) clean(p string) (string, string, error) {
@@ -34,6 +99,15 @@ func (fs jailedFS) clean(p string) (string, string, error) {
 		return "", "", fmt.Errorf("invalid path")
 	}
 
+	// Paths in a shared folder resolve to (and stay in) its directory.
+	if m, sub := mountFor(fs.shares, clean); m != nil {
+		abs := filepath.Join(m.dir, sub)
+		if abs != m.dir && !strings.HasPrefix(abs, m.dir+string(os.PathSeparator)) {
+			return "", "", fmt.Errorf("path escapes root")
+		}
+		return abs, "/" + filepath.ToSlash(clean), nil
+	}
+
 	abs := filepath.Join(fs.root, clean)
 
 	rootAbs, err := filepath.Abs(fs.root)
@@ -65,9 +139,16 @@ func (fs jailedFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := fs.permit(PermRead, "get", rel); err != nil {
+		return nil, err
+	}
 	f, err := os.Open(abs)
 	audit(fs.user, fs.remote, "get_open", rel, "", 0, err)
-	return f, err
+	if err != nil {
+		return nil, err
+	}
+	recordDownload(fs.user)
+	return &throttledReaderAt{r: f, ctx: r.Context(), limiters: fs.downLimits, user: fs.user}, nil
 }
 
 // --- FileWriter interface ---
@@ -77,6 +158,15 @@ func (fs jailedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		audit(fs.user, fs.remote, "put_open", rel, "", 0, nil)
 		return nil, err
 	}
+	if err := fs.permit(PermWrite, "put", rel); err != nil {
+		return nil, err
+	}
+
+	// Committed WORM files cannot be overwritten
+	if err := fs.worm.check(abs, rel); err != nil {
+		audit(fs.user, fs.remote, "put_denied_immutable", rel, "", 0, err)
+		return nil, err
+	}
 
 	// Ensure parent exists
 	if err := os.MkdirAll(filepath.Dir(abs), 0o750); err != nil {
@@ -85,13 +175,14 @@ func (fs jailedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	}
 
 	// Check current usage for quota enforcement
-	u, err := dirUsage(fs.root)
+	usageDir, quotaBytes, quotaFiles := fs.quotaFor(rel)
+	u, err := dirUsage(usageDir)
 	if err != nil {
 		audit(fs.user, fs.remote, "quota_usage_failed", rel, "", 0, err)
 		return nil, err
 	}
 
-	if fs.quotaFiles > 0 && u.Files >= fs.quotaFiles {
+	if quotaFiles > 0 && u.Files >= quotaFiles {
 		err := fmt.Errorf("file quota exceeded")
 		audit(fs.user, fs.remote, "put_open", rel, "", 0, err)
 		return nil, err
@@ -111,7 +202,7 @@ func (fs jailedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 
 	audit(fs.user, fs.remote, "put_open", rel, "", 0, nil)
 
-	return &atomicQuotaWriterAt{
+	w := &atomicQuotaWriterAt{
 		user:	   fs.user,
 		remote:	   fs.remote,
 		rel:	   rel,
@@ -119,8 +210,56 @@ func (fs jailedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		finalPath: abs,
 		f:         f,
 		baseBytes: u.Bytes,
-		quota:     fs.quotaBytes,
-	}, nil
+		quota:     quotaBytes,
+		worm:      fs.worm,
+		sums:      fs.sums,
+		hasher:    fs.sums.newHasher(),
+		writers:   fs.writers,
+	}
+	fs.writers.add(abs, w)
+	return &throttledWriterAt{w: w, ctx: r.Context(), limiters: fs.upLimits, user: fs.user}, nil
+}
+
+// openWriters maps absolute paths to the session's open upload writers, so
+// server-side copy can write through the same quota-enforcing writer the
+// client's handle uses.
+type openWriters struct {
+	mu sync.Mutex
+	m  map[string]*atomicQuotaWriterAt
+}
+
+func newOpenWriters() *openWriters {
+	return &openWriters{m: map[string]*atomicQuotaWriterAt{}}
+}
+
+func (o *openWriters) add(abs string, w *atomicQuotaWriterAt) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	o.m[abs] = w
+	o.mu.Unlock()
+}
+
+func (o *openWriters) remove(abs string, w *atomicQuotaWriterAt) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	if o.m[abs] == w {
+		delete(o.m, abs)
+	}
+	o.mu.Unlock()
+}
+
+func (o *openWriters) get(abs string) (*atomicQuotaWriterAt, bool) {
+	if o == nil {
+		return nil, false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	w, ok := o.m[abs]
+	return w, ok
 }
 
 
@@ -132,10 +271,30 @@ func (fs jailedFS) Filecmd(r *sftp.Request) error {
 		return err
 	}
 
+	switch r.Method {
+	case "Remove", "Rmdir":
+		err = fs.permit(PermDelete, strings.ToLower(r.Method), rel)
+	case "Mkdir", "Setstat":
+		err = fs.permit(PermWrite, strings.ToLower(r.Method), rel)
+	case "Rename", "Link":
+		err = fs.permit(PermRename, strings.ToLower(r.Method), rel)
+	}
+	if err != nil {
+		return err
+	}
+
 	switch r.Method {
 	case "Remove":
+		if err = fs.worm.check(abs, rel); err != nil {
+			audit(fs.user, fs.remote, "rm_denied_immutable", rel, "", 0, err)
+			return err
+		}
 		err = os.Remove(abs)
 		audit(fs.user, fs.remote, "rm", rel, "", 0, err)
+		if err == nil {
+			fs.sums.remove(abs)
+			emitEvent(fileEvent{Event: "rm", User: fs.user, Remote: fs.remote, Path: rel}, abs, "")
+		}
 		return err
 
 	case "Mkdir":
@@ -149,13 +308,18 @@ func (fs jailedFS) Filecmd(r *sftp.Request) error {
 		return err
 
 	case "Rename":
-		tAbs, tRel, tErr := fs.clean(r.Target)
-		if tErr != nil {
-			audit(fs.user, fs.remote, "rename", rel, tRel, 0, tErr)
-			return tErr
+		return fs.rename(abs, rel, r.Target)
+
+	case "Link":
+		return fs.link(abs, rel, r.Target)
+
+	case "Setstat":
+		if err = fs.worm.check(abs, rel); err != nil {
+			audit(fs.user, fs.remote, "setstat_denied_immutable", rel, "", 0, err)
+			return err
 		}
-		err = os.Rename(abs, tAbs)
-		audit(fs.user, fs.remote, "rename", rel, tRel, 0, err)
+		err = setstat(abs, r)
+		audit(fs.user, fs.remote, "setstat", rel, "", 0, err)
 		return err
 
 	default:
@@ -165,6 +329,193 @@ func (fs jailedFS) Filecmd(r *sftp.Request) error {
 	}
 }
 
+// PosixRename implements posix-rename@openssh.com: an atomic rename that
+// replaces an existing target (as Rename always has here).
+func (fs jailedFS) PosixRename(r *sftp.Request) error {
+	abs, rel, err := fs.clean(r.Filepath)
+	if err != nil {
+		audit(fs.user, fs.remote, "rename", rel, "", 0, err)
+		return err
+	}
+	if err := fs.permit(PermRename, "rename", rel); err != nil {
+		return err
+	}
+	return fs.rename(abs, rel, r.Target)
+}
+
+func (fs jailedFS) rename(abs, rel, target string) error {
+	tAbs, tRel, err := fs.clean(target)
+	if err != nil {
+		audit(fs.user, fs.remote, "rename", rel, tRel, 0, err)
+		return err
+	}
+	if err := fs.writable("rename", tRel); err != nil {
+		return err
+	}
+	if err = fs.worm.checkTree(abs, rel); err == nil {
+		err = fs.worm.check(tAbs, tRel)
+	}
+	if err != nil {
+		audit(fs.user, fs.remote, "rename_denied_immutable", rel, tRel, 0, err)
+		return err
+	}
+	// Moving into or out of a shared folder moves the usage to another quota.
+	srcDir, _, _ := fs.quotaFor(rel)
+	if tDir, _, _ := fs.quotaFor(tRel); tDir != srcDir {
+		moved, err := dirUsage(abs)
+		if err == nil {
+			err = fs.chargeQuota(tRel, moved)
+		}
+		if err != nil {
+			audit(fs.user, fs.remote, "rename", rel, tRel, 0, err)
+			return err
+		}
+	}
+	err = os.Rename(abs, tAbs)
+	audit(fs.user, fs.remote, "rename", rel, tRel, 0, err)
+	if err == nil {
+		fs.sums.move(abs, tAbs)
+		emitEvent(fileEvent{Event: "rename", User: fs.user, Remote: fs.remote, Path: rel, Target: tRel}, abs, tAbs)
+	}
+	return err
+}
+
+// chargeQuota refuses adding add at rel if that would exceed the quota it
+// counts against (see quotaFor).
+func (fs jailedFS) chargeQuota(rel string, add usage) error {
+	dir, quotaBytes, quotaFiles := fs.quotaFor(rel)
+	if quotaBytes <= 0 && quotaFiles <= 0 {
+		return nil
+	}
+	u, err := dirUsage(dir)
+	if err != nil {
+		audit(fs.user, fs.remote, "quota_usage_failed", rel, "", 0, err)
+		return err
+	}
+	if quotaFiles > 0 && u.Files+add.Files > quotaFiles {
+		IncQuotaExceeded(fs.user, "files")
+		return fmt.Errorf("file quota exceeded")
+	}
+	if quotaBytes > 0 && u.Bytes+add.Bytes > quotaBytes {
+		IncQuotaExceeded(fs.user, "bytes")
+		return fmt.Errorf("quota exceeded")
+	}
+	return nil
+}
+
+// link implements hardlink@openssh.com. The new name is charged against the
+// quotas like a copy, since dirUsage counts every name.
+func (fs jailedFS) link(abs, rel, target string) error {
+	tAbs, tRel, err := fs.clean(target)
+	if err != nil {
+		audit(fs.user, fs.remote, "link", rel, tRel, 0, err)
+		return err
+	}
+	// A second name for a file in a read-only shared folder would let
+	// Setstat change its mode and times there.
+	if err := fs.writable("link", rel); err != nil {
+		return err
+	}
+	if err := fs.writable("link", tRel); err != nil {
+		return err
+	}
+	// A second name for a WORM file would let Setstat move its mtime.
+	if err := fs.worm.check(abs, rel); err != nil {
+		audit(fs.user, fs.remote, "link_denied_immutable", rel, tRel, 0, err)
+		return err
+	}
+	info, err := os.Stat(abs)
+	if err == nil && info.IsDir() {
+		err = fmt.Errorf("cannot link a directory")
+	}
+	if err != nil {
+		audit(fs.user, fs.remote, "link", rel, tRel, 0, err)
+		return err
+	}
+
+	if err := fs.chargeQuota(tRel, usage{Bytes: info.Size(), Files: 1}); err != nil {
+		audit(fs.user, fs.remote, "link", rel, tRel, 0, err)
+		return err
+	}
+
+	err = os.Link(abs, tAbs)
+	audit(fs.user, fs.remote, "link", rel, tRel, info.Size(), err)
+	return err
+}
+
+// StatVFS implements statvfs@openssh.com. With quotas set it reports the
+// user's quota (or, in a shared folder, the folder's) as the filesystem
+// size, so `df` shows what is left; dimensions without a quota fall back to
+// the host filesystem.
+func (fs jailedFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	_, rel, err := fs.clean(r.Filepath)
+	if err != nil {
+		audit(fs.user, fs.remote, "statvfs", rel, "", 0, err)
+		return nil, err
+	}
+	if err := fs.permit(PermList, "statvfs", rel); err != nil {
+		return nil, err
+	}
+
+	st, err := hostStatVFS(fs.root)
+	if err != nil {
+		audit(fs.user, fs.remote, "statvfs", rel, "", 0, err)
+		return nil, err
+	}
+
+	usageDir, quotaBytes, quotaFiles := fs.quotaFor(rel)
+	if quotaBytes > 0 || quotaFiles > 0 {
+		u, err := dirUsage(usageDir)
+		if err != nil {
+			audit(fs.user, fs.remote, "statvfs", rel, "", 0, err)
+			return nil, err
+		}
+		if quotaBytes > 0 {
+			const bs = 4096
+			free := quotaBytes - u.Bytes
+			if free < 0 {
+				free = 0
+			}
+			st.Bsize, st.Frsize = bs, bs
+			st.Blocks = uint64((quotaBytes + bs - 1) / bs)
+			st.Bfree = uint64(free / bs)
+			st.Bavail = st.Bfree
+		}
+		if quotaFiles > 0 {
+			free := quotaFiles - u.Files
+			if free < 0 {
+				free = 0
+			}
+			st.Files = uint64(quotaFiles)
+			st.Ffree = uint64(free)
+			st.Favail = st.Ffree
+		}
+	}
+
+	audit(fs.user, fs.remote, "statvfs", rel, "", 0, nil)
+	return st, nil
+}
+
+// setstat applies the permission and time attributes of a Setstat request.
+// Ownership and size changes are ignored: uid/gid are meaningless inside the
+// jail and truncation would bypass quota accounting.
+func setstat(abs string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.Permissions {
+		if err := os.Chmod(abs, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(abs, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // --- FileLister interface ---
 func (fs jailedFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	abs, rel, err := fs.clean(r.Filepath)
@@ -172,24 +523,18 @@ func (fs jailedFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		audit(fs.user, fs.remote, "list_"+r.Method, rel, "", 0, err)
 		return nil, err
 	}
+	if err := fs.permit(PermList, strings.ToLower(r.Method), rel); err != nil {
+		return nil, err
+	}
 
 	switch r.Method {
 	case "List":
-		entries, err := os.ReadDir(abs)
+		l, err := newDirLister(abs, fs.list)
+		audit(fs.user, fs.remote, "ls", rel, "", 0, err)
 		if err != nil {
-			audit(fs.user, fs.remote, "ls", rel, "", 0, err)
 			return nil, err
 		}
-		infos := make([]os.FileInfo, 0, len(entries))
-		for _, e := range entries {
-			info, err := e.Info()
-			if err != nil {
-				continue
-			}
-			infos = append(infos, info)
-		}
-		audit(fs.user, fs.remote, "ls", rel, "", 0, nil)
-		return listerAtFromFileInfo(infos), nil
+		return l, nil
 
 	case "Stat":
 		info, err := os.Stat(abs)
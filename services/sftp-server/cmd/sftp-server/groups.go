@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Groups.
+//
+// A user record may name groups (kept by admin-api under
+// VAULT_GROUPS_PREFIX). When the user is loaded, every field the user
+// leaves unset (quotaBytes, quotaFiles, permissions, allowedCIDRs,
+// retentionDays) is taken from the first of its groups that sets it, and
+// the shared folders of all its groups are added. A group of another tenant,
+// or one that no longer exists, fails the load rather than silently
+// dropping its restrictions.
+//
+// A shared folder appears as a top-level directory of each member's root.
+// Its files live under DATA_ROOT/.shared/global/<path> for groups without a
+// tenant and DATA_ROOT/.shared/tenants/<tenant>/<path> otherwise, so a
+// tenant's groups can only share among that tenant. Files in a shared folder
+// count against the folder's own quota (quotaBytes, quotaFiles), not the
+// members'.
+
+// sharedFolder is a folder a group shares with its members.
+type sharedFolder struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	ReadOnly   bool   `json:"readOnly"`
+	QuotaBytes int64  `json:"quotaBytes"`
+	QuotaFiles int64  `json:"quotaFiles"`
+	tenant     string // of the group that shares it
+}
+
+// groupRecord is the part of a group sftp-server applies.
+type groupRecord struct {
+	Name          string
+	Tenant        string
+	QuotaBytes    int64
+	QuotaFiles    int64
+	Permissions   string
+	AllowedCIDRs  []string
+	SharedFolders []sharedFolder
+	RetentionDays int64
+}
+
+func loadGroupFromVault(ctx context.Context, vc *vault.Client, groupsPrefix, name string) (groupRecord, error) {
+	sec, err := vc.Logical().ReadWithContext(ctx, kvV2DataPath(groupsPrefix, name))
+	if err != nil {
+		return groupRecord{}, err
+	}
+	if sec == nil || sec.Data == nil {
+		return groupRecord{}, fmt.Errorf("group %s not found", name)
+	}
+	m, ok := sec.Data["data"].(map[string]interface{})
+	if !ok {
+		return groupRecord{}, fmt.Errorf("group %s not found", name)
+	}
+	g, err := parseGroupRecord(m)
+	if err != nil {
+		return g, fmt.Errorf("group %s: %w", name, err)
+	}
+	g.Name = name
+	return g, nil
+}
+
+func parseGroupRecord(m map[string]interface{}) (groupRecord, error) {
+	var g groupRecord
+	var err error
+	if g.Tenant, err = asString(m["tenant"]); err != nil {
+		return g, fmt.Errorf("invalid tenant: %w", err)
+	}
+	if g.QuotaBytes, err = asInt64(m["quotaBytes"]); err != nil {
+		return g, fmt.Errorf("invalid quotaBytes: %w", err)
+	}
+	if g.QuotaFiles, err = asInt64(m["quotaFiles"]); err != nil {
+		return g, fmt.Errorf("invalid quotaFiles: %w", err)
+	}
+	if g.Permissions, err = asString(m["permissions"]); err != nil {
+		return g, fmt.Errorf("invalid permissions: %w", err)
+	}
+	if g.AllowedCIDRs, err = asStringSlice(m["allowedCIDRs"]); err != nil {
+		return g, fmt.Errorf("invalid allowedCIDRs: %w", err)
+	}
+	if g.RetentionDays, err = asInt64(m["retentionDays"]); err != nil || g.RetentionDays < 0 {
+		return g, fmt.Errorf("invalid retentionDays")
+	}
+
+	folders, _ := m["sharedFolders"].([]interface{})
+	for _, raw := range folders {
+		fm, ok := raw.(map[string]interface{})
+		if !ok {
+			return g, fmt.Errorf("invalid sharedFolders")
+		}
+		var f sharedFolder
+		f.Name, _ = asString(fm["name"])
+		f.Path, _ = asString(fm["path"])
+		if f.ReadOnly, err = asBool(fm["readOnly"]); err != nil {
+			return g, fmt.Errorf("invalid sharedFolders: %w", err)
+		}
+		if f.QuotaBytes, err = asInt64(fm["quotaBytes"]); err != nil {
+			return g, fmt.Errorf("invalid sharedFolders: %w", err)
+		}
+		if f.QuotaFiles, err = asInt64(fm["quotaFiles"]); err != nil {
+			return g, fmt.Errorf("invalid sharedFolders: %w", err)
+		}
+		if !validShareName(f.Name) || !validSharePath(f.Path) {
+			return g, fmt.Errorf("invalid shared folder %q -> %q", f.Name, f.Path)
+		}
+		f.tenant = g.Tenant
+		g.SharedFolders = append(g.SharedFolders, f)
+	}
+	return g, nil
+}
+
+// validShareName accepts a single, visible path segment.
+func validShareName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// validSharePath accepts a relative path that stays where it is put.
+func validSharePath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, `\`) {
+		return false
+	}
+	c := path.Clean(p)
+	return c != "." && c != ".." && !strings.HasPrefix(c, "../")
+}
+
+// applyGroups loads ur's groups and resolves its effective settings.
+func applyGroups(ctx context.Context, vc *vault.Client, groupsPrefix string, ur *userRecord) error {
+	groups := make([]groupRecord, 0, len(ur.Groups))
+	for _, name := range ur.Groups {
+		g, err := loadGroupFromVault(ctx, vc, groupsPrefix, name)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, g)
+	}
+	return resolveGroups(ur, groups)
+}
+
+// resolveGroups fills ur's unset fields from groups (first wins) and
+// parses the resulting permissions and source networks.
+func resolveGroups(ur *userRecord, groups []groupRecord) error {
+	seen := map[string]bool{}
+	for _, g := range groups {
+		if g.Tenant != "" && g.Tenant != ur.Tenant {
+			return fmt.Errorf("group %s belongs to tenant %s", g.Name, g.Tenant)
+		}
+		if ur.QuotaBytes == 0 {
+			ur.QuotaBytes = g.QuotaBytes
+		}
+		if ur.QuotaFiles == 0 {
+			ur.QuotaFiles = g.QuotaFiles
+		}
+		if ur.Permissions == "" {
+			ur.Permissions = g.Permissions
+		}
+		if ur.RetentionDays == 0 {
+			ur.RetentionDays = g.RetentionDays
+		}
+		if len(ur.AllowedCIDRs) == 0 && len(g.AllowedCIDRs) > 0 {
+			nets, err := parseCIDRList(strings.Join(g.AllowedCIDRs, ","))
+			if err != nil {
+				return fmt.Errorf("group %s: invalid allowedCIDRs: %w", g.Name, err)
+			}
+			ur.AllowedCIDRs, ur.allowedNets = g.AllowedCIDRs, nets
+		}
+		for _, f := range g.SharedFolders {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				ur.SharedFolders = append(ur.SharedFolders, f)
+			}
+		}
+	}
+
+	ur.perms = nil
+	if ur.Permissions != "" {
+		p, err := parseKeyPermissions(ur.Permissions)
+		if err != nil {
+			return fmt.Errorf("invalid permissions: %w", err)
+		}
+		ur.perms = p
+	}
+	return nil
+}
+
+// sharedMount is a shared folder as mounted in a session.
+type sharedMount struct {
+	name       string
+	dir        string // absolute
+	readOnly   bool
+	quotaBytes int64
+	quotaFiles int64
+}
+
+// mountSharedFolders creates the folders of ur and their mount points in
+// root, returning the mounts. A folder whose name is taken by one of the
+// user's files is left out (and audited) rather than failing the session.
+func mountSharedFolders(dataRoot, root, user, remote string, ur userRecord) ([]sharedMount, error) {
+	mounts := make([]sharedMount, 0, len(ur.SharedFolders))
+	for _, f := range ur.SharedFolders {
+		base := joinClean(dataRoot, ".shared/global")
+		if f.tenant != "" {
+			base = joinClean(dataRoot, ".shared/tenants/"+f.tenant)
+		}
+		dir, err := filepath.Abs(filepath.Join(base, path.Clean(f.Path)))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+		// Visible in listings of the root; its contents are the folder's.
+		point := filepath.Join(root, f.Name)
+		if info, err := os.Lstat(point); err == nil && !info.IsDir() {
+			audit(user, remote, "shared_folder_conflict", "/"+f.Name, "", 0,
+				fmt.Errorf("shared folder %s not mounted: a file has its name", f.Name))
+			continue
+		}
+		if err := os.MkdirAll(point, 0o750); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, sharedMount{name: f.Name, dir: dir, readOnly: f.ReadOnly,
+			quotaBytes: f.QuotaBytes, quotaFiles: f.QuotaFiles})
+	}
+	return mounts, nil
+}
+
+// mountFor returns the mount the relative path clean (OS separators) is
+// in, and the path below it.
+func mountFor(mounts []sharedMount, clean string) (*sharedMount, string) {
+	first, rest, _ := strings.Cut(clean, string(os.PathSeparator))
+	for i := range mounts {
+		if mounts[i].name == first {
+			if rest == "" {
+				rest = "."
+			}
+			return &mounts[i], rest
+		}
+	}
+	return nil, clean
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Post-upload event hooks.
+//
+// File events (put_commit, rm, rename) are matched against the hooks from
+// HOOKS_CONFIG and, for every matching hook, written as one JSON file into a
+// durable on-disk queue (HOOKS_QUEUE_DIR). A background worker delivers them
+// and retries with exponential backoff, so events survive pod restarts.
+//
+// Queue layout:
+//
+//	pending/   waiting for (re)delivery
+//	inflight/  claimed by a worker (atomic rename, safe across replicas)
+//	dead/      gave up after maxAttempts
+//
+// Example HOOKS_CONFIG:
+//
+//	{"hooks": [
+//	  {"name": "etl", "type": "webhook", "url": "https://etl/hook",
+//	   "secretEnv": "HOOK_ETL_SECRET", "events": ["put_commit"],
+//	   "users": ["partner-*"], "paths": ["/inbox"]},
+//	  {"name": "scan", "type": "exec", "command": ["/hooks/scan.sh"],
+//	   "events": ["put_commit"]}
+//	]}
+
+const (
+	HookWebhook = "webhook"
+	HookExec    = "exec"
+)
+
+type hookConfig struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Events []string `json:"events"` // empty = all events
+	Users  []string `json:"users"`  // globs; empty = all users
+	Paths  []string `json:"paths"`  // globs or folder prefixes; empty = all paths
+
+	// webhook
+	URL       string `json:"url"`
+	Secret    string `json:"secret"`
+	SecretEnv string `json:"secretEnv"`
+
+	// exec
+	Command []string `json:"command"`
+
+	Timeout     string `json:"timeout"`     // default 10s
+	MaxAttempts int    `json:"maxAttempts"` // default 10
+
+	timeout time.Duration
+}
+
+type hooksFile struct {
+	Hooks []hookConfig `json:"hooks"`
+}
+
+// fileEvent is the payload sent to webhooks (and mirrored into exec env).
+type fileEvent struct {
+	ID     string `json:"id"`
+	Ts     string `json:"ts"`
+	Event  string `json:"event"`
+	User   string `json:"user"`
+	Remote string `json:"remote"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// queueEntry is one (event, hook) delivery as stored on disk.
+type queueEntry struct {
+	Hook        string    `json:"hook"`
+	Event       fileEvent `json:"event"`
+	File        string    `json:"file,omitempty"`       // absolute path, exec hooks only
+	TargetFile  string    `json:"targetFile,omitempty"` // absolute rename target, exec hooks only
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+func loadHooksConfig(p string) ([]hookConfig, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var hf hooksFile
+	if err := json.Unmarshal(b, &hf); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", p, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range hf.Hooks {
+		h := &hf.Hooks[i]
+		if h.Name == "" || strings.ContainsAny(h.Name, "/\\") {
+			return nil, fmt.Errorf("hook %d: invalid name %q", i, h.Name)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("hook %q: duplicate name", h.Name)
+		}
+		seen[h.Name] = true
+
+		switch h.Type {
+		case HookWebhook:
+			if h.URL == "" {
+				return nil, fmt.Errorf("hook %q: url required", h.Name)
+			}
+			if h.SecretEnv != "" {
+				h.Secret = os.Getenv(h.SecretEnv)
+			}
+		case HookExec:
+			if len(h.Command) == 0 {
+				return nil, fmt.Errorf("hook %q: command required", h.Name)
+			}
+		default:
+			return nil, fmt.Errorf("hook %q: unknown type %q", h.Name, h.Type)
+		}
+
+		h.timeout = 10 * time.Second
+		if h.Timeout != "" {
+			d, err := time.ParseDuration(h.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("hook %q: invalid timeout %q", h.Name, h.Timeout)
+			}
+			h.timeout = d
+		}
+		if h.MaxAttempts <= 0 {
+			h.MaxAttempts = 10
+		}
+	}
+	return hf.Hooks, nil
+}
+
+func (h hookConfig) matches(ev fileEvent) bool {
+	if len(h.Events) > 0 && !containsString(h.Events, ev.Event) {
+		return false
+	}
+	if len(h.Users) > 0 && !matchAny(h.Users, ev.User, false) {
+		return false
+	}
+	if len(h.Paths) > 0 && !matchAny(h.Paths, ev.Path, true) && (ev.Target == "" || !matchAny(h.Paths, ev.Target, true)) {
+		return false
+	}
+	return true
+}
+
+// matchAny matches s against globs; with folders set, patterns without glob
+// characters also match everything below them ("/inbox" covers "/inbox/a").
+func matchAny(patterns []string, s string, folders bool) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+		if folders && !strings.ContainsAny(p, "*?[") && pathCovers(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// --- dispatcher ---
+
+type eventDispatcher struct {
+	mu     sync.RWMutex // guards hooks and order (replaced on reload)
+	hooks  map[string]hookConfig
+	order  []string
+	dir    string
+	client *http.Client
+	wake   chan struct{}
+}
+
+var globalEvents *eventDispatcher
+
+// StartEventHooks loads HOOKS_CONFIG and starts the delivery worker.
+// It is a no-op when no hooks file is configured.
+func StartEventHooks(ctx context.Context, cfg config) error {
+	if cfg.HooksConfigPath == "" {
+		return nil
+	}
+	hooks, err := loadHooksConfig(cfg.HooksConfigPath)
+	if err != nil {
+		return err
+	}
+
+	d := &eventDispatcher{
+		hooks:  map[string]hookConfig{},
+		dir:    cfg.HooksQueueDir,
+		client: &http.Client{},
+		wake:   make(chan struct{}, 1),
+	}
+	for _, h := range hooks {
+		d.hooks[h.Name] = h
+		d.order = append(d.order, h.Name)
+	}
+	for _, sub := range []string{"pending", "inflight", "dead"} {
+		if err := os.MkdirAll(filepath.Join(d.dir, sub), 0o750); err != nil {
+			return fmt.Errorf("hooks queue dir: %w", err)
+		}
+	}
+
+	globalEvents = d
+	go d.run(ctx)
+	log.Printf("event hooks enabled: %d hook(s), queue %s", len(hooks), d.dir)
+	return nil
+}
+
+// reloadEventHooks replaces the hook list after a config reload. Starting
+// or stopping the dispatcher itself needs a restart.
+func reloadEventHooks(hooks []hookConfig) {
+	d := globalEvents
+	if d == nil {
+		if len(hooks) > 0 {
+			log.Printf("config reload: restart needed to enable event hooks")
+		}
+		return
+	}
+	m := map[string]hookConfig{}
+	var order []string
+	for _, h := range hooks {
+		m[h.Name] = h
+		order = append(order, h.Name)
+	}
+	d.mu.Lock()
+	d.hooks, d.order = m, order
+	d.mu.Unlock()
+	log.Printf("event hooks reloaded: %d hook(s)", len(hooks))
+}
+
+// emitEvent queues ev for every matching hook. file/targetFile are absolute
+// paths on disk, exposed to exec hooks only. Safe to call when hooks are off.
+func emitEvent(ev fileEvent, file, targetFile string) {
+	d := globalEvents
+	if d == nil {
+		return
+	}
+	ev.ID = newEventID()
+	ev.Ts = time.Now().UTC().Format(time.RFC3339Nano)
+
+	d.mu.RLock()
+	hooks, order := d.hooks, d.order
+	d.mu.RUnlock()
+
+	queued := false
+	for _, name := range order {
+		h := hooks[name]
+		if !h.matches(ev) {
+			continue
+		}
+		e := queueEntry{Hook: name, Event: ev, NextAttempt: time.Now()}
+		if h.Type == HookExec {
+			e.File, e.TargetFile = file, targetFile
+		}
+		if err := d.writeEntry(entryName(e), e); err != nil {
+			audit(ev.User, ev.Remote, "hook_enqueue_failed", ev.Path, name, 0, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func newEventID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func entryName(e queueEntry) string {
+	return fmt.Sprintf("%020d-%s-%s.json", time.Now().UnixNano(), e.Event.ID, e.Hook)
+}
+
+// writeEntry durably stores e as pending/<name> (write, fsync, rename).
+func (d *eventDispatcher) writeEntry(name string, e queueEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.dir, "pending", "."+name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.dir, "pending", name))
+}
+
+const (
+	hooksPollInterval = 5 * time.Second
+	hooksStaleClaim   = 10 * time.Minute
+	hooksMaxBackoff   = 30 * time.Minute
+)
+
+func (d *eventDispatcher) run(ctx context.Context) {
+	t := time.NewTicker(hooksPollInterval)
+	defer t.Stop()
+	for {
+		d.reclaimStale()
+		d.drain(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// reclaimStale returns entries claimed by a worker that died mid-delivery.
+func (d *eventDispatcher) reclaimStale() {
+	entries, err := os.ReadDir(filepath.Join(d.dir, "inflight"))
+	if err != nil {
+		return
+	}
+	for _, de := range entries {
+		info, err := de.Info()
+		if err != nil || time.Since(info.ModTime()) < hooksStaleClaim {
+			continue
+		}
+		_ = os.Rename(filepath.Join(d.dir, "inflight", de.Name()), filepath.Join(d.dir, "pending", de.Name()))
+	}
+}
+
+func (d *eventDispatcher) drain(ctx context.Context) {
+	entries, err := os.ReadDir(filepath.Join(d.dir, "pending"))
+	if err != nil {
+		log.Printf("hooks: read queue: %v", err)
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, de := range entries {
+		if !strings.HasPrefix(de.Name(), ".") && strings.HasSuffix(de.Name(), ".json") {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		d.process(ctx, name)
+	}
+}
+
+func (d *eventDispatcher) process(ctx context.Context, name string) {
+	pending := filepath.Join(d.dir, "pending", name)
+	b, err := os.ReadFile(pending)
+	if err != nil {
+		return
+	}
+	var e queueEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		_ = os.Rename(pending, filepath.Join(d.dir, "dead", name))
+		return
+	}
+	if time.Now().Before(e.NextAttempt) {
+		return
+	}
+
+	// Claim; another replica may have been faster.
+	inflight := filepath.Join(d.dir, "inflight", name)
+	if err := os.Rename(pending, inflight); err != nil {
+		return
+	}
+	now := time.Now()
+	_ = os.Chtimes(inflight, now, now)
+
+	d.mu.RLock()
+	h, ok := d.hooks[e.Hook]
+	d.mu.RUnlock()
+	if !ok {
+		// Hook removed from config; keep the entry for inspection.
+		_ = os.Rename(inflight, filepath.Join(d.dir, "dead", name))
+		return
+	}
+
+	start := time.Now()
+	err = d.deliver(ctx, h, e)
+	e.Attempts++
+
+	if err == nil {
+		_ = os.Remove(inflight)
+		ObserveHookDelivery(h.Name, "success", time.Since(start))
+		audit(e.Event.User, e.Event.Remote, "hook_delivered", e.Event.Path, h.Name, 0, nil)
+		return
+	}
+
+	e.LastError = err.Error()
+	if e.Attempts >= h.MaxAttempts {
+		ObserveHookDelivery(h.Name, "dead", time.Since(start))
+		audit(e.Event.User, e.Event.Remote, "hook_dead", e.Event.Path, h.Name, 0, err)
+		if b, mErr := json.Marshal(e); mErr == nil {
+			_ = os.WriteFile(inflight, b, 0o640)
+		}
+		_ = os.Rename(inflight, filepath.Join(d.dir, "dead", name))
+		return
+	}
+
+	ObserveHookDelivery(h.Name, "retry", time.Since(start))
+	audit(e.Event.User, e.Event.Remote, "hook_retry", e.Event.Path, h.Name, 0, err)
+	e.NextAttempt = time.Now().Add(hookBackoff(e.Attempts))
+	if err := d.writeEntry(name, e); err != nil {
+		log.Printf("hooks: requeue %s: %v", name, err)
+		return
+	}
+	_ = os.Remove(inflight)
+}
+
+// hookBackoff is 2^attempts seconds, capped at hooksMaxBackoff.
+func hookBackoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return hooksMaxBackoff
+	}
+	d := time.Duration(1<<uint(attempts)) * time.Second
+	if d > hooksMaxBackoff {
+		return hooksMaxBackoff
+	}
+	return d
+}
+
+func (d *eventDispatcher) deliver(ctx context.Context, h hookConfig, e queueEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	switch h.Type {
+	case HookWebhook:
+		return d.deliverWebhook(ctx, h, e)
+	case HookExec:
+		return deliverExec(ctx, h, e)
+	default:
+		return fmt.Errorf("unknown hook type %q", h.Type)
+	}
+}
+
+// deliverWebhook POSTs the event as JSON. When a secret is configured the
+// body is signed: X-SFTP-Signature = "sha256=" + hex(HMAC-SHA256(secret,
+// X-SFTP-Timestamp + "." + body)).
+func (d *eventDispatcher) deliverWebhook(ctx context.Context, h hookConfig, e queueEntry) error {
+	body, err := json.Marshal(e.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sftp-service-hooks")
+	req.Header.Set("X-SFTP-Event", e.Event.Event)
+	req.Header.Set("X-SFTP-Delivery", e.Event.ID)
+	req.Header.Set("X-SFTP-Timestamp", ts)
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		req.Header.Set("X-SFTP-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// deliverExec runs the hook command with the event in its environment.
+// The command gets only PATH and the event; the server's own environment
+// (VAULT_TOKEN, webhook secrets, ...) is not passed on.
+func deliverExec(ctx context.Context, h hookConfig, e queueEntry) error {
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")},
+		"SFTP_EVENT="+e.Event.Event,
+		"SFTP_EVENT_ID="+e.Event.ID,
+		"SFTP_EVENT_TS="+e.Event.Ts,
+		"SFTP_USER="+e.Event.User,
+		"SFTP_REMOTE="+e.Event.Remote,
+		"SFTP_PATH="+e.Event.Path,
+		"SFTP_FILE="+e.File,
+		"SFTP_TARGET="+e.Event.Target,
+		"SFTP_TARGET_FILE="+e.TargetFile,
+		"SFTP_BYTES="+strconv.FormatInt(e.Event.Bytes, 10),
+		"SFTP_CHECKSUMS="+formatChecksums(e.Event.Checksums),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		if msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
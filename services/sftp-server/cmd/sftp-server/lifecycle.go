@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Account lifecycle.
+//
+// A user may only log in from validFrom until validUntil (both optional).
+// A user who has not logged in for inactivityDays (USER_INACTIVITY_DAYS
+// when 0, -1 = never) is refused too. Inactivity counts from the latest of
+// the last login (see activity.go), validFrom and the last change to the
+// user record, so an admin who edits or re-enables a user gives them a
+// fresh period. admin-api also sets disabled on such users.
+
+// checkLifecycle returns the audit action and error if ur may not log in at
+// now, or "" and nil.
+func checkLifecycle(ctx context.Context, cfg config, ur userRecord, now time.Time) (string, error) {
+	if !ur.ValidFrom.IsZero() && now.Before(ur.ValidFrom) {
+		return "auth_fail_not_yet_valid", fmt.Errorf("account valid from %s", ur.ValidFrom.Format(time.RFC3339))
+	}
+	if !ur.ValidUntil.IsZero() && !now.Before(ur.ValidUntil) {
+		return "auth_fail_expired", fmt.Errorf("account expired at %s", ur.ValidUntil.Format(time.RFC3339))
+	}
+
+	days := ur.InactivityDays
+	if days == 0 {
+		days = cfg.InactivityDays
+	}
+	if days <= 0 || activity == nil {
+		return "", nil
+	}
+	since := ur.UpdatedAt
+	if ur.ValidFrom.After(since) {
+		since = ur.ValidFrom
+	}
+	period := time.Duration(days) * 24 * time.Hour
+	if now.Before(since.Add(period)) {
+		return "", nil
+	}
+	last, err := activity.lastLogin(ctx, ur.Username, now.Add(-period))
+	if err != nil {
+		return "auth_fail_user_load", fmt.Errorf("activity: %w", err)
+	}
+	if last.After(since) {
+		since = last
+	}
+	if !now.Before(since.Add(period)) {
+		return "auth_fail_inactive", fmt.Errorf("no login for %d days", days)
+	}
+	return "", nil
+}
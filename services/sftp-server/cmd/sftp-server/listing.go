@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Directory listing policies (user record "listSort", env LIST_SORT).
+const (
+	ListSortNone  = "none"  // directory order, fully streamed
+	ListSortName  = "name"  // by name; reads all names up front, stats lazily
+	ListSortMtime = "mtime" // newest first; stats every entry up front
+)
+
+func validListSort(s string) bool {
+	switch s {
+	case "", ListSortNone, ListSortName, ListSortMtime:
+		return true
+	}
+	return false
+}
+
+// listPolicy controls how Filelist "List" returns a directory.
+type listPolicy struct {
+	sort       string
+	maxEntries int64 // 0 = unlimited
+}
+
+// dirLister is a streaming sftp.ListerAt. Instead of reading and stat-ing a
+// whole directory before replying, it keeps the directory open for the
+// lifetime of the request and reads entries as ListAt offsets advance, so a
+// 500k-entry inbox costs one READDIR batch at a time.
+//
+// pkg/sftp calls ListAt with increasing offsets and Close when the handle
+// is closed. A backwards offset reopens the directory and skips ahead.
+type dirLister struct {
+	dir    string
+	policy listPolicy
+
+	f   *os.File
+	eof bool
+
+	pos int64         // offset of buf[0]
+	buf []os.FileInfo // read but not yet returned
+
+	// Sorted modes only: the whole directory, consumed from idx.
+	sorted      []os.DirEntry
+	sortedInfos []os.FileInfo
+	idx         int
+}
+
+const dirReadBatch = 256
+
+func newDirLister(dir string, policy listPolicy) (*dirLister, error) {
+	l := &dirLister{dir: dir, policy: policy}
+	if err := l.reset(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *dirLister) reset() error {
+	if l.f != nil {
+		_ = l.f.Close()
+	}
+	l.f, l.eof, l.pos, l.buf, l.idx = nil, false, 0, nil, 0
+	l.sorted, l.sortedInfos = nil, nil
+
+	f, err := os.Open(l.dir)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if !info.IsDir() {
+		_ = f.Close()
+		return fmt.Errorf("%s: not a directory", l.dir)
+	}
+
+	switch l.policy.sort {
+	case ListSortName:
+		entries, err := f.ReadDir(-1)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		l.sorted = entries
+
+	case ListSortMtime:
+		entries, err := f.ReadDir(-1)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		sort.SliceStable(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+		l.sortedInfos = infos
+
+	default:
+		l.f = f
+	}
+	return nil
+}
+
+// fill appends at least one more entry to buf unless the directory is
+// exhausted (eof).
+func (l *dirLister) fill(want int) error {
+	if want < dirReadBatch {
+		want = dirReadBatch
+	}
+	for len(l.buf) == 0 && !l.eof {
+		switch {
+		case l.sortedInfos != nil:
+			end := min(l.idx+want, len(l.sortedInfos))
+			l.buf = append(l.buf, l.sortedInfos[l.idx:end]...)
+			l.idx = end
+			l.eof = l.idx >= len(l.sortedInfos)
+
+		case l.sorted != nil:
+			end := min(l.idx+want, len(l.sorted))
+			l.buf = appendInfos(l.buf, l.sorted[l.idx:end])
+			l.idx = end
+			l.eof = l.idx >= len(l.sorted)
+
+		case l.f != nil:
+			entries, err := l.f.ReadDir(want)
+			l.buf = appendInfos(l.buf, entries)
+			if errors.Is(err, io.EOF) || (err == nil && len(entries) == 0) {
+				l.eof = true
+			} else if err != nil {
+				return err
+			}
+
+		default:
+			l.eof = true
+		}
+	}
+	return nil
+}
+
+// appendInfos stats entries; ones deleted since READDIR are skipped.
+func appendInfos(dst []os.FileInfo, entries []os.DirEntry) []os.FileInfo {
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			dst = append(dst, info)
+		}
+	}
+	return dst
+}
+
+func (l *dirLister) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	limit := l.policy.maxEntries
+	if limit > 0 && offset >= limit {
+		return 0, io.EOF
+	}
+	if offset < l.pos {
+		if err := l.reset(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Skip forward to offset.
+	for l.pos+int64(len(l.buf)) <= offset {
+		l.pos += int64(len(l.buf))
+		l.buf = nil
+		if l.eof {
+			return 0, io.EOF
+		}
+		if err := l.fill(int(offset - l.pos)); err != nil {
+			return 0, err
+		}
+		if len(l.buf) == 0 {
+			return 0, io.EOF
+		}
+	}
+	skip := offset - l.pos
+	l.buf = l.buf[skip:]
+	l.pos = offset
+
+	want := len(dst)
+	if limit > 0 && offset+int64(want) > limit {
+		want = int(limit - offset)
+	}
+
+	n := 0
+	for n < want {
+		if len(l.buf) == 0 {
+			if err := l.fill(want - n); err != nil {
+				return n, err
+			}
+			if len(l.buf) == 0 {
+				break
+			}
+		}
+		k := copy(dst[n:want], l.buf)
+		l.buf = l.buf[k:]
+		l.pos += int64(k)
+		n += k
+	}
+
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (l *dirLister) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
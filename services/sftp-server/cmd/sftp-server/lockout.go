@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Brute-force protection.
+//
+// Failed authentications are counted per source IP, per username and
+// source IP, and per username from any source within LOCKOUT_WINDOW, at
+// most once per connection: a client offering several keys, or retrying
+// within a connection, counts once, and a connection that ends without
+// authenticating counts even if every attempt was a key that didn't match
+// (handleConn). A failure found by an auth callback is answered after an
+// exponential backoff delay. Once a counter reaches its limit the IP, the
+// username from that IP, or the username everywhere is banned for
+// LOCKOUT_BAN_DURATION; the last limit is the highest, so a single source
+// cannot lock an account out. Sources in LOCKOUT_ALLOW_CIDRS are never
+// delayed or banned.
+//
+// Counters are local to the replica; bans go through a banStore so they can
+// be shared (LOCKOUT_STORE=vault keeps them under VAULT_BANS_PREFIX, where
+// admin-api can list and clear them). Each replica re-reads the store every
+// LOCKOUT_SYNC_INTERVAL.
+
+var errAuthLocked = errors.New("locked out")
+
+const (
+	BanKindIP   = "ip"
+	BanKindUser = "user"
+)
+
+type authBan struct {
+	Kind     string `json:"kind"`
+	Value    string `json:"value"`
+	Reason   string `json:"reason,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+	BannedAt string `json:"bannedAt"`
+	Until    string `json:"until"`
+}
+
+// userBanValue is the value of a BanKindUser ban for one source: the
+// username and the source IP it failed from. A ban from every source has
+// the bare username.
+func userBanValue(user string, ip net.IP) string {
+	if ip == nil {
+		return user
+	}
+	return user + "@" + ip.String()
+}
+
+// banID is the store key for a ban; values are hex-encoded because
+// usernames come straight from the client. admin-api uses the same scheme.
+func banID(kind, value string) string {
+	return kind + "-" + hex.EncodeToString([]byte(value))
+}
+
+func (b authBan) until() time.Time {
+	t, _ := time.Parse(time.RFC3339, b.Until)
+	return t
+}
+
+// banStore persists bans. Implementations must be safe for concurrent use.
+type banStore interface {
+	Put(ctx context.Context, b authBan) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]authBan, error)
+}
+
+type memoryBanStore struct {
+	mu   sync.Mutex
+	bans map[string]authBan
+}
+
+func newMemoryBanStore() *memoryBanStore {
+	return &memoryBanStore{bans: map[string]authBan{}}
+}
+
+func (s *memoryBanStore) Put(_ context.Context, b authBan) error {
+	s.mu.Lock()
+	s.bans[banID(b.Kind, b.Value)] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryBanStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	delete(s.bans, id)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryBanStore) List(_ context.Context) ([]authBan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]authBan, 0, len(s.bans))
+	for _, b := range s.bans {
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// vaultBanStore keeps one KV v2 secret per ban under prefix.
+type vaultBanStore struct {
+	vc     *vault.Client
+	prefix string
+}
+
+func (s *vaultBanStore) Put(ctx context.Context, b authBan) error {
+	_, err := s.vc.Logical().WriteWithContext(ctx, kvV2DataPath(s.prefix, banID(b.Kind, b.Value)), map[string]interface{}{
+		"data": map[string]interface{}{
+			"kind":     b.Kind,
+			"value":    b.Value,
+			"reason":   b.Reason,
+			"failures": b.Failures,
+			"bannedAt": b.BannedAt,
+			"until":    b.Until,
+		},
+	})
+	return err
+}
+
+func (s *vaultBanStore) Delete(ctx context.Context, id string) error {
+	_, err := s.vc.Logical().DeleteWithContext(ctx, kvV2MetadataPath(s.prefix, id))
+	return err
+}
+
+func (s *vaultBanStore) List(ctx context.Context) ([]authBan, error) {
+	sec, err := s.vc.Logical().ListWithContext(ctx, kvV2MetadataPath(s.prefix, ""))
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, nil
+	}
+	keys, _ := asStringSlice(sec.Data["keys"])
+
+	var out []authBan
+	for _, id := range keys {
+		sec, err := s.vc.Logical().ReadWithContext(ctx, kvV2DataPath(s.prefix, id))
+		if err != nil {
+			return nil, err
+		}
+		if sec == nil || sec.Data == nil {
+			continue
+		}
+		m, ok := sec.Data["data"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		str := func(k string) string { v, _ := asString(m[k]); return v }
+		b := authBan{
+			Kind:     str("kind"),
+			Value:    str("value"),
+			Reason:   str("reason"),
+			BannedAt: str("bannedAt"),
+			Until:    str("until"),
+		}
+		if n, err := asInt64(m["failures"]); err == nil {
+			b.Failures = int(n)
+		}
+		if b.Kind == "" {
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+type lockoutConfig struct {
+	enabled      bool
+	maxIP        int
+	maxUser      int
+	maxUserAny   int
+	window       time.Duration
+	banDuration  time.Duration
+	backoffBase  time.Duration
+	backoffMax   time.Duration
+	allow        []*net.IPNet
+	syncInterval time.Duration
+}
+
+func lockoutConfigFromConfig(cfg config) lockoutConfig {
+	return lockoutConfig{
+		enabled:      cfg.LockoutEnabled,
+		maxIP:        cfg.LockoutMaxFailuresIP,
+		maxUser:      cfg.LockoutMaxFailuresUser,
+		maxUserAny:   cfg.LockoutMaxFailuresUserAny,
+		window:       cfg.LockoutWindow,
+		banDuration:  cfg.LockoutBanDuration,
+		backoffBase:  cfg.LockoutBackoffBase,
+		backoffMax:   cfg.LockoutBackoffMax,
+		allow:        cfg.LockoutAllowCIDRs,
+		syncInterval: cfg.LockoutSyncInterval,
+	}
+}
+
+type failureCount struct {
+	n     int
+	first time.Time
+}
+
+type authGuard struct {
+	cfg     lockoutConfig
+	store   banStore
+	timeout time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failureCount // banID -> count in window
+	counted  map[string]time.Time     // remote address (connection) -> failure counted
+	bans     map[string]authBan       // banID -> ban (snapshot of store)
+}
+
+func newAuthGuard(cfg config, vc *vault.Client) (*authGuard, error) {
+	g := &authGuard{
+		cfg:      lockoutConfigFromConfig(cfg),
+		timeout:  cfg.VaultTimeout,
+		failures: map[string]*failureCount{},
+		counted:  map[string]time.Time{},
+		bans:     map[string]authBan{},
+	}
+	switch cfg.LockoutStore {
+	case "memory":
+		g.store = newMemoryBanStore()
+	case "vault":
+		g.store = &vaultBanStore{vc: vc, prefix: cfg.VaultBansPrefix}
+	default:
+		return nil, fmt.Errorf("unknown lockout store %q", cfg.LockoutStore)
+	}
+	return g, nil
+}
+
+// Start keeps the ban snapshot in sync with the store and drops stale
+// counters until ctx is done.
+func (g *authGuard) Start(ctx context.Context) {
+	if !g.cfg.enabled {
+		return
+	}
+	g.sync(ctx)
+	go func() {
+		t := time.NewTicker(g.cfg.syncInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				g.sync(ctx)
+			}
+		}
+	}()
+}
+
+func (g *authGuard) sync(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	now := time.Now()
+	g.mu.Lock()
+	for id, f := range g.failures {
+		if now.Sub(f.first) > g.cfg.window {
+			delete(g.failures, id)
+		}
+	}
+	for remote, t := range g.counted {
+		if now.Sub(t) > g.cfg.window {
+			delete(g.counted, remote)
+		}
+	}
+	g.mu.Unlock()
+
+	list, err := g.store.List(ctx)
+	if err != nil {
+		// Keep the previous snapshot; bans must not lapse on a store outage.
+		log.Printf("lockout: list bans failed: %v", err)
+		return
+	}
+	bans := make(map[string]authBan, len(list))
+	for _, b := range list {
+		id := banID(b.Kind, b.Value)
+		if now.After(b.until()) {
+			_ = g.store.Delete(ctx, id)
+			continue
+		}
+		bans[id] = b
+	}
+	g.mu.Lock()
+	g.bans = bans
+	g.mu.Unlock()
+}
+
+func (g *authGuard) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range g.cfg.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *authGuard) activeBan(id string) (authBan, bool) {
+	b, ok := g.bans[id]
+	if !ok || time.Now().After(b.until()) {
+		return authBan{}, false
+	}
+	return b, true
+}
+
+// bannedIP reports whether connections from remote should be refused.
+func (g *authGuard) bannedIP(remote string) bool {
+	if g == nil || !g.cfg.enabled {
+		return false
+	}
+	ip := remoteIP(remote)
+	if g.allowed(ip) || ip == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.activeBan(banID(BanKindIP, ip.String()))
+	return ok
+}
+
+// check returns errAuthLocked if user or the source IP is banned.
+func (g *authGuard) check(user, remote string) error {
+	if g == nil || !g.cfg.enabled {
+		return nil
+	}
+	ip := remoteIP(remote)
+	if g.allowed(ip) {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ip != nil {
+		if _, ok := g.activeBan(banID(BanKindIP, ip.String())); ok {
+			return errAuthLocked
+		}
+	}
+	if _, ok := g.activeBan(banID(BanKindUser, userBanValue(user, ip))); ok {
+		return errAuthLocked
+	}
+	if _, ok := g.activeBan(banID(BanKindUser, user)); ok {
+		return errAuthLocked
+	}
+	return nil
+}
+
+// fail records a failed attempt (see count) and sleeps for the backoff
+// delay before returning.
+func (g *authGuard) fail(user, remote string) {
+	if d := g.backoff(g.count(user, remote)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// count records a failed attempt and bans when a limit is reached. Only the
+// first failure of a connection (remote address) counts; later ones return
+// 0. Otherwise it returns the highest counter it raised.
+func (g *authGuard) count(user, remote string) int {
+	if g == nil || !g.cfg.enabled {
+		return 0
+	}
+	ip := remoteIP(remote)
+	if g.allowed(ip) {
+		return 0
+	}
+
+	now := time.Now()
+	var newBans []authBan
+	worst := 0
+
+	g.mu.Lock()
+	if _, ok := g.counted[remote]; ok {
+		g.mu.Unlock()
+		return 0
+	}
+	g.counted[remote] = now
+	count := func(kind, value string, limit int) {
+		id := banID(kind, value)
+		f := g.failures[id]
+		if f == nil || now.Sub(f.first) > g.cfg.window {
+			f = &failureCount{first: now}
+			g.failures[id] = f
+		}
+		f.n++
+		worst = max(worst, f.n)
+		if limit > 0 && f.n >= limit {
+			b := authBan{
+				Kind:     kind,
+				Value:    value,
+				Reason:   fmt.Sprintf("%d failed logins in %s", f.n, g.cfg.window),
+				Failures: f.n,
+				BannedAt: now.UTC().Format(time.RFC3339),
+				Until:    now.Add(g.cfg.banDuration).UTC().Format(time.RFC3339),
+			}
+			g.bans[id] = b
+			delete(g.failures, id)
+			newBans = append(newBans, b)
+		}
+	}
+	if ip != nil {
+		count(BanKindIP, ip.String(), g.cfg.maxIP)
+	}
+	count(BanKindUser, userBanValue(user, ip), g.cfg.maxUser)
+	if ip != nil {
+		count(BanKindUser, user, g.cfg.maxUserAny)
+	}
+	g.mu.Unlock()
+
+	for _, b := range newBans {
+		ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+		err := g.store.Put(ctx, b)
+		cancel()
+		auditEv(auditEvent{User: user, Remote: remote, Action: "auth_ban", Path: b.Kind + ":" + b.Value, Reason: b.Reason}, err)
+		IncAuthBan(b.Kind)
+	}
+	return worst
+}
+
+// succeed clears the counters of the source for a successful login. The
+// username's count from any source is left to expire, so a user logging in
+// does not hide an attack on the account from elsewhere.
+func (g *authGuard) succeed(user, remote string) {
+	if g == nil || !g.cfg.enabled {
+		return
+	}
+	ip := remoteIP(remote)
+	g.mu.Lock()
+	if ip != nil {
+		delete(g.failures, banID(BanKindIP, ip.String()))
+	}
+	delete(g.failures, banID(BanKindUser, userBanValue(user, ip)))
+	delete(g.counted, remote)
+	g.mu.Unlock()
+}
+
+// backoff is base * 2^(n-1), capped at backoffMax.
+func (g *authGuard) backoff(n int) time.Duration {
+	if n <= 0 || g.cfg.backoffBase <= 0 {
+		return 0
+	}
+	d := g.cfg.backoffBase
+	for i := 1; i < n && d < g.cfg.backoffMax; i++ {
+		d *= 2
+	}
+	return min(d, g.cfg.backoffMax)
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs or bare IPs.
+func parseCIDRList(raw string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"golang.org/x/crypto/ssh"
@@ -17,18 +21,27 @@ import (
 func main() {
 	log.SetFlags(0)
 
-	cfg, err := loadConfigFromEnv()
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "config file (.yaml, .yml or .toml)")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	StartMetricsServer(ctx, DefaultMetricsConfigFromEnv())
+	StartMetricsServer(ctx, cfg.Metrics)
+	if err := StartEventHooks(ctx, cfg); err != nil {
+		log.Fatalf("event hooks error: %v", err)
+	}
 
-	hostKey, err := readHostKey(cfg.HostKeyPath)
+	hostKeys, err := loadHostKeys(cfg.HostKeyPaths, cfg.HostKeyAnnouncePaths, cfg.Crypto.HostKeyAlgos)
 	if err != nil {
-		log.Fatalf("read host key %q failed: %v", cfg.HostKeyPath, err)
+		log.Fatalf("host keys: %v", err)
 	}
 
 	vc, err := newVaultClient(cfg)
@@ -36,19 +49,56 @@ func main() {
 		log.Fatalf("vault client error: %v", err)
 	}
 
-	cache := newUserCache(cfg.UserCacheTTL)
-
-	sshCfg := &ssh.ServerConfig{
-		ServerVersion: "SSH-2.0-sftp-service",
-		// Public key auth only
-		PublicKeyCallback: makePublicKeyAuthCallbackWithMetrics(cfg, vc, cache),
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Explicitly disable password auth
-			audit(c.User(), c.RemoteAddr().String(), "auth_password_rejected", "", "", 0, fmt.Errorf("password auth disabled"))
-			return nil, fmt.Errorf("password auth disabled")
-		},
+	cache := newUserCache(cfg.UserCacheTTL, cfg.VaultGroupsPrefix)
+	holds := newHoldCache(vc, cfg.VaultHoldsPrefix, cfg.VaultTimeout, cfg.UserCacheTTL)
+	limits := newThrottle(cfg)
+	proxy := newProxyProtocol(cfg)
+	guard, err := newAuthGuard(cfg, vc)
+	if err != nil {
+		log.Fatalf("lockout error: %v", err)
+	}
+	guard.Start(ctx)
+	if err := StartActivityTracking(cfg, vc); err != nil {
+		log.Fatalf("activity tracking error: %v", err)
 	}
-	sshCfg.AddHostKey(hostKey)
+	StartThroughputSampler(ctx, 5*time.Second)
+
+	newSSHConfig := func(cfg config, hostKeys *hostKeySet) *ssh.ServerConfig {
+		sshCfg := &ssh.ServerConfig{
+			ServerVersion: "SSH-2.0-sftp-service",
+			// Public key auth only
+			PublicKeyCallback: makePublicKeyAuthCallbackWithMetrics(cfg, vc, cache, guard),
+			PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				// Explicitly disable password auth
+				audit(c.User(), c.RemoteAddr().String(), "auth_password_rejected", "", "", 0, fmt.Errorf("password auth disabled"))
+				guard.fail(c.User(), c.RemoteAddr().String())
+				return nil, fmt.Errorf("password auth disabled")
+			},
+		}
+		if cfg.PasswordAuthEnabled {
+			// password+totp users (see mfa.go); everyone else is refused there
+			sshCfg.PasswordCallback = makePasswordCallback(cfg, vc, cache, guard)
+			sshCfg.KeyboardInteractiveCallback = makeKeyboardInteractiveCallback(cfg, vc, cache, guard)
+		}
+		cfg.Crypto.apply(sshCfg)
+		hostKeys.addTo(sshCfg)
+		return sshCfg
+	}
+	cfg.Crypto.logPolicy(hostKeys)
+
+	// New connections are served with the current state; SIGHUP swaps it
+	// (see reload.go) and running sessions keep what they started with.
+	var state atomic.Pointer[serverState]
+	state.Store(&serverState{cfg: cfg, hostKeys: hostKeys, sshCfg: newSSHConfig(cfg, hostKeys)})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(*configPath, &state, newSSHConfig, limits); err != nil {
+				log.Printf("config reload failed, keeping current settings: %v", err)
+			}
+		}
+	}()
 
 	ln, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
@@ -74,14 +124,30 @@ func main() {
 				errCh <- err
 				return
 			}
-			
-			IncSessionActive(1)
-			IncSessionTotal("started")
-
-			go func() {
-    				defer IncSessionActive(-1)
-    				handleConn(cfg, vc, cache, sshCfg, conn)
-			}()
+
+			go func(raw net.Conn) {
+				// Real client address first, so the ban check and
+				// everything after it see the client, not the LB.
+				conn, err := proxy.wrap(raw)
+				if err != nil {
+					audit("", raw.RemoteAddr().String(), "proxy_header_invalid", "", "", 0, err)
+					IncSessionTotal("rejected_proxy")
+					_ = raw.Close()
+					return
+				}
+
+				if guard.bannedIP(conn.RemoteAddr().String()) {
+					IncSessionTotal("rejected_banned")
+					_ = conn.Close()
+					return
+				}
+
+				IncSessionActive(1)
+				IncSessionTotal("started")
+				defer IncSessionActive(-1)
+				st := state.Load()
+				handleConn(st.cfg, vc, cache, holds, limits, guard, st.hostKeys, st.sshCfg, conn)
+			}(conn)
 		}
 	}()
 
@@ -97,12 +163,30 @@ func main() {
 	}
 }
 
-func handleConn(cfg config, vc *vault.Client, cache *userCache, sshCfg *ssh.ServerConfig, raw net.Conn) {
+func handleConn(cfg config, vc *vault.Client, cache *userCache, holds *holdCache, limits *throttle, guard *authGuard, hostKeys *hostKeySet, sshCfg *ssh.ServerConfig, raw net.Conn) {
 	defer raw.Close()
 
-	sshConn, chans, reqs, err := ssh.NewServerConn(raw, sshCfg)
+	// Note who tried to log in and whether any attempt was refused, so a
+	// connection that never authenticates counts as one failure even when
+	// no callback counted it (keys that don't match).
+	var triedUser string
+	refused := false
+	connCfg := *sshCfg
+	connCfg.AuthLogCallback = func(c ssh.ConnMetadata, method string, err error) {
+		var partial *ssh.PartialSuccessError
+		if err != nil && method != "none" && !errors.As(err, &partial) {
+			triedUser, refused = c.User(), true
+		}
+	}
+
+	start := time.Now()
+	sshConn, chans, reqs, err := ssh.NewServerConn(raw, &connCfg)
 	if err != nil {
 		// Most auth failures surface here
+		var authErr *ssh.ServerAuthError
+		if errors.As(err, &authErr) && refused {
+			guard.count(triedUser, raw.RemoteAddr().String())
+		}
 		return
 	}
 	defer sshConn.Close()
@@ -110,10 +194,25 @@ func handleConn(cfg config, vc *vault.Client, cache *userCache, sshCfg *ssh.Serv
 	user := sshConn.User()
 	remote := sshConn.RemoteAddr().String()
 
-	audit(user, remote, "session_start", "", "", 0, nil)
+	// Only now has the client proven the key (or password and code).
+	methods := sshConn.Permissions.Extensions[extAuthMethods]
+	guard.succeed(user, remote)
+	okEv := auditEvent{User: user, Remote: remote, Action: "auth_ok", Key: sshConn.Permissions.Extensions[extKeyFingerprint]}
+	if methods != "publickey" {
+		okEv.Target = strings.ReplaceAll(methods, ",", "+")
+	} else {
+		ObserveAuth(user, AuthOK, time.Since(start))
+	}
+	auditEv(okEv, nil)
+
+	auditEv(auditEvent{User: user, Remote: remote, Action: "session_start", Key: sshConn.Permissions.Extensions[extKeyFingerprint], Algorithms: negotiatedAlgorithms(sshConn.Conn)}, nil)
+	recordLogin(user, remote, sshConn.Permissions.Extensions[extKeyFingerprint])
+
+	mon := newSessionMonitor(sshConn, sessionLimitsFromConfig(cfg))
 
-	// Discard global requests
-	go ssh.DiscardRequests(reqs)
+	// Host key proofs; other global requests are refused
+	go hostKeys.serveGlobalRequests(sshConn.Conn, reqs)
+	hostKeys.announce(sshConn)
 
 	// Handle channels
 	for newCh := range chans {
@@ -129,6 +228,7 @@ func handleConn(cfg config, vc *vault.Client, cache *userCache, sshCfg *ssh.Serv
 
 		go func() {
 			defer ch.Close()
+			defer mon.untrack(ch)
 
 			for req := range inReqs {
 				switch req.Type {
@@ -142,42 +242,29 @@ func handleConn(cfg config, vc *vault.Client, cache *userCache, sshCfg *ssh.Serv
 					}
 					_ = req.Reply(true, nil)
 
-					// Load user again to get quotas & rootSubdir (cached)
-					ctx, cancel := context.WithTimeout(context.Background(), cfg.VaultTimeout)
-					ur, err := cache.getOrLoad(ctx, vc, cfg.VaultUsersPrefix, user, cfg.UserCacheTTL)
-					cancel()
-					if err != nil {
-						audit(user, remote, "user_load_failed", "", "", 0, err)
+					fs, ok := sessionFS(cfg, vc, cache, holds, limits, sshConn)
+					if !ok {
 						return
 					}
+					defer fs.releaseLimits()
 
-					root := userRootPath(cfg.DataRoot, ur.RootSubdir, user)
-
-					// Ensure user root exists (will fail if /data not writable)
-					if err := os.MkdirAll(root, 0o750); err != nil {
-						audit(user, remote, "user_root_mkdir_failed", root, "", 0, err)
-						return
-					}
+					// Serve SFTP on this channel
+					serveSFTP(mon.track(ch), fs)
+					return
 
-					qb := ur.QuotaBytes
-					if qb <= 0 {
-						qb = cfg.DefaultQuotaBytes
-					}
-					qf := ur.QuotaFiles
-					if qf <= 0 {
-						qf = cfg.DefaultQuotaFiles
+				case "exec":
+					// scp or an allow-listed command, no shell
+					argv, ok := acceptExec(cfg, user, remote, req)
+					if !ok {
+						continue
 					}
 
-					fs := jailedFS{
-						root:       root,
-						user:       user,
-						remote:     remote,
-						quotaBytes: qb,
-						quotaFiles: qf,
+					fs, ok := sessionFS(cfg, vc, cache, holds, limits, sshConn)
+					if !ok {
+						return
 					}
-
-					// Serve SFTP on this channel
-					serveSFTP(ch, fs)
+					defer fs.releaseLimits()
+					serveExec(mon.track(ch), fs, argv)
 					return
 
 				default:
@@ -188,15 +275,87 @@ func handleConn(cfg config, vc *vault.Client, cache *userCache, sshCfg *ssh.Serv
 		}()
 	}
 
-	audit(user, remote, "session_end", "", "", 0, nil)
+	reason := mon.stop()
+	IncSessionTotal(reason)
+	auditEv(auditEvent{
+		User:       user,
+		Remote:     remote,
+		Action:     "session_end",
+		Reason:     reason,
+		DurationMs: time.Since(mon.start).Milliseconds(),
+	}, nil)
 }
 
-func readHostKey(path string) (ssh.Signer, error) {
-	b, err := os.ReadFile(path)
+// sessionFS builds the jailed filesystem a session channel is served with,
+// loading the user again for quotas and root (cached). Failures are audited.
+func sessionFS(cfg config, vc *vault.Client, cache *userCache, holds *holdCache, limits *throttle, sshConn *ssh.ServerConn) (jailedFS, bool) {
+	user := sshConn.User()
+	remote := sshConn.RemoteAddr().String()
+
+	// Load user again to get quotas & rootSubdir (cached)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.VaultTimeout)
+	ur, err := cache.getOrLoad(ctx, vc, cfg.VaultUsersPrefix, user, cfg.UserCacheTTL)
+	cancel()
 	if err != nil {
-		return nil, err
+		audit(user, remote, "user_load_failed", "", "", 0, err)
+		return jailedFS{}, false
 	}
-	return ssh.ParsePrivateKey(b)
+
+	root := userRootPath(cfg.DataRoot, ur.RootSubdir, user)
+
+	// Ensure user root exists (will fail if /data not writable)
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		audit(user, remote, "user_root_mkdir_failed", root, "", 0, err)
+		return jailedFS{}, false
+	}
+
+	qb := ur.QuotaBytes
+	if qb <= 0 {
+		qb = cfg.DefaultQuotaBytes
+	}
+	qf := ur.QuotaFiles
+	if qf <= 0 {
+		qf = cfg.DefaultQuotaFiles
+	}
+
+	lp := listPolicy{sort: ur.ListSort, maxEntries: ur.ListMaxEntries}
+	if lp.sort == "" {
+		lp.sort = cfg.ListSort
+	}
+	if lp.maxEntries <= 0 {
+		lp.maxEntries = cfg.ListMaxEntries
+	}
+
+	shares, err := mountSharedFolders(cfg.DataRoot, root, user, remote, ur)
+	if err != nil {
+		audit(user, remote, "shared_folder_mkdir_failed", "", "", 0, err)
+		return jailedFS{}, false
+	}
+
+	upL, downL, release := limits.limiters(user, remote, ur.UploadBytesPerSec, ur.DownloadBytesPerSec)
+
+	return jailedFS{
+		root:          root,
+		user:          user,
+		remote:        remote,
+		quotaBytes:    qb,
+		quotaFiles:    qf,
+		sums:          checksumPolicyFromConfig(cfg),
+		writers:       newOpenWriters(),
+		list:          lp,
+		perms:         keyPermsFromExtensions(sshConn.Permissions.Extensions),
+		userPerms:     ur.perms,
+		shares:        shares,
+		upLimits:      upL,
+		downLimits:    downL,
+		releaseLimits: release,
+		worm: wormPolicy{
+			immutable: ur.Immutable,
+			paths:     ur.ImmutablePaths,
+			retention: time.Duration(ur.RetentionDays) * 24 * time.Hour,
+			holds:     func() ([]legalHold, error) { return holds.get(user) },
+		},
+	}, true
 }
 
 func parseSubsystem(payload []byte) string {
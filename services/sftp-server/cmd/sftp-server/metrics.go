@@ -4,8 +4,6 @@ import (
 	"context"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -28,32 +26,6 @@ type MetricsConfig struct {
 	DisableProcess     bool
 }
 
-// DefaultMetricsConfigFromEnv reads config from env vars.
-// METRICS_ADDR default: "0.0.0.0:9090"
-// METRICS_PATH default: "/metrics"
-// METRICS_INCLUDE_USER default: "false"
-func DefaultMetricsConfigFromEnv() MetricsConfig {
-	addr := getenvM("METRICS_ADDR", "0.0.0.0:9090")
-	path := getenvM("METRICS_PATH", "/metrics")
-	includeUser := getenvBoolM("METRICS_INCLUDE_USER", false)
-
-	ns := getenvM("METRICS_NAMESPACE", "sftp")
-	sub := getenvM("METRICS_SUBSYSTEM", "server")
-
-	disableGo := getenvBoolM("METRICS_DISABLE_GO", false)
-	disableProc := getenvBoolM("METRICS_DISABLE_PROCESS", false)
-
-	return MetricsConfig{
-		Addr:              addr,
-		Path:              path,
-		IncludeUserLabel:   includeUser,
-		Namespace:          ns,
-		Subsystem:          sub,
-		DisableGoCollector: disableGo,
-		DisableProcess:     disableProc,
-	}
-}
-
 // StartMetricsServer starts /metrics on a separate listener.
 // Call this once during startup, and cancel via ctx.
 func StartMetricsServer(ctx context.Context, cfg MetricsConfig) {
@@ -113,6 +85,9 @@ const (
 	AuthFailKey     = "fail_key"
 	AuthFailUnknown = "fail_unknown_user"
 	AuthFailDisabled = "fail_disabled"
+	AuthFailLocked  = "fail_locked"
+	AuthFailPassword = "fail_password"
+	AuthFailTOTP    = "fail_totp"
 	AuthError       = "error"
 )
 
@@ -130,6 +105,15 @@ func ObserveAuth(user string, result string, dur time.Duration) {
 	m.authDuration.With(lbl).Observe(dur.Seconds())
 }
 
+// IncAuthBan counts bans placed by brute-force protection; kind is "ip" or "user".
+func IncAuthBan(kind string) {
+	m := getGlobalMetrics()
+	if m == nil {
+		return
+	}
+	m.authBans.WithLabelValues(kind).Inc()
+}
+
 // IncSessionActive increments/decrements active session gauge.
 // Call with +1 on session start, -1 on session end.
 func IncSessionActive(delta float64) {
@@ -228,6 +212,26 @@ func IncStorageIOError(op string) {
 	m.storageIOErrors.WithLabelValues(op).Inc()
 }
 
+// ObserveHookDelivery records an event hook delivery attempt.
+// result: "success", "retry" or "dead".
+func ObserveHookDelivery(hook string, result string, dur time.Duration) {
+	m := getGlobalMetrics()
+	if m == nil {
+		return
+	}
+	m.hookDeliveries.WithLabelValues(hook, result).Inc()
+	m.hookDuration.WithLabelValues(hook, result).Observe(dur.Seconds())
+}
+
+// SetThroughput publishes the current transfer rate; direction is "in" or "out".
+func SetThroughput(direction string, bytesPerSec float64) {
+	m := getGlobalMetrics()
+	if m == nil {
+		return
+	}
+	m.throughput.WithLabelValues(direction).Set(bytesPerSec)
+}
+
 // =====================
 // Internal metrics impl
 // =====================
@@ -239,6 +243,7 @@ type sftpMetrics struct {
 	sessionsTotal  *prometheus.CounterVec
 
 	authAttempts *prometheus.CounterVec
+	authBans     *prometheus.CounterVec
 	authDuration *prometheus.HistogramVec
 
 	opTotal    *prometheus.CounterVec
@@ -254,6 +259,11 @@ type sftpMetrics struct {
 	vaultLastSuccess prometheus.Gauge
 
 	storageIOErrors *prometheus.CounterVec
+
+	hookDeliveries *prometheus.CounterVec
+	hookDuration   *prometheus.HistogramVec
+
+	throughput *prometheus.GaugeVec
 }
 
 func newSFTPMetrics(cfg MetricsConfig, reg *prometheus.Registry) *sftpMetrics {
@@ -282,13 +292,17 @@ func newSFTPMetrics(cfg MetricsConfig, reg *prometheus.Registry) *sftpMetrics {
 	})
 	m.sessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: ns, Subsystem: sub, Name: "sessions_total",
-		Help: "Total number of SFTP sessions started.",
+		Help: "Total number of SFTP sessions by result (\"started\", or the reason a session ended).",
 	}, []string{"result"})
 
 	m.authAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: ns, Subsystem: sub, Name: "auth_attempts_total",
 		Help: "Total authentication attempts.",
 	}, authLabels)
+	m.authBans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Subsystem: sub, Name: "auth_bans_total",
+		Help: "Bans placed by brute-force protection.",
+	}, []string{"kind"})
 	m.authDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: ns, Subsystem: sub, Name: "auth_duration_seconds",
 		Help: "Authentication decision latency.",
@@ -338,10 +352,26 @@ func newSFTPMetrics(cfg MetricsConfig, reg *prometheus.Registry) *sftpMetrics {
 		Help: "Storage IO error count (application-level).",
 	}, []string{"op"})
 
+	m.hookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns, Subsystem: sub, Name: "hook_deliveries_total",
+		Help: "Total event hook delivery attempts.",
+	}, []string{"hook", "result"})
+	m.hookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns, Subsystem: sub, Name: "hook_delivery_duration_seconds",
+		Help: "Event hook delivery latency.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+	}, []string{"hook", "result"})
+
+	m.throughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns, Subsystem: sub, Name: "throughput_bytes_per_second",
+		Help: "Current SFTP transfer rate across all sessions (after throttling).",
+	}, []string{"direction"})
+
 	reg.MustRegister(
 		m.sessionsActive,
 		m.sessionsTotal,
 		m.authAttempts,
+		m.authBans,
 		m.authDuration,
 		m.opTotal,
 		m.opDuration,
@@ -352,6 +382,9 @@ func newSFTPMetrics(cfg MetricsConfig, reg *prometheus.Registry) *sftpMetrics {
 		m.vaultDuration,
 		m.vaultLastSuccess,
 		m.storageIOErrors,
+		m.hookDeliveries,
+		m.hookDuration,
+		m.throughput,
 	)
 
 	return m
@@ -366,27 +399,6 @@ func getGlobalMetrics() *sftpMetrics  { return globalMetrics }
 // Helpers
 // =====================
 
-
-func getenvM(k, def string) string {
-	v := strings.TrimSpace(os.Getenv(k))
-	if v == "" {
-		return def
-	}
-	return v
-}
-
-func getenvBoolM(k string, def bool) bool {
-	v := strings.TrimSpace(os.Getenv(k))
-	if v == "" {
-		return def
-	}
-	b, err := strconv.ParseBool(v)
-	if err != nil {
-		return def
-	}
-	return b
-}
-
 func normalizeOpM(op string) string {
 	op = strings.ToLower(strings.TrimSpace(op))
 	switch op {
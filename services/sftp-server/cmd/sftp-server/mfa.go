@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// Password and TOTP authentication.
+//
+// The user record's authMode selects how a user logs in:
+//
+//	publickey       (default) an authorized key
+//	publickey+totp  an authorized key, then a TOTP code over
+//	                keyboard-interactive (SSH partial success)
+//	password+totp   password and TOTP code, either both over
+//	                keyboard-interactive or "password" followed by a
+//	                keyboard-interactive TOTP prompt
+//
+// Passwords are stored as Argon2id PHC strings (passwordHash); TOTP follows
+// RFC 6238 with SHA-1, 30 s steps and 6 digits, accepting one step of clock
+// skew. A code cannot be reused within its window.
+
+const (
+	AuthModePublicKey     = "publickey"
+	AuthModePublicKeyTOTP = "publickey+totp"
+	AuthModePasswordTOTP  = "password+totp"
+)
+
+func validAuthMode(s string) bool {
+	switch s {
+	case "", AuthModePublicKey, AuthModePublicKeyTOTP, AuthModePasswordTOTP:
+		return true
+	}
+	return false
+}
+
+// Limits on password verification. Each check allocates the hash's m KiB,
+// so stored hashes may ask for at most argon2MaxMemory (admin-api enforces
+// the same bounds) and at most argon2MaxConcurrent checks run at once;
+// further attempts wait up to argon2Wait and then fail.
+const (
+	argon2MaxMemory     = 256 * 1024 // KiB
+	argon2MaxIterations = 16
+	argon2MaxThreads    = 16
+
+	argon2MaxConcurrent = 4
+	argon2Wait          = 10 * time.Second
+)
+
+var argon2Slots = make(chan struct{}, argon2MaxConcurrent)
+
+// dummyPasswordHash is verified against when the user is unknown so that
+// response time does not reveal which usernames exist.
+const dummyPasswordHash = "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$7kV7X9m4Ejb0pY4Yb6y8gqN7f1a8m5o3t0q1Zy9cVfQ"
+
+// verifyArgon2id checks password against an encoded
+// "$argon2id$v=19$m=...,t=...,p=...$salt$hash" string.
+func verifyArgon2id(encoded string, password []byte) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	var mem, iters uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iters, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	if mem > argon2MaxMemory || iters == 0 || iters > argon2MaxIterations || threads == 0 || threads > argon2MaxThreads {
+		return false, fmt.Errorf("argon2 parameters out of range")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, fmt.Errorf("invalid argon2 hash")
+	}
+	select {
+	case argon2Slots <- struct{}{}:
+		defer func() { <-argon2Slots }()
+	case <-time.After(argon2Wait):
+		return false, fmt.Errorf("too many password checks in progress")
+	}
+	got := argon2.IDKey(password, salt, iters, mem, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// totpCode returns the RFC 6238 code for secret at step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+func decodeTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s), " ", ""))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+}
+
+// totpReplay remembers the last step accepted per user. Steps older than
+// the skew window can't be replayed anyway, so they are dropped.
+var totpReplay = struct {
+	mu   sync.Mutex
+	last map[string]int64
+}{last: map[string]int64{}}
+
+// verifyTOTP checks code against secret at now (±1 step) and rejects reuse
+// of an already accepted step.
+func verifyTOTP(user, secret, code string, now time.Time) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	code = strings.TrimSpace(code)
+	step := now.Unix() / 30
+
+	totpReplay.mu.Lock()
+	defer totpReplay.mu.Unlock()
+	for u, last := range totpReplay.last {
+		if last < step-2 {
+			delete(totpReplay.last, u)
+		}
+	}
+	for _, s := range []int64{step, step - 1, step + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, s)), []byte(code)) != 1 {
+			continue
+		}
+		if s <= totpReplay.last[user] {
+			return false
+		}
+		totpReplay.last[user] = s
+		return true
+	}
+	return false
+}
+
+// totpStage returns the callbacks for the second factor after partial
+// success; on success the session gets perms from the first factor.
+func totpStage(user, remote, secret string, perms *ssh.Permissions, guard *authGuard, first string) ssh.ServerAuthCallbacks {
+	return ssh.ServerAuthCallbacks{
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			start := time.Now()
+			if first == "publickey" {
+				// Only reached once the key signature has been verified.
+				auditEv(auditEvent{User: user, Remote: remote, Action: "auth_partial", Target: "publickey", Key: perms.Extensions[extKeyFingerprint]}, nil)
+			}
+			answers, err := client(user, "", []string{"Verification code: "}, []bool{true})
+			if err != nil || len(answers) != 1 {
+				return nil, fmt.Errorf("permission denied")
+			}
+			if !verifyTOTP(user, secret, answers[0], time.Now()) {
+				audit(user, remote, "auth_fail_totp", "", "", 0, fmt.Errorf("invalid verification code"))
+				ObserveAuth(user, AuthFailTOTP, time.Since(start))
+				guard.fail(user, remote)
+				return nil, fmt.Errorf("permission denied")
+			}
+			perms.Extensions[extAuthMethods] = first + ",totp"
+			ObserveAuth(user, AuthOK, time.Since(start))
+			return perms, nil
+		},
+	}
+}
+
+// extAuthMethods records the methods that authenticated the session.
+const extAuthMethods = "auth-methods"
+
+// loadPasswordUser performs the checks shared by password logins and
+// returns the user if password+totp is enabled for them.
+func loadPasswordUser(cfg config, vc *vault.Client, cache *userCache, guard *authGuard, user, remote string) (userRecord, error) {
+	if err := guard.check(user, remote); err != nil {
+		audit(user, remote, "auth_fail_locked", "", "", 0, err)
+		return userRecord{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.VaultTimeout)
+	defer cancel()
+	ur, err := cache.getOrLoad(ctx, vc, cfg.VaultUsersPrefix, user, cfg.UserCacheTTL)
+	if err != nil {
+		return userRecord{}, fmt.Errorf("user load: %w", err)
+	}
+	if ur.Disabled {
+		return userRecord{}, fmt.Errorf("disabled")
+	}
+	if _, err := checkLifecycle(ctx, cfg, ur, time.Now()); err != nil {
+		return userRecord{}, err
+	}
+	if !ipAllowed(remoteIP(remote), ur.allowedNets) {
+		return userRecord{}, fmt.Errorf("source address not in allowedCIDRs")
+	}
+	if ur.AuthMode != AuthModePasswordTOTP || ur.PasswordHash == "" || ur.TOTPSecret == "" {
+		return userRecord{}, fmt.Errorf("password login not enabled")
+	}
+	return ur, nil
+}
+
+// checkPassword verifies pass for ur (or a dummy hash if ur is unknown).
+func checkPassword(ur userRecord, pass []byte) bool {
+	if ur.PasswordHash == "" {
+		_, _ = verifyArgon2id(dummyPasswordHash, pass)
+		return false
+	}
+	ok, err := verifyArgon2id(ur.PasswordHash, pass)
+	return err == nil && ok
+}
+
+// makePasswordCallback handles the "password" method: a correct password
+// yields partial success with a TOTP prompt.
+func makePasswordCallback(cfg config, vc *vault.Client, cache *userCache, guard *authGuard) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		user, remote := c.User(), c.RemoteAddr().String()
+		start := time.Now()
+
+		ur, err := loadPasswordUser(cfg, vc, cache, guard, user, remote)
+		if err == errAuthLocked {
+			ObserveAuth(user, AuthFailLocked, time.Since(start))
+			return nil, err
+		}
+		if !checkPassword(ur, pass) || err != nil {
+			if err == nil {
+				err = fmt.Errorf("wrong password")
+			}
+			audit(user, remote, "auth_fail_password", "", "", 0, err)
+			ObserveAuth(user, AuthFailPassword, time.Since(start))
+			guard.fail(user, remote)
+			return nil, fmt.Errorf("permission denied")
+		}
+
+		audit(user, remote, "auth_partial", "", "password", 0, nil)
+		perms := &ssh.Permissions{Extensions: map[string]string{"authed": "true"}}
+		return nil, &ssh.PartialSuccessError{Next: totpStage(user, remote, ur.TOTPSecret, perms, guard, "password")}
+	}
+}
+
+// makeKeyboardInteractiveCallback asks for password and verification code
+// in one round, for clients that only speak keyboard-interactive.
+func makeKeyboardInteractiveCallback(cfg config, vc *vault.Client, cache *userCache, guard *authGuard) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		user, remote := c.User(), c.RemoteAddr().String()
+		start := time.Now()
+
+		if err := guard.check(user, remote); err != nil {
+			audit(user, remote, "auth_fail_locked", "", "", 0, err)
+			ObserveAuth(user, AuthFailLocked, time.Since(start))
+			return nil, err
+		}
+
+		// Always challenge, even for unknown users.
+		answers, err := client(user, "", []string{"Password: ", "Verification code: "}, []bool{false, true})
+		if err != nil || len(answers) != 2 {
+			return nil, fmt.Errorf("permission denied")
+		}
+
+		ur, err := loadPasswordUser(cfg, vc, cache, guard, user, remote)
+		if !checkPassword(ur, []byte(answers[0])) || err != nil {
+			if err == nil {
+				err = fmt.Errorf("wrong password")
+			}
+			audit(user, remote, "auth_fail_password", "", "", 0, err)
+			ObserveAuth(user, AuthFailPassword, time.Since(start))
+			guard.fail(user, remote)
+			return nil, fmt.Errorf("permission denied")
+		}
+		if !verifyTOTP(user, ur.TOTPSecret, answers[1], time.Now()) {
+			audit(user, remote, "auth_fail_totp", "", "", 0, fmt.Errorf("invalid verification code"))
+			ObserveAuth(user, AuthFailTOTP, time.Since(start))
+			guard.fail(user, remote)
+			return nil, fmt.Errorf("permission denied")
+		}
+
+		ObserveAuth(user, AuthOK, time.Since(start))
+		return &ssh.Permissions{Extensions: map[string]string{
+			"authed":       "true",
+			extAuthMethods: "password,totp",
+		}}, nil
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy PROXY protocol (v1 text and v2 binary).
+//
+// With PROXY_PROTOCOL_ENABLED, connections from PROXY_PROTOCOL_TRUSTED_CIDRS
+// (the load balancers) must start with a PROXY header; the client address
+// it carries becomes the connection's RemoteAddr, so auth, audit, lockout,
+// throttling and metrics all see the real client. Connections from other
+// addresses are served as-is and a header from them is not honoured, since
+// anyone could send one.
+//
+// v2 LOCAL (load balancer health checks) and v1 UNKNOWN keep the load
+// balancer's own address. TLVs are ignored.
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a net.Conn whose addresses come from a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // holds bytes read past the header
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+type proxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// newProxyProtocol returns nil when PROXY protocol is disabled.
+func newProxyProtocol(cfg config) *proxyProtocol {
+	if !cfg.ProxyProtocolEnabled {
+		return nil
+	}
+	return &proxyProtocol{trusted: cfg.ProxyProtocolTrustedCIDRs, timeout: cfg.ProxyProtocolTimeout}
+}
+
+// wrap reads the PROXY header if conn comes from a trusted upstream. Nil
+// receivers return conn unchanged.
+func (p *proxyProtocol) wrap(conn net.Conn) (net.Conn, error) {
+	if p == nil || !ipAllowedStrict(remoteIP(conn.RemoteAddr().String()), p.trusted) {
+		return conn, nil
+	}
+	if p.timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(p.timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	r := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+
+	// Peek only the first byte: a v1 "PROXY UNKNOWN\r\n" is shorter than
+	// the v2 signature, and a health check that sends just that and waits
+	// must not block here. v1 is then read up to its "\r\n".
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errProxyHeader, err)
+	}
+	if first[0] == proxyV2Sig[0] {
+		err = readProxyV2(r, pc)
+	} else {
+		err = readProxyV1(r, pc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// ipAllowedStrict is ipAllowed where an empty list allows nothing.
+func ipAllowedStrict(ip net.IP, nets []*net.IPNet) bool {
+	return len(nets) > 0 && ipAllowed(ip, nets)
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader, pc *proxyConn) error {
+	var line []byte
+	for len(line) < 107 { // longest valid v1 header
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok || !strings.HasPrefix(s, "PROXY ") {
+		return fmt.Errorf("%w: missing v1 header", errProxyHeader)
+	}
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return fmt.Errorf("%w: %q", errProxyHeader, s)
+	}
+	src, err := parseProxyAddr(f[2], f[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddr(f[3], f[5])
+	if err != nil {
+		return err
+	}
+	pc.remote, pc.local = src, dst
+	return nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: bad address %s:%s", errProxyHeader, host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 parses the binary header: signature, version/command,
+// family/protocol, length and the address block.
+func readProxyV2(r *bufio.Reader, pc *proxyConn) error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return fmt.Errorf("%w: %v", errProxyHeader, err)
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return fmt.Errorf("%w: bad v2 signature", errProxyHeader)
+	}
+	if hdr[12] != 0x20 && hdr[12] != 0x21 { // version 2, LOCAL or PROXY
+		return fmt.Errorf("%w: version/command 0x%02x", errProxyHeader, hdr[12])
+	}
+	switch hdr[13] {
+	case 0x00, 0x11, 0x12, 0x21, 0x22, 0x31, 0x32: // UNSPEC, or INET/INET6/UNIX over STREAM/DGRAM
+	default:
+		return fmt.Errorf("%w: family/transport 0x%02x", errProxyHeader, hdr[13])
+	}
+	n := int(binary.BigEndian.Uint16(hdr[14:16]))
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return fmt.Errorf("%w: %v", errProxyHeader, err)
+	}
+
+	if hdr[12] == 0x20 { // LOCAL
+		return nil
+	}
+
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		ipLen = 4
+	case 0x2: // AF_INET6
+		ipLen = 16
+	default: // AF_UNSPEC, AF_UNIX: no usable address
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return fmt.Errorf("%w: short address block", errProxyHeader)
+	}
+	src := net.IP(bytes.Clone(body[:ipLen]))
+	dst := net.IP(bytes.Clone(body[ipLen : 2*ipLen]))
+	sport := binary.BigEndian.Uint16(body[2*ipLen:])
+	dport := binary.BigEndian.Uint16(body[2*ipLen+2:])
+	pc.remote = &net.TCPAddr{IP: src, Port: int(sport)}
+	pc.local = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 type usage struct {
@@ -45,12 +46,25 @@ type atomicQuotaWriterAt struct {
 	f         *os.File
 	baseBytes int64
 	quota     int64
-
+	worm      wormPolicy
+	sums      checksumPolicy
+	hasher    *streamHasher
+	writers   *openWriters
+
+	// mu serializes the client's writes and Close with server-side copies
+	// (copy-data), which write through the same writer.
+	mu       sync.Mutex
 	maxEnd   int64
 	exceeded bool
+	closed   bool
 }
 
 func (w *atomicQuotaWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
 	if w.exceeded {
 		return 0, fmt.Errorf("quota exceeded")
 	}
@@ -70,10 +84,19 @@ func (w *atomicQuotaWriterAt) WriteAt(p []byte, off int64) (int, error) {
 		return 0, fmt.Errorf("quota exceeded")
 	}
 
-	return w.f.WriteAt(p, off)
+	n, err := w.f.WriteAt(p, off)
+	w.hasher.write(p[:n], off)
+	return n, err
 }
 
 func (w *atomicQuotaWriterAt) Close() error {
+	w.writers.remove(w.finalPath, w)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
 	_ = w.f.Close()
 
 	// If we exceeded, temp already removed.
@@ -81,18 +104,61 @@ func (w *atomicQuotaWriterAt) Close() error {
 		return fmt.Errorf("quota exceeded")
 	}
 
+	// A WORM file may have been committed at the target meanwhile
+	if err := w.worm.check(w.finalPath, w.rel); err != nil {
+		_ = os.Remove(w.tmpPath)
+		audit(w.user, w.remote, "put_fail", w.rel, "", w.maxEnd, err)
+		return err
+	}
+
+	sums, err := w.hasher.sums(w.tmpPath)
+	if err != nil {
+		_ = os.Remove(w.tmpPath)
+		audit(w.user, w.remote, "put_fail", w.rel, "", w.maxEnd, fmt.Errorf("checksum: %w", err))
+		return err
+	}
+
 	// Commit atomically
 	if err := os.Rename(w.tmpPath, w.finalPath); err != nil {
 		_ = os.Remove(w.tmpPath)
 		return err
 	}
 
+	if err := w.sums.save(w.finalPath, sums); err != nil {
+		audit(w.user, w.remote, "checksum_store_failed", w.rel, "", 0, err)
+	}
 
 	// Final outcome: success
-	audit(w.user, w.remote, "put_commit", w.rel, "", w.maxEnd, nil)
+	auditEv(auditEvent{User: w.user, Remote: w.remote, Action: "put_commit", Path: w.rel, Bytes: w.maxEnd, Checksums: sums}, nil)
+	emitEvent(fileEvent{Event: "put_commit", User: w.user, Remote: w.remote, Path: w.rel, Bytes: w.maxEnd, Checksums: sums}, w.finalPath, "")
+	recordUpload(w.user)
 	return nil
 }
 
+// Abort ends the upload without committing it: the temp file is removed
+// and the failure audited. For callers that know the data is incomplete.
+func (w *atomicQuotaWriterAt) Abort(cause error) {
+	w.writers.remove(w.finalPath, w)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	_ = w.f.Close()
+	if w.exceeded {
+		return // temp already removed and audited
+	}
+	_ = os.Remove(w.tmpPath)
+	audit(w.user, w.remote, "put_fail", w.rel, "", w.maxEnd, cause)
+}
+
+// writeAborter is implemented by writers that can discard an upload.
+type writeAborter interface {
+	Abort(cause error)
+}
+
 var _ io.WriterAt = (*atomicQuotaWriterAt)(nil)
 var _ io.Closer = (*atomicQuotaWriterAt)(nil)
+var _ writeAborter = (*atomicQuotaWriterAt)(nil)
 
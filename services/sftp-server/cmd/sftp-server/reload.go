@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Configuration reload (SIGHUP) and "sftp-server config check".
+//
+// On SIGHUP the environment and config file are read and validated again.
+// If anything is wrong nothing changes. Otherwise the settings below take
+// effect without dropping sessions: new connections get the new state,
+// running sessions keep their quotas and timeouts, and bandwidth limits
+// change for everyone (see throttle.update). Other settings (listen
+// address, Vault, data root, lockout, metrics, ...) need a restart; a
+// reload that changes them logs a warning and keeps the old value.
+
+// reloadableFields are the config fields SIGHUP applies.
+var reloadableFields = map[string]bool{
+	// quotas, listings, checksums
+	"DefaultQuotaBytes":  true,
+	"DefaultQuotaFiles":  true,
+	"ListSort":           true,
+	"ListMaxEntries":     true,
+	"ChecksumAlgorithms": true,
+	"ChecksumStore":      true,
+	// limits
+	"ThrottleUploadBPS":   true,
+	"ThrottleDownloadBPS": true,
+	"ThrottleCIDRs":       true,
+	"IdleTimeout":         true,
+	"MaxSessionDuration":  true,
+	"KeepaliveInterval":   true,
+	"KeepaliveMaxMisses":  true,
+	// account lifecycle
+	"InactivityDays": true,
+	// event hooks (re-read even if the path is unchanged)
+	"HooksConfigPath": true,
+	// SSH
+	"PasswordAuthEnabled":  true,
+	"SCPEnabled":           true,
+	"ExecCommands":         true,
+	"Crypto":               true,
+	"HostKeyPaths":         true,
+	"HostKeyAnnouncePaths": true,
+}
+
+// serverState is what new connections are served with.
+type serverState struct {
+	cfg      config
+	hostKeys *hostKeySet
+	sshCfg   *ssh.ServerConfig
+}
+
+// mergeReload returns old with the reloadable fields of next, and the names
+// of other fields that differ.
+func mergeReload(old, next config) (config, []string) {
+	merged := old
+	mv, nv, ov := reflect.ValueOf(&merged).Elem(), reflect.ValueOf(next), reflect.ValueOf(old)
+	var ignored []string
+	for i := 0; i < nv.NumField(); i++ {
+		name := nv.Type().Field(i).Name
+		if reloadableFields[name] {
+			mv.Field(i).Set(nv.Field(i))
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			ignored = append(ignored, name)
+		}
+	}
+	sort.Strings(ignored)
+	return merged, ignored
+}
+
+func reloadConfig(path string, state *atomic.Pointer[serverState], newSSHConfig func(config, *hostKeySet) *ssh.ServerConfig, limits *throttle) error {
+	next, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	old := state.Load()
+	cfg, ignored := mergeReload(old.cfg, next)
+
+	hostKeys, err := loadHostKeys(cfg.HostKeyPaths, cfg.HostKeyAnnouncePaths, cfg.Crypto.HostKeyAlgos)
+	if err != nil {
+		return fmt.Errorf("host keys: %w", err)
+	}
+	var hooks []hookConfig
+	if cfg.HooksConfigPath != "" {
+		if hooks, err = loadHooksConfig(cfg.HooksConfigPath); err != nil {
+			return fmt.Errorf("event hooks: %w", err)
+		}
+	}
+
+	reloadEventHooks(hooks)
+	limits.update(cfg)
+	state.Store(&serverState{cfg: cfg, hostKeys: hostKeys, sshCfg: newSSHConfig(cfg, hostKeys)})
+
+	if len(ignored) > 0 {
+		log.Printf("config reload: restart needed to apply %s", strings.Join(ignored, ", "))
+	}
+	cfg.Crypto.logPolicy(hostKeys)
+	audit("", "", "config_reload", path, "", 0, nil)
+	return nil
+}
+
+// configCommand implements "sftp-server config check [-config file]": it
+// loads and validates everything the server would at startup (settings,
+// host keys, hooks file) without serving. Returns the exit code.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: sftp-server config check [-config file]")
+		return 2
+	}
+	path := os.Getenv("CONFIG_FILE")
+	for i := 1; i < len(args); i++ {
+		switch a := args[i]; {
+		case (a == "-config" || a == "--config") && i+1 < len(args):
+			path = args[i+1]
+			i++
+		case strings.HasPrefix(a, "-config=") || strings.HasPrefix(a, "--config="):
+			_, path, _ = strings.Cut(a, "=")
+		default:
+			fmt.Fprintf(os.Stderr, "config check: unexpected argument %q\n", a)
+			return 2
+		}
+	}
+
+	var problems []string
+	cfg, err := loadConfig(path)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		if _, err := loadHostKeys(cfg.HostKeyPaths, cfg.HostKeyAnnouncePaths, cfg.Crypto.HostKeyAlgos); err != nil {
+			problems = append(problems, "host keys: "+err.Error())
+		}
+		if cfg.HooksConfigPath != "" {
+			if _, err := loadHooksConfig(cfg.HooksConfigPath); err != nil {
+				problems = append(problems, "HOOKS_CONFIG: "+err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "configuration invalid:\n%s\n", strings.Join(problems, "\n"))
+		return 1
+	}
+	src := "environment"
+	if path != "" {
+		src = path + " and environment"
+	}
+	fmt.Printf("configuration OK (%s)\n", src)
+	return 0
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// Legacy SCP ("scp -O", or any scp older than OpenSSH 9.0), server side.
+//
+// The client runs "scp -t TARGET" to upload (we are the sink) or
+// "scp -f PATH..." to download (we are the source); -r, -p and -d work as
+// in OpenSSH. Files go through jailedFS like SFTP transfers: uploads are
+// written to a temp file and committed on close (quota, WORM, checksums),
+// downloads are throttled, and everything is audited. Only a trailing
+// wildcard in a source path's last element is expanded (*, ?, [...]), since
+// there is no shell.
+//
+// Protocol: every control line and every file body is acknowledged with a
+// single byte, 0 for OK, 1 followed by a message line for a warning (this
+// file failed, carry on) or 2 and a message for a fatal error.
+
+const scpMaxDepth = 64
+
+// SFTP attribute flags (filexfer-02) for the Setstat requests -p makes.
+const (
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+)
+
+// errSCPFatal aborts the transfer after the client was told.
+var errSCPFatal = errors.New("scp: fatal error")
+
+// scpMaxLine bounds a control line, so a client cannot make us buffer an
+// endless one.
+const scpMaxLine = 4096
+
+type scpSession struct {
+	execEnv
+	r         *bufio.Reader
+	recursive bool
+	preserve  bool
+	targetDir bool
+	failed    bool // some file failed; exit status 1
+}
+
+func runSCP(e execEnv, args []string) int {
+	s := &scpSession{execEnv: e, r: bufio.NewReaderSize(e.stdin, scpMaxLine)}
+	var sink, source bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		a := args[0]
+		args = args[1:]
+		if a == "--" {
+			break
+		}
+		for _, f := range a[1:] {
+			switch f {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'r':
+				s.recursive = true
+			case 'p':
+				s.preserve = true
+			case 'd':
+				s.targetDir = true
+			case 'v', 'q':
+			default:
+				e.errorf("scp", "unsupported option -%c", f)
+				return 2
+			}
+		}
+	}
+	var err error
+	switch {
+	case sink == source || len(args) == 0:
+		e.errorf("scp", "usage: scp -t|-f [-r] [-p] [-d] path...")
+		return 2
+	case sink:
+		if len(args) != 1 {
+			s.fatal("ambiguous target")
+			return 1
+		}
+		err = s.sink(args[0])
+	default:
+		err = s.source(args)
+	}
+	if err != nil || s.failed {
+		return 1
+	}
+	return 0
+}
+
+// ack sends the OK byte.
+func (s *scpSession) ack() error {
+	_, err := s.stdout.Write([]byte{0})
+	return err
+}
+
+// warn tells the client one file failed and records it for the exit status.
+func (s *scpSession) warn(format string, args ...any) {
+	s.failed = true
+	_, _ = fmt.Fprintf(s.stdout, "\x01scp: %s\n", fmt.Sprintf(format, args...))
+}
+
+// fatal tells the client the transfer is over and returns errSCPFatal.
+func (s *scpSession) fatal(format string, args ...any) error {
+	s.failed = true
+	_, _ = fmt.Fprintf(s.stdout, "\x02scp: %s\n", fmt.Sprintf(format, args...))
+	return errSCPFatal
+}
+
+// readAck reads the client's reply byte; a warning or error from the client
+// is returned as an error.
+func (s *scpSession) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.readLine()
+	return fmt.Errorf("client: %s", strings.TrimSpace(msg))
+}
+
+// readLine reads up to and including '\n', like ReadString, but fails with
+// bufio.ErrBufferFull after scpMaxLine bytes.
+func (s *scpSession) readLine() (string, error) {
+	b, err := s.r.ReadSlice('\n')
+	return string(b), err
+}
+
+// ---- sink (upload) ----
+
+func (s *scpSession) sink(target string) error {
+	isDir := false
+	if info, err := s.stat(target); err == nil && info.IsDir() {
+		isDir = true
+	}
+	if s.targetDir && !isDir {
+		return s.fatal("%s: Not a directory", target)
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	return s.sinkLoop(target, isDir, 0)
+}
+
+// sinkLoop receives entries into dir (or, at the top level of a single-file
+// copy, into the file dir itself) until "E" or end of input.
+func (s *scpSession) sinkLoop(dir string, isDir bool, depth int) error {
+	var times *[2]int64 // mtime, atime from the last "T" line
+	for {
+		line, err := s.readLine()
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return s.fatal("protocol error: line longer than %d bytes", scpMaxLine)
+		}
+		if err == io.EOF && line == "" {
+			if depth > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return s.fatal("protocol error: empty line")
+		}
+
+		switch line[0] {
+		case 1, 2: // client-side error about a file
+			s.failed = true
+			fmt.Fprintln(s.stderr, line[1:])
+			if line[0] == 2 {
+				return errSCPFatal
+			}
+			continue
+
+		case 'E':
+			if depth == 0 {
+				return s.fatal("protocol error: unexpected E")
+			}
+			return s.ack()
+
+		case 'T':
+			var t [2]int64
+			var mu, au int64
+			if n, _ := fmt.Sscanf(line[1:], "%d %d %d %d", &t[0], &mu, &t[1], &au); n != 4 {
+				return s.fatal("protocol error: bad times")
+			}
+			times = &t
+			if err := s.ack(); err != nil {
+				return err
+			}
+			continue
+
+		case 'C', 'D':
+		default:
+			return s.fatal("protocol error: unexpected %q", line)
+		}
+
+		mode, size, name, err := parseSCPHeader(line)
+		if err != nil {
+			return s.fatal("protocol error: %v", err)
+		}
+		target := dir
+		if isDir {
+			target = path.Join(dir, name)
+		}
+
+		if line[0] == 'D' {
+			if !s.recursive {
+				return s.fatal("received directory without -r")
+			}
+			if depth >= scpMaxDepth {
+				return s.fatal("%s: directories nested too deeply", target)
+			}
+			info, err := s.stat(target)
+			switch {
+			case err == nil && !info.IsDir():
+				return s.fatal("%s: Not a directory", target)
+			case err != nil:
+				if err := s.fs.Filecmd(sftp.NewRequest("Mkdir", target)); err != nil {
+					return s.fatal("%s: %s", target, errText(err))
+				}
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+			if err := s.sinkLoop(target, true, depth+1); err != nil {
+				return err
+			}
+			s.setAttrs(target, mode, times)
+			times = nil
+			continue
+		}
+
+		if err := s.ack(); err != nil {
+			return err
+		}
+		if err := s.receiveFile(target, size, mode, times); err != nil {
+			return err
+		}
+		times = nil
+	}
+}
+
+// parseSCPHeader parses "C0644 123 name" or "D0755 0 name". Names must be
+// a single path element.
+func parseSCPHeader(line string) (os.FileMode, int64, string, error) {
+	f := strings.SplitN(line[1:], " ", 3)
+	if len(f) != 3 {
+		return 0, 0, "", fmt.Errorf("bad header %q", line)
+	}
+	mode, err := strconv.ParseUint(f[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad mode %q", f[0])
+	}
+	size, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("bad size %q", f[1])
+	}
+	name := f[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("unexpected filename %q", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// receiveFile reads size bytes into target. Failures after the header are
+// warnings: the rest of the data is still read so the stream stays in sync.
+// An upload cut short, failed or reported as failed by the client is
+// discarded, never committed.
+func (s *scpSession) receiveFile(target string, size int64, mode os.FileMode, times *[2]int64) error {
+	req := sftp.NewRequest("Put", target).WithContext(s.ctx)
+	w, werr := s.fs.Filewrite(req)
+	abort := func(cause error) {
+		if a, ok := w.(writeAborter); ok {
+			a.Abort(cause)
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	var off int64
+	for off < size {
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+		if m, err := io.ReadFull(s.r, buf[:n]); err != nil {
+			abort(fmt.Errorf("upload cut short after %d of %d bytes: %w", off+int64(m), size, err))
+			return err
+		}
+		if werr == nil {
+			_, werr = w.WriteAt(buf[:n], off)
+		}
+		off += n
+	}
+	ackErr := s.readAck()
+	switch {
+	case werr != nil:
+		abort(werr)
+	case ackErr != nil:
+		abort(ackErr)
+		werr = ackErr
+	default:
+		if c, ok := w.(io.Closer); ok {
+			werr = c.Close()
+		}
+	}
+	if werr != nil {
+		s.warn("%s: %s", target, errText(werr))
+		return nil
+	}
+	s.setAttrs(target, mode, times)
+	return s.ack()
+}
+
+// setAttrs applies the mode and times sent with -p. Without -p the server's
+// defaults stand.
+func (s *scpSession) setAttrs(target string, mode os.FileMode, times *[2]int64) {
+	if !s.preserve {
+		return
+	}
+	attrs := binary.BigEndian.AppendUint32(nil, uint32(mode))
+	flags := uint32(sftpAttrPermissions)
+	if times != nil {
+		attrs = binary.BigEndian.AppendUint32(attrs, uint32(times[1]))
+		attrs = binary.BigEndian.AppendUint32(attrs, uint32(times[0]))
+		flags |= sftpAttrACModTime
+	}
+	req := sftp.NewRequest("Setstat", target)
+	req.Flags = flags
+	req.Attrs = attrs
+	if err := s.fs.Filecmd(req); err != nil {
+		fmt.Fprintf(s.stderr, "scp: %s: set attributes: %s\n", target, errText(err))
+	}
+}
+
+// ---- source (download) ----
+
+func (s *scpSession) source(paths []string) error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		matches, err := s.glob(p)
+		if err != nil {
+			s.warn("%s: %s", p, errText(err))
+			continue
+		}
+		for _, m := range matches {
+			if err := s.send(m, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// glob expands wildcards in the last element of p.
+func (s *scpSession) glob(p string) ([]string, error) {
+	dir, pattern := path.Split(p)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{p}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	listDir := dir
+	if listDir == "" {
+		listDir = "."
+	}
+	entries, err := s.list(listDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(pattern, ".") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, e.Name()); ok {
+			out = append(out, dir+e.Name())
+		}
+	}
+	if len(out) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return out, nil
+}
+
+func (s *scpSession) send(p string, depth int) error {
+	info, err := s.stat(p)
+	if err != nil {
+		s.warn("%s: %s", p, errText(err))
+		return nil
+	}
+	if info.IsDir() && !s.recursive {
+		s.warn("%s: not a regular file", p)
+		return nil
+	}
+	if s.preserve {
+		mt := info.ModTime().Unix()
+		if _, err := fmt.Fprintf(s.stdout, "T%d 0 %d 0\n", mt, mt); err != nil {
+			return err
+		}
+		if err := s.readAck(); err != nil {
+			return err
+		}
+	}
+	name := path.Base(p)
+	if info.IsDir() {
+		return s.sendDir(p, name, info, depth)
+	}
+
+	if _, err := fmt.Fprintf(s.stdout, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), name); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		// the client can't take this one (e.g. local write error)
+		s.failed = true
+		fmt.Fprintf(s.stderr, "scp: %s: %v\n", p, err)
+		return nil
+	}
+
+	// Once the header is out exactly size bytes must follow, so on a read
+	// error the rest is padded and a warning sent instead of the OK byte.
+	var rerr error
+	r, err := s.open(p)
+	if err != nil {
+		rerr = err
+	}
+	var off int64
+	buf := make([]byte, 32*1024)
+	for off < info.Size() {
+		n := int64(len(buf))
+		if info.Size()-off < n {
+			n = info.Size() - off
+		}
+		chunk := buf[:n]
+		if rerr == nil {
+			var got int
+			got, rerr = r.ReadAt(chunk, off)
+			if rerr == io.EOF && int64(got) == n {
+				rerr = nil
+			}
+			clear(chunk[got:])
+		} else {
+			clear(chunk)
+		}
+		if _, err := s.stdout.Write(chunk); err != nil {
+			if r != nil {
+				closeReader(r)
+			}
+			return err
+		}
+		off += n
+	}
+	if r != nil {
+		closeReader(r)
+	}
+	if rerr != nil {
+		s.warn("%s: %s", p, errText(rerr))
+	} else if err := s.ack(); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		s.failed = true
+		fmt.Fprintf(s.stderr, "scp: %s: %v\n", p, err)
+	}
+	return nil
+}
+
+func (s *scpSession) sendDir(p, name string, info os.FileInfo, depth int) error {
+	if depth >= scpMaxDepth {
+		s.warn("%s: directories nested too deeply", p)
+		return nil
+	}
+	entries, err := s.list(p)
+	if err != nil {
+		s.warn("%s: %s", p, errText(err))
+		return nil
+	}
+	if _, err := fmt.Fprintf(s.stdout, "D%04o 0 %s\n", info.Mode().Perm(), name); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		s.failed = true
+		fmt.Fprintf(s.stderr, "scp: %s: %v\n", p, err)
+		return nil
+	}
+	for _, e := range entries {
+		if err := s.send(path.Join(p, e.Name()), depth+1); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(s.stdout, "E\n"); err != nil {
+		return err
+	}
+	return s.readAck()
+}
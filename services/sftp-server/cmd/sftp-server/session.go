@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session lifetime limits.
+//
+// A sessionMonitor watches one SSH connection and closes it when
+//
+//   - no SFTP packet has arrived for IDLE_TIMEOUT ("idle_timeout")
+//   - it has been open for MAX_SESSION_DURATION ("max_duration")
+//   - KEEPALIVE_MAX_MISSES keepalive@openssh.com requests in a row went
+//     unanswered ("keepalive_timeout")
+//
+// x/crypto/ssh cannot send SSH_MSG_DISCONNECT with a custom reason, so the
+// reason is written to the stderr of every open session channel (OpenSSH's
+// sftp client prints it) before the connection is closed, and recorded on
+// the session_end audit event.
+
+const (
+	EndReasonClientClosed     = "client_closed"
+	EndReasonIdleTimeout      = "idle_timeout"
+	EndReasonMaxDuration      = "max_duration"
+	EndReasonKeepaliveTimeout = "keepalive_timeout"
+)
+
+type sessionLimits struct {
+	idleTimeout        time.Duration // 0 = disabled
+	maxDuration        time.Duration // 0 = unlimited
+	keepaliveInterval  time.Duration // 0 = disabled
+	keepaliveMaxMisses int
+}
+
+func sessionLimitsFromConfig(cfg config) sessionLimits {
+	return sessionLimits{
+		idleTimeout:        cfg.IdleTimeout,
+		maxDuration:        cfg.MaxSessionDuration,
+		keepaliveInterval:  cfg.KeepaliveInterval,
+		keepaliveMaxMisses: cfg.KeepaliveMaxMisses,
+	}
+}
+
+type sessionMonitor struct {
+	conn   ssh.Conn
+	limits sessionLimits
+	start  time.Time
+
+	lastActivity atomic.Int64 // unix nanos
+
+	mu       sync.Mutex
+	channels map[ssh.Channel]struct{}
+	reason   string
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newSessionMonitor(conn ssh.Conn, limits sessionLimits) *sessionMonitor {
+	m := &sessionMonitor{
+		conn:     conn,
+		limits:   limits,
+		start:    time.Now(),
+		channels: map[ssh.Channel]struct{}{},
+		done:     make(chan struct{}),
+	}
+	m.touch()
+	go m.watch()
+	if limits.keepaliveInterval > 0 {
+		go m.keepalive()
+	}
+	return m
+}
+
+func (m *sessionMonitor) touch() {
+	m.lastActivity.Store(time.Now().UnixNano())
+}
+
+// track registers ch for disconnect messages and returns it wrapped so that
+// every read from the client counts as activity.
+func (m *sessionMonitor) track(ch ssh.Channel) ssh.Channel {
+	m.mu.Lock()
+	m.channels[ch] = struct{}{}
+	m.mu.Unlock()
+	return &activityChannel{Channel: ch, mon: m}
+}
+
+func (m *sessionMonitor) untrack(ch ssh.Channel) {
+	m.mu.Lock()
+	delete(m.channels, ch)
+	m.mu.Unlock()
+}
+
+// end closes the connection with reason; only the first call has effect.
+func (m *sessionMonitor) end(reason string) {
+	m.mu.Lock()
+	if m.reason != "" {
+		m.mu.Unlock()
+		return
+	}
+	m.reason = reason
+	chans := make([]ssh.Channel, 0, len(m.channels))
+	for ch := range m.channels {
+		chans = append(chans, ch)
+	}
+	m.mu.Unlock()
+
+	msg := fmt.Sprintf("sftp-server: closing session: %s\n", reason)
+	for _, ch := range chans {
+		_, _ = ch.Stderr().Write([]byte(msg))
+	}
+	_ = m.conn.Close()
+}
+
+// stop ends the background goroutines and returns why the session ended.
+func (m *sessionMonitor) stop() string {
+	m.once.Do(func() { close(m.done) })
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reason == "" {
+		m.reason = EndReasonClientClosed
+	}
+	return m.reason
+}
+
+func (m *sessionMonitor) watch() {
+	tick := time.Second
+	if m.limits.idleTimeout > 0 && m.limits.idleTimeout/4 < tick {
+		tick = max(m.limits.idleTimeout/4, 10*time.Millisecond)
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-t.C:
+			if d := m.limits.maxDuration; d > 0 && now.Sub(m.start) >= d {
+				m.end(EndReasonMaxDuration)
+				return
+			}
+			if d := m.limits.idleTimeout; d > 0 && now.Sub(time.Unix(0, m.lastActivity.Load())) >= d {
+				m.end(EndReasonIdleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// keepalive sends keepalive@openssh.com every interval. Any reply, including
+// failure, proves the peer is alive; a request still pending when the next
+// one is due counts as a miss.
+func (m *sessionMonitor) keepalive() {
+	t := time.NewTicker(m.limits.keepaliveInterval)
+	defer t.Stop()
+
+	replied := make(chan struct{}, 1)
+	pending := false
+	misses := 0
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-replied:
+			pending = false
+			misses = 0
+		case <-t.C:
+			if pending {
+				misses++
+				if m.limits.keepaliveMaxMisses > 0 && misses >= m.limits.keepaliveMaxMisses {
+					m.end(EndReasonKeepaliveTimeout)
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				if _, _, err := m.conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+					return // connection gone; watch/stop will clean up
+				}
+				select {
+				case replied <- struct{}{}:
+				default:
+				}
+			}()
+		}
+	}
+}
+
+type activityChannel struct {
+	ssh.Channel
+	mon *sessionMonitor
+}
+
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.mon.touch()
+	}
+	return n, err
+}
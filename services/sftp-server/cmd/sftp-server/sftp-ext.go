@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types used by sftpExtMux (draft-ietf-secsh-filexfer-02).
+const (
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpOpendir       = 11
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// SSH_FX_* status codes for replies written by extension handlers.
+const (
+	fxOK               = 0
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// extHandler answers one SFTP extended request. payload starts right after
+// the extension name. It returns the reply packet body (type byte onwards,
+// without id) or an error that is sent back as SSH_FXP_STATUS.
+type extHandler func(m *sftpExtMux, payload []byte) ([]byte, error)
+
+// sftpExtMux sits between the SSH channel and pkg/sftp's RequestServer. It
+// answers the extended requests the request server does not implement
+// (check-file, copy-data, ...) and forwards everything else untouched.
+//
+// It watches OPEN/HANDLE/CLOSE traffic so handle-based extensions can map a
+// client handle back to its path, and appends its extensions to the
+// server's VERSION packet.
+type sftpExtMux struct {
+	ch ssh.Channel
+	fs jailedFS
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	handlers map[string]extHandler
+	names    []string
+
+	// Outgoing: pkg/sftp writes header and payload separately, so packets
+	// are reassembled before being written, letting replies interleave.
+	wmu  sync.Mutex
+	wbuf []byte
+
+	mu          sync.Mutex
+	pendingOpen map[uint32]string // request id -> path of OPEN/OPENDIR
+	handles     map[string]string // handle -> path
+}
+
+func newSFTPExtMux(ch ssh.Channel, fs jailedFS) *sftpExtMux {
+	pr, pw := io.Pipe()
+	m := &sftpExtMux{
+		ch:          ch,
+		fs:          fs,
+		pr:          pr,
+		pw:          pw,
+		handlers:    map[string]extHandler{},
+		pendingOpen: map[uint32]string{},
+		handles:     map[string]string{},
+	}
+	m.register("check-file-name", checkFileName)
+	m.register("check-file-handle", checkFileHandle)
+	m.register("copy-data", copyData)
+
+	go m.readLoop()
+	return m
+}
+
+func (m *sftpExtMux) register(name string, h extHandler) {
+	m.handlers[name] = h
+	m.names = append(m.names, name)
+}
+
+// --- io.ReadWriteCloser for sftp.NewRequestServer ---
+
+func (m *sftpExtMux) Read(p []byte) (int, error) { return m.pr.Read(p) }
+
+func (m *sftpExtMux) Write(p []byte) (int, error) {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	m.wbuf = append(m.wbuf, p...)
+	for len(m.wbuf) >= 4 {
+		n := int(binary.BigEndian.Uint32(m.wbuf[:4]))
+		if len(m.wbuf) < 4+n {
+			break
+		}
+		pkt := m.outgoing(m.wbuf[4 : 4+n])
+		if err := m.writePacketLocked(pkt); err != nil {
+			return 0, err
+		}
+		m.wbuf = m.wbuf[4+n:]
+	}
+	if len(m.wbuf) == 0 {
+		m.wbuf = nil
+	}
+	return len(p), nil
+}
+
+func (m *sftpExtMux) Close() error {
+	_ = m.pr.Close()
+	return m.ch.Close()
+}
+
+func (m *sftpExtMux) writePacketLocked(body []byte) error {
+	hdr := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(hdr, uint32(len(body)))
+	_, err := m.ch.Write(append(hdr, body...))
+	return err
+}
+
+func (m *sftpExtMux) writePacket(body []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.writePacketLocked(body)
+}
+
+// outgoing inspects a server->client packet and returns what to send.
+func (m *sftpExtMux) outgoing(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	switch body[0] {
+	case fxpVersion:
+		out := append([]byte(nil), body...)
+		for _, name := range m.names {
+			out = appendString(out, name)
+			out = appendString(out, "1")
+		}
+		return out
+
+	case fxpHandle:
+		r := sshReader{b: body[1:]}
+		id := r.uint32()
+		handle := r.string()
+		if r.err == nil {
+			m.mu.Lock()
+			if p, ok := m.pendingOpen[id]; ok {
+				m.handles[handle] = p
+				delete(m.pendingOpen, id)
+			}
+			m.mu.Unlock()
+		}
+
+	case fxpStatus:
+		r := sshReader{b: body[1:]}
+		id := r.uint32()
+		if r.err == nil {
+			m.mu.Lock()
+			delete(m.pendingOpen, id)
+			m.mu.Unlock()
+		}
+	}
+	return body
+}
+
+// readLoop reads client->server packets from the channel.
+func (m *sftpExtMux) readLoop() {
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(m.ch, hdr); err != nil {
+			m.closeRead(err)
+			return
+		}
+		n := binary.BigEndian.Uint32(hdr)
+		if n == 0 || n > 1<<20 {
+			m.closeRead(fmt.Errorf("invalid sftp packet length %d", n))
+			return
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(m.ch, body); err != nil {
+			m.closeRead(err)
+			return
+		}
+
+		if m.incoming(body) {
+			continue
+		}
+		if _, err := m.pw.Write(append(hdr, body...)); err != nil {
+			return
+		}
+	}
+}
+
+func (m *sftpExtMux) closeRead(err error) {
+	if errors.Is(err, io.EOF) {
+		_ = m.pw.Close()
+		return
+	}
+	_ = m.pw.CloseWithError(err)
+}
+
+// incoming inspects a client->server packet; it returns true when the
+// packet was answered here and must not be forwarded.
+func (m *sftpExtMux) incoming(body []byte) bool {
+	r := sshReader{b: body[1:]}
+	switch body[0] {
+	case fxpOpen, fxpOpendir:
+		id := r.uint32()
+		p := r.string()
+		if r.err == nil {
+			m.mu.Lock()
+			m.pendingOpen[id] = p
+			m.mu.Unlock()
+		}
+
+	case fxpClose:
+		_ = r.uint32()
+		handle := r.string()
+		if r.err == nil {
+			m.mu.Lock()
+			delete(m.handles, handle)
+			m.mu.Unlock()
+		}
+
+	case fxpExtended:
+		id := r.uint32()
+		name := r.string()
+		if r.err != nil {
+			return false
+		}
+		h, ok := m.handlers[name]
+		if !ok {
+			return false
+		}
+		go m.answer(id, h, r.b)
+		return true
+	}
+	return false
+}
+
+func (m *sftpExtMux) answer(id uint32, h extHandler, payload []byte) {
+	reply, err := h(m, payload)
+	if err != nil {
+		_ = m.writePacket(statusPacket(id, err))
+		return
+	}
+	out := []byte{reply[0]}
+	out = binary.BigEndian.AppendUint32(out, id)
+	out = append(out, reply[1:]...)
+	_ = m.writePacket(out)
+}
+
+func (m *sftpExtMux) handlePath(handle string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.handles[handle]
+	return p, ok
+}
+
+// statusPacket maps err to an SSH_FXP_STATUS body.
+func statusPacket(id uint32, err error) []byte {
+	code := uint32(fxFailure)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = fxNoSuchFile
+	case errors.Is(err, os.ErrPermission), errors.Is(err, sftp.ErrSSHFxPermissionDenied):
+		code = fxPermissionDenied
+	case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		code = fxOpUnsupported
+	case errors.Is(err, errBadMessage):
+		code = fxBadMessage
+	}
+	out := []byte{fxpStatus}
+	out = binary.BigEndian.AppendUint32(out, id)
+	out = binary.BigEndian.AppendUint32(out, code)
+	out = appendString(out, err.Error())
+	out = appendString(out, "")
+	return out
+}
+
+// statusOK is a successful SSH_FXP_STATUS reply body (without id).
+func statusOK() []byte {
+	out := []byte{fxpStatus}
+	out = binary.BigEndian.AppendUint32(out, fxOK)
+	out = appendString(out, "Success")
+	return appendString(out, "")
+}
+
+var errBadMessage = errors.New("bad message")
+
+// --- wire helpers ---
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sshReader) uint64() uint64 {
+	if r.err != nil || len(r.b) < 8 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sshReader) string() string {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.b)) < n {
+		r.err = errBadMessage
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// --- check-file (draft-ietf-secsh-filexfer-extensions-00, section 3) ---
+
+// checkFileAlgorithms in order of preference when the client offers several.
+var checkFileAlgorithms = []string{"sha256", "sha512", "sha1", "md5", "crc32"}
+
+func checkFileName(m *sftpExtMux, payload []byte) ([]byte, error) {
+	r := sshReader{b: payload}
+	name := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	abs, rel, err := m.fs.clean(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.checkFile(abs, rel, &r)
+}
+
+func checkFileHandle(m *sftpExtMux, payload []byte) ([]byte, error) {
+	r := sshReader{b: payload}
+	handle := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	p, ok := m.handlePath(handle)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown handle", os.ErrNotExist)
+	}
+	abs, rel, err := m.fs.clean(p)
+	if err != nil {
+		return nil, err
+	}
+	return m.checkFile(abs, rel, &r)
+}
+
+// checkFile parses the rest of a check-file request and hashes the range.
+// Whole-file requests are served from the stored upload checksum if present.
+func (m *sftpExtMux) checkFile(abs, rel string, r *sshReader) ([]byte, error) {
+	algList := r.string()
+	start := r.uint64()
+	length := r.uint64()
+	blockSize := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if blockSize != 0 && blockSize < 256 {
+		return nil, fmt.Errorf("%w: block size must be 0 or >= 256", errBadMessage)
+	}
+
+	if err := m.fs.permit(PermRead, "check_file", rel); err != nil {
+		return nil, err
+	}
+
+	alg := ""
+	offered := strings.Split(algList, ",")
+	for _, a := range checkFileAlgorithms {
+		if containsString(offered, a) {
+			alg = a
+			break
+		}
+	}
+	if alg == "" {
+		return nil, fmt.Errorf("%w: no supported hash algorithm in %q", sftp.ErrSSHFxOpUnsupported, algList)
+	}
+	auditCheck := func(err error) {
+		auditEv(auditEvent{User: m.fs.user, Remote: m.fs.remote, Action: "check_file", Path: rel, Algorithm: alg}, err)
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		auditCheck(err)
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", rel)
+	}
+
+	var digests []byte
+	if start == 0 && length == 0 && blockSize == 0 {
+		if v, ok := m.fs.sums.load(abs)[alg]; ok {
+			digests, _ = hex.DecodeString(v)
+		}
+	}
+	if digests == nil {
+		digests, err = hashRange(f, alg, info.Size(), int64(start), int64(length), int64(blockSize))
+		if err != nil {
+			auditCheck(err)
+			return nil, err
+		}
+	}
+
+	auditCheck(nil)
+
+	out := []byte{fxpExtendedReply}
+	out = appendString(out, "check-file")
+	out = appendString(out, alg)
+	return append(out, digests...), nil
+}
+
+// hashRange hashes [start, start+length) of f (length 0 = to EOF), one
+// digest per blockSize bytes or a single digest when blockSize is 0.
+func hashRange(f *os.File, alg string, size, start, length, blockSize int64) ([]byte, error) {
+	if start > size {
+		return nil, fmt.Errorf("start offset beyond end of file")
+	}
+	end := size
+	if length > 0 && start+length < size {
+		end = start + length
+	}
+	if blockSize == 0 {
+		blockSize = end - start
+	}
+
+	var out []byte
+	for off := start; off < end || (off == start && start == end); off += blockSize {
+		n := blockSize
+		if off+n > end {
+			n = end - off
+		}
+		h := newHash(alg)
+		if _, err := io.Copy(h, io.NewSectionReader(f, off, n)); err != nil {
+			return nil, err
+		}
+		out = h.Sum(out)
+		if n == 0 {
+			break
+		}
+	}
+	return out, nil
+}
+
+// --- copy-data (draft-ietf-secsh-filexfer-extensions-00, section 7) ---
+
+// copyData copies a range between two open handles on the server. The
+// destination must be a handle this session opened for writing, and the
+// bytes go through its atomicQuotaWriterAt, so quota, WORM and checksums
+// apply exactly as for a client upload.
+func copyData(m *sftpExtMux, payload []byte) ([]byte, error) {
+	r := sshReader{b: payload}
+	readHandle := r.string()
+	readOff := r.uint64()
+	readLen := r.uint64()
+	writeHandle := r.string()
+	writeOff := r.uint64()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	srcPath, ok1 := m.handlePath(readHandle)
+	dstPath, ok2 := m.handlePath(writeHandle)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%w: unknown handle", os.ErrNotExist)
+	}
+	srcAbs, srcRel, err := m.fs.clean(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	dstAbs, dstRel, err := m.fs.clean(dstPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.fs.permit(PermRead, "copy_data", srcRel); err != nil {
+		return nil, err
+	}
+
+	w, ok := m.fs.writers.get(dstAbs)
+	if !ok {
+		err := fmt.Errorf("%w: write handle is not open for writing", sftp.ErrSSHFxPermissionDenied)
+		audit(m.fs.user, m.fs.remote, "copy_data", srcRel, dstRel, 0, err)
+		return nil, err
+	}
+
+	src, err := os.Open(srcAbs)
+	if err != nil {
+		audit(m.fs.user, m.fs.remote, "copy_data", srcRel, dstRel, 0, err)
+		return nil, err
+	}
+	defer src.Close()
+
+	var copied int64
+	buf := make([]byte, 64<<10)
+	for readLen == 0 || uint64(copied) < readLen {
+		chunk := buf
+		if readLen > 0 && readLen-uint64(copied) < uint64(len(chunk)) {
+			chunk = chunk[:readLen-uint64(copied)]
+		}
+		n, rErr := src.ReadAt(chunk, int64(readOff)+copied)
+		if n > 0 {
+			if _, wErr := w.WriteAt(chunk[:n], int64(writeOff)+copied); wErr != nil {
+				audit(m.fs.user, m.fs.remote, "copy_data", srcRel, dstRel, copied, wErr)
+				return nil, wErr
+			}
+			copied += int64(n)
+		}
+		if errors.Is(rErr, io.EOF) {
+			break
+		}
+		if rErr != nil {
+			audit(m.fs.user, m.fs.remote, "copy_data", srcRel, dstRel, copied, rErr)
+			return nil, rErr
+		}
+	}
+
+	audit(m.fs.user, m.fs.remote, "copy_data", srcRel, dstRel, copied, nil)
+	return statusOK(), nil
+}
@@ -16,7 +16,7 @@ func serveSFTP(ch ssh.Channel, fs jailedFS) {
 		FileList: fs,
 	}
 
-	server := sftp.NewRequestServer(ch, handlers)
+	server := sftp.NewRequestServer(newSFTPExtMux(ch, fs), handlers)
 
 	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
 		audit(fs.user, fs.remote, "sftp_serve_error", "", "", 0, err)
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+func hostStatVFS(path string) (*sftp.StatVFS, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	return &sftp.StatVFS{
+		Bsize:   uint64(st.Bsize),
+		Frsize:  uint64(st.Frsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Favail:  st.Ffree,
+		Flag:    uint64(st.Flags),
+		Namemax: uint64(st.Namelen),
+	}, nil
+}
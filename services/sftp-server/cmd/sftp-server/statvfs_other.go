@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "github.com/pkg/sftp"
+
+// hostStatVFS has no portable implementation; quotas still fill in the
+// user-visible numbers in StatVFS.
+func hostStatVFS(path string) (*sftp.StatVFS, error) {
+	return &sftp.StatVFS{Bsize: 4096, Frsize: 4096, Namemax: 255}, nil
+}
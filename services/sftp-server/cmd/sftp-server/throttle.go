@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth throttling.
+//
+// Transfers are limited by token buckets at three levels, all of which must
+// grant bytes before data moves:
+//
+//   - global (THROTTLE_UPLOAD_BPS / THROTTLE_DOWNLOAD_BPS), shared by every
+//     session on this replica
+//   - per source CIDR (THROTTLE_CIDRS), shared by all clients in the range
+//   - per user (uploadBytesPerSec / downloadBytesPerSec on the user record),
+//     shared by all of that user's sessions
+//
+// A limit of 0 means unlimited. The reader/writer returned by jailedFS is
+// wrapped in throttledReaderAt / throttledWriterAt, which also feed the
+// bytes_in/bytes_out counters and the throughput gauge.
+
+// minBurst keeps WaitN from failing on a single large SFTP packet.
+const minBurst = 256 << 10
+
+type cidrLimit struct {
+	net        *net.IPNet
+	up, down   int64
+	upL, downL *rate.Limiter
+}
+
+// parseThrottleCIDRs parses THROTTLE_CIDRS: "cidr=up/down,..." in bytes per
+// second, e.g. "203.0.113.0/24=1048576/2097152,10.0.0.0/8=0/524288".
+func parseThrottleCIDRs(raw string) ([]cidrLimit, error) {
+	var out []cidrLimit
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		cidr, limits, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want cidr=up/down", item)
+		}
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		upS, downS, ok := strings.Cut(limits, "/")
+		if !ok {
+			return nil, fmt.Errorf("%q: want cidr=up/down", item)
+		}
+		up, err1 := strconv.ParseInt(strings.TrimSpace(upS), 10, 64)
+		down, err2 := strconv.ParseInt(strings.TrimSpace(downS), 10, 64)
+		if err1 != nil || err2 != nil || up < 0 || down < 0 {
+			return nil, fmt.Errorf("%q: limits must be non-negative integers", item)
+		}
+		out = append(out, cidrLimit{net: ipnet, up: up, down: down})
+	}
+	return out, nil
+}
+
+func newLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bps), int(max(bps, minBurst)))
+}
+
+// userLimiters are one user's buckets. Entries are dropped once no
+// session uses them and the buckets have refilled, so a new session gets
+// nothing a kept one would not have given.
+type userLimiters struct {
+	up, down       *rate.Limiter
+	upBPS, downBPS int64
+	sessions       int
+}
+
+func (ul *userLimiters) idle() bool {
+	full := func(l *rate.Limiter) bool { return l == nil || l.Tokens() >= float64(l.Burst()) }
+	return ul.sessions == 0 && full(ul.up) && full(ul.down)
+}
+
+type throttle struct {
+	mu       sync.Mutex // guards all fields; update replaces up/down/cidrs
+	up, down *rate.Limiter
+	cidrs    []cidrLimit
+	users    map[string]*userLimiters
+}
+
+func newThrottle(cfg config) *throttle {
+	t := &throttle{
+		up:    newLimiter(cfg.ThrottleUploadBPS),
+		down:  newLimiter(cfg.ThrottleDownloadBPS),
+		users: map[string]*userLimiters{},
+	}
+	for _, c := range cfg.ThrottleCIDRs {
+		c.upL, c.downL = newLimiter(c.up), newLimiter(c.down)
+		t.cidrs = append(t.cidrs, c)
+	}
+	return t
+}
+
+// limiters returns the upload and download buckets that apply to a session,
+// and release, which the session calls when it ends.
+func (t *throttle) limiters(user, remote string, upBPS, downBPS int64) (up, down []*rate.Limiter, release func()) {
+	add := func(list []*rate.Limiter, l *rate.Limiter) []*rate.Limiter {
+		if l != nil {
+			list = append(list, l)
+		}
+		return list
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	up, down = add(up, t.up), add(down, t.down)
+
+	if ip := remoteIP(remote); ip != nil {
+		for _, c := range t.cidrs {
+			if c.net.Contains(ip) {
+				up, down = add(up, c.upL), add(down, c.downL)
+				break
+			}
+		}
+	}
+
+	for name, ul := range t.users {
+		if ul.idle() {
+			delete(t.users, name)
+		}
+	}
+	ul, ok := t.users[user]
+	if !ok || ul.upBPS != upBPS || ul.downBPS != downBPS {
+		// New user, or the record's limits changed since last session.
+		ul = &userLimiters{up: newLimiter(upBPS), down: newLimiter(downBPS), upBPS: upBPS, downBPS: downBPS}
+		t.users[user] = ul
+	}
+	ul.sessions++
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			t.mu.Lock()
+			ul.sessions--
+			t.mu.Unlock()
+		})
+	}
+	return add(up, ul.up), add(down, ul.down), release
+}
+
+// update applies reloaded global and CIDR limits. Existing buckets are
+// retuned in place so running transfers follow the new rate; a limit
+// added where there was none applies to new sessions only.
+func (t *throttle) update(cfg config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.up = retune(t.up, cfg.ThrottleUploadBPS)
+	t.down = retune(t.down, cfg.ThrottleDownloadBPS)
+
+	old := map[string]cidrLimit{}
+	for _, c := range t.cidrs {
+		old[c.net.String()] = c
+	}
+	t.cidrs = nil
+	for _, c := range cfg.ThrottleCIDRs {
+		prev := old[c.net.String()]
+		delete(old, c.net.String())
+		c.upL, c.downL = retune(prev.upL, c.up), retune(prev.downL, c.down)
+		t.cidrs = append(t.cidrs, c)
+	}
+	for _, c := range old { // removed ranges
+		retune(c.upL, 0)
+		retune(c.downL, 0)
+	}
+}
+
+// retune sets l to bps, or lifts it (rate.Inf) for 0. A nil l gets a new
+// limiter.
+func retune(l *rate.Limiter, bps int64) *rate.Limiter {
+	if l == nil {
+		return newLimiter(bps)
+	}
+	if bps <= 0 {
+		l.SetLimit(rate.Inf)
+		return nil
+	}
+	l.SetLimit(rate.Limit(bps))
+	l.SetBurst(int(max(bps, minBurst)))
+	return l
+}
+
+func remoteIP(remote string) net.IP {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	return net.ParseIP(host)
+}
+
+// waitAll blocks until every limiter has granted n bytes.
+func waitAll(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		for left := n; left > 0; {
+			chunk := min(left, l.Burst())
+			if err := l.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
+
+// --- throughput gauge ---
+
+var (
+	bytesInCounter  atomic.Int64
+	bytesOutCounter atomic.Int64
+)
+
+// StartThroughputSampler publishes bytes/s over the last interval to the
+// throughput gauge until ctx is done.
+func StartThroughputSampler(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		lastIn, lastOut := bytesInCounter.Load(), bytesOutCounter.Load()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			in, out := bytesInCounter.Load(), bytesOutCounter.Load()
+			secs := interval.Seconds()
+			SetThroughput("in", float64(in-lastIn)/secs)
+			SetThroughput("out", float64(out-lastOut)/secs)
+			lastIn, lastOut = in, out
+		}
+	}()
+}
+
+// --- wrappers ---
+
+type throttledReaderAt struct {
+	r        io.ReaderAt
+	ctx      context.Context
+	limiters []*rate.Limiter
+	user     string
+}
+
+func (t *throttledReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.r.ReadAt(p, off)
+	if n > 0 {
+		if wErr := waitAll(t.ctx, t.limiters, n); wErr != nil {
+			return 0, wErr
+		}
+		bytesOutCounter.Add(int64(n))
+		AddBytesOut(t.user, "success", int64(n))
+	}
+	return n, err
+}
+
+func (t *throttledReaderAt) Close() error {
+	if c, ok := t.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type throttledWriterAt struct {
+	w        io.WriterAt
+	ctx      context.Context
+	limiters []*rate.Limiter
+	user     string
+}
+
+func (t *throttledWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := waitAll(t.ctx, t.limiters, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := t.w.WriteAt(p, off)
+	if n > 0 {
+		bytesInCounter.Add(int64(n))
+		AddBytesIn(t.user, "success", int64(n))
+	}
+	return n, err
+}
+
+func (t *throttledWriterAt) Close() error {
+	if c, ok := t.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (t *throttledWriterAt) Abort(cause error) {
+	if a, ok := t.w.(writeAborter); ok {
+		a.Abort(cause)
+	}
+}
+
+var _ io.ReaderAt = (*throttledReaderAt)(nil)
+var _ io.WriterAt = (*throttledWriterAt)(nil)
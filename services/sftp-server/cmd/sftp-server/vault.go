@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -16,9 +17,46 @@ type userRecord struct {
 	Disabled   bool     `json:"disabled"`
 	RootSubdir string   `json:"rootSubdir"`
 	PublicKeys []string `json:"publicKeys"`
+	Tenant     string   `json:"tenant"`
+
+	// Groups whose defaults fill unset fields (see groups.go), and the SFTP
+	// operations allowed ("" = all; keys may narrow it further).
+	Groups        []string       `json:"groups"`
+	Permissions   string         `json:"permissions"`
+	SharedFolders []sharedFolder `json:"sharedFolders"` // from groups
+	perms         keyPerms
+
+	// Login method (see mfa.go); secrets never leave this process.
+	AuthMode     string `json:"authMode"`
+	PasswordHash string `json:"-"`
+	TOTPSecret   string `json:"-"`
+
+	// Source networks the user may connect from (empty = anywhere).
+	AllowedCIDRs []string `json:"allowedCIDRs"`
+	allowedNets  []*net.IPNet
 
 	QuotaBytes int64 `json:"quotaBytes"`
 	QuotaFiles int64 `json:"quotaFiles"`
+
+	// WORM: committed files under the whole root (Immutable) or under
+	// ImmutablePaths cannot be changed for RetentionDays (0 = forever).
+	Immutable      bool     `json:"immutable"`
+	ImmutablePaths []string `json:"immutablePaths"`
+	RetentionDays  int64    `json:"retentionDays"`
+
+	// Directory listing policy; empty/0 falls back to LIST_SORT / LIST_MAX_ENTRIES.
+	ListSort       string `json:"listSort"`
+	ListMaxEntries int64  `json:"listMaxEntries"`
+
+	// Per-user bandwidth limits in bytes/s (0 = unlimited), shared by all sessions.
+	UploadBytesPerSec   int64 `json:"uploadBytesPerSec"`
+	DownloadBytesPerSec int64 `json:"downloadBytesPerSec"`
+
+	// Account lifecycle (see lifecycle.go); zero times are unbounded.
+	ValidFrom      time.Time `json:"validFrom"`
+	ValidUntil     time.Time `json:"validUntil"`
+	InactivityDays int64     `json:"inactivityDays"`
+	UpdatedAt      time.Time `json:"updatedAt"`
 }
 
 func newVaultClient(cfg config) (*vault.Client, error) {
@@ -70,6 +108,10 @@ func loadUserFromVault(ctx context.Context, vc *vault.Client, usersPrefix, usern
 		if !ok {
 			return ur, fmt.Errorf("unexpected vault kv response: missing data field")
 		}
+		if raw == nil {
+			// Soft-deleted in admin-api: KV v2 keeps only the metadata
+			return ur, fmt.Errorf("user not found")
+		}
 
 		rawMap, ok := raw.(map[string]interface{})
 		if !ok {
@@ -127,6 +169,25 @@ func parseUserRecord(m map[string]interface{}, fallbackUsername string) (userRec
 		ur.RootSubdir = ur.Username
 	}
 
+	// tenant, groups, permissions
+	if s, err := asString(m["tenant"]); err == nil {
+		ur.Tenant = s
+	} else {
+		return ur, fmt.Errorf("invalid tenant: %w", err)
+	}
+	if v, ok := m["groups"]; ok {
+		groups, err := asStringSlice(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid groups: %w", err)
+		}
+		ur.Groups = groups
+	}
+	if s, err := asString(m["permissions"]); err == nil {
+		ur.Permissions = strings.TrimSpace(s)
+	} else {
+		return ur, fmt.Errorf("invalid permissions: %w", err)
+	}
+
 	// publicKeys
 	if v, ok := m["publicKeys"]; ok {
 		keys, err := asStringSlice(v)
@@ -135,10 +196,46 @@ func parseUserRecord(m map[string]interface{}, fallbackUsername string) (userRec
 		}
 		ur.PublicKeys = keys
 	}
-	if len(ur.PublicKeys) == 0 {
+	// authMode, passwordHash, totpSecret
+	if v, ok := m["authMode"]; ok {
+		s, err := asString(v)
+		if err != nil || !validAuthMode(s) {
+			return ur, fmt.Errorf("invalid authMode %v", v)
+		}
+		ur.AuthMode = s
+	}
+	if v, ok := m["passwordHash"]; ok {
+		s, err := asString(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid passwordHash: %w", err)
+		}
+		ur.PasswordHash = s
+	}
+	if v, ok := m["totpSecret"]; ok {
+		s, err := asString(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid totpSecret: %w", err)
+		}
+		ur.TOTPSecret = s
+	}
+
+	if len(ur.PublicKeys) == 0 && ur.PasswordHash == "" {
 		return ur, fmt.Errorf("user not found")
 	}
 
+	// allowedCIDRs (a bad entry fails the load rather than opening access)
+	if v, ok := m["allowedCIDRs"]; ok {
+		cidrs, err := asStringSlice(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid allowedCIDRs: %w", err)
+		}
+		nets, err := parseCIDRList(strings.Join(cidrs, ","))
+		if err != nil {
+			return ur, fmt.Errorf("invalid allowedCIDRs: %w", err)
+		}
+		ur.AllowedCIDRs, ur.allowedNets = cidrs, nets
+	}
+
 	// quotaBytes
 	if v, ok := m["quotaBytes"]; ok {
 		n, err := asInt64(v)
@@ -157,6 +254,108 @@ func parseUserRecord(m map[string]interface{}, fallbackUsername string) (userRec
 		ur.QuotaFiles = n
 	}
 
+	// immutable
+	if v, ok := m["immutable"]; ok {
+		b, err := asBool(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid immutable: %w", err)
+		}
+		ur.Immutable = b
+	}
+
+	// immutablePaths
+	if v, ok := m["immutablePaths"]; ok {
+		paths, err := asStringSlice(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid immutablePaths: %w", err)
+		}
+		ur.ImmutablePaths = paths
+	}
+
+	// retentionDays
+	if v, ok := m["retentionDays"]; ok {
+		n, err := asInt64(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid retentionDays: %w", err)
+		}
+		if n < 0 {
+			return ur, fmt.Errorf("invalid retentionDays: must be >= 0")
+		}
+		ur.RetentionDays = n
+	}
+
+	// listSort
+	if v, ok := m["listSort"]; ok {
+		s, err := asString(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid listSort: %w", err)
+		}
+		if !validListSort(s) {
+			return ur, fmt.Errorf("invalid listSort: %q", s)
+		}
+		ur.ListSort = s
+	}
+
+	// listMaxEntries
+	if v, ok := m["listMaxEntries"]; ok {
+		n, err := asInt64(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid listMaxEntries: %w", err)
+		}
+		ur.ListMaxEntries = n
+	}
+
+	// uploadBytesPerSec
+	if v, ok := m["uploadBytesPerSec"]; ok {
+		n, err := asInt64(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid uploadBytesPerSec: %w", err)
+		}
+		ur.UploadBytesPerSec = n
+	}
+
+	// downloadBytesPerSec
+	if v, ok := m["downloadBytesPerSec"]; ok {
+		n, err := asInt64(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid downloadBytesPerSec: %w", err)
+		}
+		ur.DownloadBytesPerSec = n
+	}
+
+	// validFrom, validUntil (a bad value fails the load rather than opening access)
+	for _, f := range []struct {
+		key string
+		dst *time.Time
+	}{{"validFrom", &ur.ValidFrom}, {"validUntil", &ur.ValidUntil}} {
+		s, err := asString(m[f.key])
+		if err != nil {
+			return ur, fmt.Errorf("invalid %s: %w", f.key, err)
+		}
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return ur, fmt.Errorf("invalid %s: %w", f.key, err)
+		}
+		*f.dst = t
+	}
+
+	// inactivityDays
+	if v, ok := m["inactivityDays"]; ok {
+		n, err := asInt64(v)
+		if err != nil {
+			return ur, fmt.Errorf("invalid inactivityDays: %w", err)
+		}
+		ur.InactivityDays = n
+	}
+
+	// updatedAt (informational; unparsable is treated as unknown)
+	if s, err := asString(m["updatedAt"]); err == nil {
+		ur.UpdatedAt, _ = time.Parse(time.RFC3339, s)
+	}
+
 	return ur, nil
 }
 
@@ -283,6 +482,18 @@ func kvV2DataPath(usersPrefix, username string) string {
 	return fmt.Sprintf("%s/data/%s/%s", mount, rest, username)
 }
 
+// kvV2MetadataPath is kvV2DataPath for the metadata endpoint (list and
+// permanent delete).
+func kvV2MetadataPath(prefix, name string) string {
+	p := strings.Trim(prefix, "/")
+	parts := strings.SplitN(p, "/", 2)
+	rest := ""
+	if len(parts) == 2 {
+		rest = strings.TrimPrefix(parts[1], "data/")
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%s/metadata/%s/%s", parts[0], rest, name), "/")
+}
+
 // --- small in-memory cache to reduce Vault calls ---
 type cachedUser struct {
 	u       userRecord
@@ -290,16 +501,18 @@ type cachedUser struct {
 }
 
 type userCache struct {
-	ttl   time.Duration
-	store map[string]cachedUser
-	mu    chan struct{}
+	ttl          time.Duration
+	groupsPrefix string
+	store        map[string]cachedUser
+	mu           chan struct{}
 }
 
-func newUserCache(ttl time.Duration) *userCache {
+func newUserCache(ttl time.Duration, groupsPrefix string) *userCache {
 	return &userCache{
-		ttl:   ttl,
-		store: map[string]cachedUser{},
-		mu:    make(chan struct{}, 1),
+		ttl:          ttl,
+		groupsPrefix: groupsPrefix,
+		store:        map[string]cachedUser{},
+		mu:           make(chan struct{}, 1),
 	}
 }
 
@@ -318,6 +531,9 @@ func (c *userCache) getOrLoad(ctx context.Context, vc *vault.Client, prefix, use
 	c.unlock()
 
 	u, err := loadUserFromVault(ctx, vc, prefix, username)
+	if err == nil {
+		err = applyGroups(ctx, vc, c.groupsPrefix, &u)
+	}
 	if err != nil {
 		return userRecord{}, err
 	}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/pkg/sftp"
+)
+
+// legalHold pins every file under Path (SFTP-visible, relative to the user's
+// root) until it is released through admin-api, regardless of retention.
+// Holds are stored per user in Vault under VAULT_HOLDS_PREFIX.
+type legalHold struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Reason   string `json:"reason,omitempty"`
+	PlacedBy string `json:"placedBy,omitempty"`
+	PlacedAt string `json:"placedAt,omitempty"`
+}
+
+// wormPolicy decides whether a committed file may still be overwritten,
+// removed, renamed or have its attributes changed.
+//
+// A file is protected when it is covered by a legal hold, or when it lives in
+// an immutable area (the whole root, or one of paths) and its modification
+// time plus retention is still in the future. A zero retention means
+// "immutable forever".
+type wormPolicy struct {
+	immutable bool
+	paths     []string
+	retention time.Duration
+
+	// holds returns the user's active legal holds; nil means none. An
+	// error (holds unknown) protects every committed file of a WORM user;
+	// for other users it counts as no holds.
+	holds func() ([]legalHold, error)
+}
+
+// worm reports whether the user has immutable storage configured.
+func (w wormPolicy) worm() bool {
+	return w.immutable || len(w.paths) > 0
+}
+
+// enabled reports whether any file of the user can be protected: WORM
+// users always, others only while they have legal holds.
+func (w wormPolicy) enabled() bool {
+	if w.worm() {
+		return true
+	}
+	holds, _ := w.activeHolds()
+	return len(holds) > 0
+}
+
+// activeHolds looks up the user's holds. Lookup errors only reach WORM users;
+// holdCache keeps serving the last known holds after an error, so files that
+// were already held stay protected either way.
+func (w wormPolicy) activeHolds() ([]legalHold, error) {
+	if w.holds == nil {
+		return nil, nil
+	}
+	holds, err := w.holds()
+	if err != nil && !w.worm() {
+		return nil, nil
+	}
+	return holds, err
+}
+
+func (w wormPolicy) covers(rel string) bool {
+	if w.immutable {
+		return true
+	}
+	for _, p := range w.paths {
+		if pathCovers(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a permission-denied error if the committed file at abs
+// (SFTP path rel) may not be modified yet. Missing files and directories are
+// never protected by check; use checkTree for directories.
+func (w wormPolicy) check(abs, rel string) error {
+	if !w.enabled() {
+		return nil
+	}
+	info, err := os.Lstat(abs)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	return w.checkInfo(rel, info)
+}
+
+func (w wormPolicy) checkInfo(rel string, info os.FileInfo) error {
+	holds, err := w.activeHolds()
+	if err != nil {
+		return fmt.Errorf("%w: legal holds unavailable: %v", sftp.ErrSSHFxPermissionDenied, err)
+	}
+	for _, h := range holds {
+		if pathCovers(h.Path, rel) {
+			return fmt.Errorf("%w: %s is under legal hold %s", sftp.ErrSSHFxPermissionDenied, rel, h.ID)
+		}
+	}
+
+	if !w.covers(rel) {
+		return nil
+	}
+	if w.retention <= 0 {
+		return fmt.Errorf("%w: %s is immutable", sftp.ErrSSHFxPermissionDenied, rel)
+	}
+	until := info.ModTime().Add(w.retention)
+	if time.Now().Before(until) {
+		return fmt.Errorf("%w: %s is retained until %s", sftp.ErrSSHFxPermissionDenied, rel, until.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkTree is check for a path that may be a directory: every committed file
+// underneath must be modifiable for the directory to be renamed.
+func (w wormPolicy) checkTree(abs, rel string) error {
+	if !w.enabled() {
+		return nil
+	}
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return nil
+	}
+	if !info.IsDir() {
+		return w.checkInfo(rel, info)
+	}
+	return filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sub, err := filepath.Rel(abs, p)
+		if err != nil {
+			return err
+		}
+		return w.checkInfo(path.Join(rel, filepath.ToSlash(sub)), info)
+	})
+}
+
+// pathCovers reports whether SFTP path rel equals prefix or lives below it.
+func pathCovers(prefix, rel string) bool {
+	prefix = path.Clean("/" + strings.TrimSpace(prefix))
+	rel = path.Clean("/" + rel)
+	if prefix == "/" || rel == prefix {
+		return true
+	}
+	return strings.HasPrefix(rel, prefix+"/")
+}
+
+// --- legal hold lookup (cached, like userCache) ---
+
+type cachedHolds struct {
+	holds   []legalHold
+	expires time.Time
+}
+
+type holdCache struct {
+	vc      *vault.Client
+	prefix  string
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	store map[string]cachedHolds
+}
+
+func newHoldCache(vc *vault.Client, prefix string, timeout, ttl time.Duration) *holdCache {
+	return &holdCache{
+		vc:      vc,
+		prefix:  prefix,
+		timeout: timeout,
+		ttl:     ttl,
+		store:   map[string]cachedHolds{},
+	}
+}
+
+// get returns the user's holds. On Vault errors the last known holds are kept
+// (fail closed for data that was already protected); with none known, the
+// error is returned and the caller must deny.
+func (c *holdCache) get(username string) ([]legalHold, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	ch, ok := c.store[username]
+	c.mu.Unlock()
+	if ok && now.Before(ch.expires) {
+		return ch.holds, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	holds, err := loadHoldsFromVault(ctx, c.vc, c.prefix, username)
+	if err != nil {
+		audit(username, "", "holds_load_failed", "", "", 0, err)
+		if !ok {
+			return nil, err
+		}
+		return ch.holds, nil
+	}
+
+	c.mu.Lock()
+	c.store[username] = cachedHolds{holds: holds, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return holds, nil
+}
+
+func loadHoldsFromVault(ctx context.Context, vc *vault.Client, holdsPrefix, username string) ([]legalHold, error) {
+	sec, err := vc.Logical().ReadWithContext(ctx, kvV2DataPath(holdsPrefix, username))
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, nil
+	}
+	raw, ok := sec.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(raw["holds"])
+	if err != nil {
+		return nil, fmt.Errorf("marshal holds failed: %w", err)
+	}
+	var holds []legalHold
+	if err := json.Unmarshal(b, &holds); err != nil {
+		return nil, fmt.Errorf("decode holds failed: %w", err)
+	}
+	return holds, nil
+}
@@ -3,10 +3,13 @@ module example.com/sftp-server
 go 1.24.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/hashicorp/vault/api v1.22.0
 	github.com/pkg/sftp v1.13.10
 	github.com/prometheus/client_golang v1.23.2
 	golang.org/x/crypto v0.46.0
+	golang.org/x/time v0.12.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -36,6 +39,5 @@ require (
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
-	golang.org/x/time v0.12.0 // indirect
 	google.golang.org/protobuf v1.36.8 // indirect
 )
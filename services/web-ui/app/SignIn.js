@@ -0,0 +1,65 @@
+"use client";
+
+import { useEffect, useState } from "react";
+import { getCredential, setCredential } from "./credential";
+
+const input = {
+  padding: "8px 10px",
+  borderRadius: 12,
+  border: "1px solid rgba(255,255,255,0.14)",
+  background: "rgba(0,0,0,0.25)",
+  color: "#e5e7eb",
+  outline: "none",
+  width: 180,
+};
+
+const btn = {
+  padding: "8px 10px",
+  borderRadius: 12,
+  border: "1px solid rgba(255,255,255,0.12)",
+  background: "rgba(255,255,255,0.04)",
+  color: "#e5e7eb",
+  cursor: "pointer",
+};
+
+// SignIn asks for the admin-api credential the UI acts with (see
+// credential.js). Pages reload after a change so they fetch again.
+export default function SignIn() {
+  const [signedIn, setSignedIn] = useState(false);
+  const [value, setValue] = useState("");
+
+  useEffect(() => {
+    setSignedIn(getCredential() !== "");
+  }, []);
+
+  function signIn(e) {
+    e.preventDefault();
+    if (!value.trim()) return;
+    setCredential(value.trim());
+    window.location.reload();
+  }
+
+  function signOut() {
+    setCredential("");
+    window.location.reload();
+  }
+
+  if (signedIn) {
+    return (
+      <button type="button" style={btn} onClick={signOut}>Sign out</button>
+    );
+  }
+  return (
+    <form onSubmit={signIn} style={{ display: "flex", gap: 8 }}>
+      <input
+        type="password"
+        style={input}
+        placeholder="Admin API key or token"
+        autoComplete="off"
+        value={value}
+        onChange={(e) => setValue(e.target.value)}
+      />
+      <button type="submit" style={btn}>Sign in</button>
+    </form>
+  );
+}
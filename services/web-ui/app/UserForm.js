@@ -1,5 +1,7 @@
 "use client";
 
+import { withCredential } from "./credential";
+
 export default function UserForm() {
   async function onSubmit(e) {
     e.preventDefault();
@@ -7,11 +9,11 @@ export default function UserForm() {
     const username = form.get("username");
     const key = form.get("publicKey");
 
-    const res = await fetch("/api/users", {
+    const res = await fetch("/api/users", withCredential({
       method: "POST",
       headers: {"Content-Type":"application/json"},
       body: JSON.stringify({ username, publicKeys: [key] })
-    });
+    }));
 
     const text = await res.text();
     alert(res.ok ? "Saved in Vault." : text);
@@ -0,0 +1,8 @@
+// Headers for requests to admin-api. The credential the browser sent (the
+// signed-in person's API key or token, see app/credential.js) is passed on
+// unchanged; the UI has none of its own, so admin-api applies that
+// person's role and tenant and refuses requests without one.
+export function adminHeaders(req, headers = {}) {
+  const auth = req.headers.get("authorization");
+  return auth ? { ...headers, "Authorization": auth } : headers;
+}
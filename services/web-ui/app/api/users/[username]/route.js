@@ -1,15 +1,30 @@
-export async function GET(_req, { params }) {
+import { adminHeaders } from "../../adminApi";
+
+// If-Match / ETag carry the record version admin-api uses to reject
+// updates based on a stale read.
+function withIfMatch(req, headers) {
+  const ifMatch = req.headers.get("if-match");
+  return ifMatch ? { ...headers, "If-Match": ifMatch } : headers;
+}
+
+function proxyHeaders(res) {
+  const headers = { "Content-Type": res.headers.get("content-type") || "application/json" };
+  const etag = res.headers.get("etag");
+  return etag ? { ...headers, "ETag": etag } : headers;
+}
+
+export async function GET(req, { params }) {
   const base = process.env.ADMIN_API_BASE_URL || "http://admin-api:8080";
   const res = await fetch(`${base}/api/v1/users/${encodeURIComponent(params.username)}`, {
     method: "GET",
-    headers: { "Accept": "application/json" },
+    headers: adminHeaders(req, { "Accept": "application/json" }),
     cache: "no-store",
   });
 
   const text = await res.text();
   return new Response(text, {
     status: res.status,
-    headers: { "Content-Type": res.headers.get("content-type") || "application/json" },
+    headers: proxyHeaders(res),
   });
 }
 
@@ -19,14 +34,14 @@ export async function PUT(req, { params }) {
 
   const res = await fetch(`${base}/api/v1/users/${encodeURIComponent(params.username)}`, {
     method: "PUT",
-    headers: { "Content-Type": "application/json", "Accept": "application/json" },
+    headers: adminHeaders(req, withIfMatch(req, { "Content-Type": "application/json", "Accept": "application/json" })),
     body: JSON.stringify(body),
   });
 
   const text = await res.text();
   return new Response(text, {
     status: res.status,
-    headers: { "Content-Type": res.headers.get("content-type") || "application/json" },
+    headers: proxyHeaders(res),
   });
 }
 
@@ -36,28 +51,29 @@ export async function PATCH(req, { params }) {
 
   const res = await fetch(`${base}/api/v1/users/${encodeURIComponent(params.username)}`, {
     method: "PATCH",
-    headers: { "Content-Type": "application/json", "Accept": "application/json" },
+    headers: adminHeaders(req, withIfMatch(req, { "Content-Type": "application/json", "Accept": "application/json" })),
     body: JSON.stringify(body),
   });
 
   const text = await res.text();
   return new Response(text, {
     status: res.status,
-    headers: { "Content-Type": res.headers.get("content-type") || "application/json" },
+    headers: proxyHeaders(res),
   });
 }
 
-export async function DELETE(_req, { params }) {
+export async function DELETE(req, { params }) {
   const base = process.env.ADMIN_API_BASE_URL || "http://admin-api:8080";
-  const res = await fetch(`${base}/api/v1/users/${encodeURIComponent(params.username)}`, {
+  const { search } = new URL(req.url);
+  const res = await fetch(`${base}/api/v1/users/${encodeURIComponent(params.username)}${search}`, {
     method: "DELETE",
-    headers: { "Accept": "application/json" },
+    headers: adminHeaders(req, withIfMatch(req, { "Accept": "application/json" })),
   });
 
   const text = await res.text();
   return new Response(text, {
     status: res.status,
-    headers: { "Content-Type": res.headers.get("content-type") || "application/json" },
+    headers: proxyHeaders(res),
   });
 }
 
@@ -1,3 +1,5 @@
+import { adminHeaders } from "../adminApi";
+
 export async function GET(req) {
   const base = process.env.ADMIN_API_BASE_URL || "http://admin-api:8080";
   const url = new URL(req.url);
@@ -5,7 +7,7 @@ export async function GET(req) {
 
   const res = await fetch(`${base}/api/v1/users${qs}`, {
     method: "GET",
-    headers: { "Accept": "application/json" },
+    headers: adminHeaders(req, { "Accept": "application/json" }),
     cache: "no-store",
   });
 
@@ -22,7 +24,7 @@ export async function POST(req) {
 
   const res = await fetch(`${base}/api/v1/users`, {
     method: "POST",
-    headers: { "Content-Type": "application/json", "Accept": "application/json" },
+    headers: adminHeaders(req, { "Content-Type": "application/json", "Accept": "application/json" }),
     body: JSON.stringify(body),
   });
 
@@ -1,6 +1,7 @@
 "use client";
 
 import { useState } from "react";
+import { withCredential } from "../credential";
 
 const card = {
   background: "rgba(255,255,255,0.06)",
@@ -32,7 +33,7 @@ const btn = {
 };
 
 async function apiFetch(url, init) {
-  const res = await fetch(url, init);
+  const res = await fetch(url, withCredential(init));
   const ct = res.headers.get("content-type") || "";
   const body = ct.includes("application/json") ? await res.json() : await res.text();
   if (!res.ok) {
@@ -0,0 +1,22 @@
+// The admin-api credential of the person using the UI: an API key or an
+// OIDC access token. It is kept in sessionStorage (this tab only) and sent
+// with every request; the API routes pass it on and admin-api checks it.
+// The UI has no credential of its own.
+const STORAGE_KEY = "adminApiCredential";
+
+export function getCredential() {
+  if (typeof window === "undefined") return "";
+  return window.sessionStorage.getItem(STORAGE_KEY) || "";
+}
+
+export function setCredential(value) {
+  if (value) window.sessionStorage.setItem(STORAGE_KEY, value);
+  else window.sessionStorage.removeItem(STORAGE_KEY);
+}
+
+// withCredential adds the Authorization header to fetch options.
+export function withCredential(init = {}) {
+  const credential = getCredential();
+  if (!credential) return init;
+  return { ...init, headers: { ...(init.headers || {}), "Authorization": `Bearer ${credential}` } };
+}
@@ -1,3 +1,5 @@
+import SignIn from "./SignIn";
+
 export const metadata = {
   title: "SFTP Admin",
   description: "Admin portal for managing SFTP users stored in Vault",
@@ -67,6 +69,7 @@ export default function RootLayout({ children }) {
               <a href="/users" style={linkStyle}>Users</a>
               <a href="/create" style={linkStyle}>Create User</a>
               <a href="/system" style={linkStyle}>System</a>
+              <SignIn />
             </nav>
           </div>
 
@@ -1,6 +1,7 @@
 "use client";
 
 import { useEffect, useState } from "react";
+import { withCredential } from "../../credential";
 
 const card = {
   background: "rgba(255,255,255,0.06)",
@@ -42,7 +43,7 @@ function fmtTime(iso) {
 }
 
 async function apiFetch(url, init) {
-  const res = await fetch(url, init);
+  const res = await fetch(url, withCredential(init));
   const ct = res.headers.get("content-type") || "";
   const body = ct.includes("application/json") ? await res.json() : await res.text();
   if (!res.ok) {
@@ -78,6 +79,7 @@ export default function UserDetailPage({ params }) {
   const [rootSubdir, setRootSubdir] = useState("");
   const [keysText, setKeysText] = useState("");
   const [updatedAt, setUpdatedAt] = useState("");
+  const [version, setVersion] = useState(0);
 
   async function load() {
     setLoading(true);
@@ -92,6 +94,7 @@ export default function UserDetailPage({ params }) {
       if (Array.isArray(u.publicKeys)) setKeysText(joinKeys(u.publicKeys, "\n"));
       else setKeysText("");
       setUpdatedAt(u.updatedAt || "");
+      setVersion(u.version || 0);
     } catch (e) {
       setErr(e.message || String(e));
     } finally {
@@ -116,7 +119,7 @@ export default function UserDetailPage({ params }) {
       await apiFetch(`/api/users/${encodeURIComponent(username)}`, {
         method: "PUT",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ username, ...payload }),
+        body: JSON.stringify({ username, version, ...payload }),
       });
 
       setMsg("Saved.");
@@ -128,10 +131,10 @@ export default function UserDetailPage({ params }) {
 
   async function onDelete() {
     setMsg("");
-    if (!confirm(`Delete user "${username}"? This removes the Vault record.`)) return;
+    if (!confirm(`Delete user "${username}"? An admin can undelete it for a limited time.`)) return;
 
     try {
-      await apiFetch(`/api/users/${encodeURIComponent(username)}`, { method: "DELETE" });
+      await apiFetch(`/api/users/${encodeURIComponent(username)}?version=${version}`, { method: "DELETE" });
       window.location.href = "/users";
     } catch (e) {
       setMsg(`Error: ${e.message || String(e)}`);
@@ -1,6 +1,7 @@
 "use client";
 
 import { useEffect, useMemo, useState } from "react";
+import { withCredential } from "../credential";
 
 const card = {
   background: "rgba(255,255,255,0.06)",
@@ -53,7 +54,7 @@ function fmtTime(iso) {
 }
 
 async function apiFetch(url, init) {
-  const res = await fetch(url, init);
+  const res = await fetch(url, withCredential(init));
   const ct = res.headers.get("content-type") || "";
   const body = ct.includes("application/json") ? await res.json() : await res.text();
 
@@ -73,6 +74,8 @@ export default function UsersPage() {
   const [loading, setLoading] = useState(true);
   const [err, setErr] = useState("");
   const [users, setUsers] = useState([]);
+  const [total, setTotal] = useState(0);
+  const [nextCursor, setNextCursor] = useState("");
 
   const queryString = useMemo(() => {
     const p = new URLSearchParams();
@@ -83,14 +86,18 @@ export default function UsersPage() {
     return p.toString();
   }, [q, status]);
 
-  async function load() {
+  // load fetches the first page, or the page after cursor (appended).
+  async function load(cursor) {
     setLoading(true);
     setErr("");
     try {
-      const data = await apiFetch(`/api/users?${queryString}`, { method: "GET" });
+      const qs = cursor ? `${queryString}&cursor=${encodeURIComponent(cursor)}` : queryString;
+      const data = await apiFetch(`/api/users?${qs}`, { method: "GET" });
       // supports either {ok,data} or raw array (defensive)
       const rows = Array.isArray(data) ? data : data?.data || [];
-      setUsers(rows);
+      setUsers((prev) => (cursor ? [...prev, ...rows] : rows));
+      setTotal(data?.total ?? rows.length);
+      setNextCursor(data?.nextCursor || "");
     } catch (e) {
       setErr(e.message || String(e));
     } finally {
@@ -112,7 +119,7 @@ export default function UsersPage() {
       await apiFetch(`/api/users/${encodeURIComponent(u.username)}`, {
         method: "PATCH",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ disabled: nextDisabled }),
+        body: JSON.stringify({ disabled: nextDisabled, version: u.version }),
       });
       await load();
     } catch (e) {
@@ -147,7 +154,7 @@ export default function UsersPage() {
             </select>
           </div>
 
-          <button style={btn} onClick={load}>Refresh</button>
+          <button style={btn} onClick={() => load()}>Refresh</button>
           <a href="/create" style={{ ...btn, textDecoration: "none", display: "inline-flex", alignItems: "center" }}>
             + Create
           </a>
@@ -158,7 +165,7 @@ export default function UsersPage() {
         <div style={{ display: "flex", alignItems: "center", justifyContent: "space-between", gap: 10 }}>
           <div style={{ fontWeight: 900, fontSize: 16 }}>Users</div>
           <div style={{ fontSize: 12, opacity: 0.8 }}>
-            {loading ? "Loading…" : `${users.length} user(s)`}
+            {loading ? "Loading…" : users.length < total ? `${users.length} of ${total} user(s)` : `${users.length} user(s)`}
           </div>
         </div>
 
@@ -178,6 +185,7 @@ export default function UsersPage() {
                 <th style={{ padding: "10px 8px" }}>Root Subdir</th>
                 <th style={{ padding: "10px 8px" }}>Keys</th>
                 <th style={{ padding: "10px 8px" }}>Updated</th>
+                <th style={{ padding: "10px 8px" }}>Last login</th>
                 <th style={{ padding: "10px 8px" }}>Actions</th>
               </tr>
             </thead>
@@ -214,6 +222,9 @@ export default function UsersPage() {
                     <td style={{ padding: "12px 8px", fontSize: 13, opacity: 0.9 }}>
                       {fmtTime(u.updatedAt)}
                     </td>
+                    <td style={{ padding: "12px 8px", fontSize: 13, opacity: 0.9 }} title={u.lastLoginIP || ""}>
+                      {fmtTime(u.lastLoginAt)}
+                    </td>
                     <td style={{ padding: "12px 8px" }}>
                       <div style={{ display: "flex", gap: 8, flexWrap: "wrap" }}>
                         <a href={`/users/${encodeURIComponent(u.username)}`} style={{ ...btn, textDecoration: "none" }}>
@@ -230,7 +241,7 @@ export default function UsersPage() {
 
               {!loading && users.length === 0 ? (
                 <tr>
-                  <td colSpan={6} style={{ padding: 14, opacity: 0.8 }}>
+                  <td colSpan={7} style={{ padding: 14, opacity: 0.8 }}>
                     No users found.
                   </td>
                 </tr>
@@ -238,6 +249,14 @@ export default function UsersPage() {
             </tbody>
           </table>
         </div>
+
+        {nextCursor ? (
+          <div style={{ marginTop: 12, display: "flex", justifyContent: "center" }}>
+            <button style={btn} disabled={loading} onClick={() => load(nextCursor)}>
+              Load more
+            </button>
+          </div>
+        ) : null}
       </div>
     </div>
   );